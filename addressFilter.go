@@ -0,0 +1,184 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Banned addresses, keyed either on a bare IP (which bans every port) or on
+// a node address ("ip:port").
+var bannedAddresses = struct {
+	sync.RWMutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// Ban evicts the node at the address from the known nodes, and stops it from
+// being added again: packets from it are dropped, and gossip about it is
+// ignored. The address is either an IP, which bans every port at it, or
+// IP:PORT. The ban lasts until Unban() is called with the same address.
+func Ban(address string) error {
+	key, err := banKey(address)
+	if err != nil {
+		return err
+	}
+
+	bannedAddresses.Lock()
+	bannedAddresses.m[key] = true
+	bannedAddresses.Unlock()
+
+	logInfo("Banned", key)
+
+	evictForbiddenNodes()
+
+	return nil
+}
+
+// Unban lifts a ban placed by Ban(). The node isn't added again until it's
+// heard from or gossiped about.
+func Unban(address string) error {
+	key, err := banKey(address)
+	if err != nil {
+		return err
+	}
+
+	bannedAddresses.Lock()
+	delete(bannedAddresses.m, key)
+	bannedAddresses.Unlock()
+
+	return nil
+}
+
+// Returns the key under which an address passed to Ban() is stored: the IP
+// alone if no port was given, or the normalized node address otherwise.
+func banKey(address string) (string, error) {
+	if ip := net.ParseIP(strings.Trim(address, "[]")); ip != nil {
+		return ip.String(), nil
+	}
+
+	ip, port, err := parseNodeAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	return nodeAddressString(ip, port), nil
+}
+
+// Returns whether a member at the IP and port may be known. This host always
+// may; any other mustn't be banned, blocked, or outside the allowed networks.
+func addressPermitted(ip net.IP, port uint16) bool {
+	address := nodeAddressString(ip, port)
+	if address == thisHostAddress {
+		return true
+	}
+
+	bannedAddresses.RLock()
+	banned := bannedAddresses.m[ip.String()] || bannedAddresses.m[address]
+	bannedAddresses.RUnlock()
+
+	if banned {
+		return false
+	}
+
+	for _, network := range GetBlockedNetworks() {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	allowed := GetAllowedNetworks()
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Convenience function. Returns whether the node may be known.
+func nodePermitted(node *Node) bool {
+	return addressPermitted(node.IP(), node.Port())
+}
+
+// Counts a packet dropped because its source isn't permitted.
+func noteForbiddenPacket(addr *net.UDPAddr) {
+	atomic.AddUint64(&metrics.packetsForbidden, 1)
+
+	logfTrace("Dropping packet from forbidden address %v", addr)
+}
+
+// Removes any known nodes that are no longer permitted, as after a ban or a
+// change to the allowed or blocked networks.
+func evictForbiddenNodes() {
+	for _, node := range knownNodes.values() {
+		if !nodePermitted(node) {
+			removeNode(node, EventLeft)
+		}
+	}
+}
+
+// Parses a list of networks given as CIDRs, or as IPs meaning single-address
+// networks. Invalid entries are skipped, and described by the returned error;
+// the valid ones are returned regardless.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+
+	var invalid []string
+
+	for _, value := range values {
+		network, err := parseNetwork(value)
+		if err != nil {
+			invalid = append(invalid, value)
+			continue
+		}
+
+		networks = append(networks, network)
+	}
+
+	if len(invalid) > 0 {
+		return networks, fmt.Errorf("%s isn't a CIDR or an IP", strings.Join(invalid, ", "))
+	}
+
+	return networks, nil
+}
+
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+
+	ip := net.ParseIP(strings.Trim(value, "[]"))
+	if ip == nil {
+		return nil, fmt.Errorf("%s isn't an IP", value)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
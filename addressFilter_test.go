@@ -0,0 +1,113 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks([]string{"10.0.0.0/8", "192.168.1.7", "fd00::/8", "bogus"})
+	if err == nil {
+		t.Error("Expected an error for the invalid entry")
+	}
+
+	expected := []string{"10.0.0.0/8", "192.168.1.7/32", "fd00::/8"}
+
+	if len(networks) != len(expected) {
+		t.Fatalf("Expected %v, found %v", expected, networks)
+	}
+
+	for i, network := range networks {
+		if network.String() != expected[i] {
+			t.Errorf("Expected %s, found %s", expected[i], network)
+		}
+	}
+}
+
+func TestAddressPermitted(t *testing.T) {
+	defer SetAllowedNetworks(GetAllowedNetworks())
+	defer SetBlockedNetworks(GetBlockedNetworks())
+
+	allowed, _ := parseNetworks([]string{"10.0.0.0/8"})
+	blocked, _ := parseNetworks([]string{"10.9.0.0/16"})
+
+	SetAllowedNetworks(allowed)
+	SetBlockedNetworks(blocked)
+
+	cases := map[string]bool{
+		"10.1.2.3":    true,
+		"10.9.2.3":    false,
+		"192.168.1.1": false,
+	}
+
+	for address, expected := range cases {
+		if addressPermitted(net.ParseIP(address), 9999) != expected {
+			t.Errorf("%s: expected permitted=%v", address, expected)
+		}
+	}
+
+	SetAllowedNetworks(nil)
+
+	if !addressPermitted(net.ParseIP("192.168.1.1"), 9999) {
+		t.Error("Expected any unblocked address to be permitted with no allowlist")
+	}
+}
+
+// A banned node should be evicted, and gossip about it shouldn't add it back
+// until it's unbanned.
+func TestBan(t *testing.T) {
+	nodes, cleanup := populateRegistry(2)
+	defer cleanup()
+
+	banned := nodes[0]
+
+	err := Ban(banned.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Unban(banned.Address())
+
+	if knownNodes.contains(banned) {
+		t.Fatal("Expected the banned node to be evicted")
+	}
+
+	if !knownNodes.contains(nodes[1]) {
+		t.Error("Expected the other node to be kept")
+	}
+
+	gossip := &Node{ip: banned.ip, port: banned.port}
+
+	msg := newMessage(verbPing, nodes[1], nodes[1].Heartbeat())
+	msg.addMember(gossip, StatusAlive, banned.Heartbeat()+1, nodes[1])
+
+	updateStatusesFromMessage(msg)
+
+	if knownNodes.containsByAddress(banned.Address()) {
+		t.Error("Expected gossip about the banned node to be ignored")
+	}
+
+	// Banning the bare IP bans every port at it.
+	Unban(banned.Address())
+	Ban(banned.IP().String())
+	defer Unban(banned.IP().String())
+
+	if addressPermitted(banned.IP(), 1234) {
+		t.Error("Expected every port at a banned IP to be forbidden")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// The cluster sizes that the benchmarks are run at.
+var benchmarkSizes = []int{100, 1000, 10000}
+
+// The operations that are benchmarked, and whose cost must stay (close to)
+// flat as the cluster grows. Each is passed the registry's nodes and the
+// iteration.
+var scalingOperations = []struct {
+	name string
+	op   func(nodes []*Node, i int)
+}{
+	// Composing, encoding and queueing a message with piggybacked updates.
+	{"TransmitMessage", func(nodes []*Node, i int) {
+		node := nodes[i%len(nodes)]
+
+		// Keep the updates coming, so that the queue stays full.
+		node.setEmitCounter(int8(emitCount()))
+		updatedNodes.push(node)
+
+		msg := newMessage(verbPing, thisHost, uint32(i))
+		transmitMessageUDP(node, msg)
+	}},
+
+	// Choosing the relays for a ping request.
+	{"GetTargetNodes", func(nodes []*Node, i int) {
+		getTargetNodes(pingRequestCount(), thisHost, nodes[i%len(nodes)])
+	}},
+
+	// A status change, including the counts in its log line. Each node is
+	// suspected and then cleared in turn.
+	{"UpdateNodeStatus", func(nodes []*Node, i int) {
+		node := nodes[(i/2)%len(nodes)]
+		status := []NodeStatus{StatusSuspected, StatusAlive}[i%2]
+
+		updateNodeStatus(node, status, node.Heartbeat(), thisHost,
+			newStatusCause(ReasonExplicit))
+	}},
+}
+
+// Discards queued packets, rather than sending them, until the returned
+// function is called.
+func discardOutboundPackets() func() {
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-outboundPackets:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func benchmarkOperation(b *testing.B, op func(nodes []*Node, i int)) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("members=%d", size), func(b *testing.B) {
+			nodes, cleanup := populateRegistry(size)
+			defer cleanup()
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				op(nodes, i)
+			}
+		})
+	}
+}
+
+func BenchmarkTransmitMessage(b *testing.B) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Skip("cannot open a loopback socket:", err)
+	}
+	defer c.Close()
+
+	conn := udpConn
+	udpConn = c
+	defer func() { udpConn = conn }()
+
+	defer discardOutboundPackets()()
+
+	benchmarkOperation(b, scalingOperations[0].op)
+}
+
+func BenchmarkGetTargetNodes(b *testing.B) {
+	benchmarkOperation(b, scalingOperations[1].op)
+}
+
+func BenchmarkUpdateNodeStatus(b *testing.B) {
+	benchmarkOperation(b, scalingOperations[2].op)
+}
@@ -24,14 +24,6 @@ import (
 	"sync"
 )
 
-const (
-	// Emit counters for broadcasts can be less than 0. We transmit positive
-	// numbers, and decrement all the others. At this value, the broadcast
-	// is removed from the map all together. This ensures broadcasts are
-	// emitted briefly, but retained long enough to not be received twice.
-	broadcastRemoveValue int8 = int8(-100)
-)
-
 // The index counter value for the next broadcast message
 var indexCounter uint32 = 1
 
@@ -51,8 +43,24 @@ type Broadcast struct {
 	index       uint32
 	label       string
 	emitCounter int8
+	kind        broadcastType
 }
 
+// broadcastType distinguishes user broadcasts from the broadcasts used
+// internally by Smudge to propagate other cluster-wide messages.
+type broadcastType byte
+
+const (
+	// A user broadcast, as emitted by BroadcastBytes().
+	broadcastUser broadcastType = iota
+
+	// A query, as emitted by Query().
+	broadcastQuery
+
+	// A forced removal, as emitted by ForceRemove().
+	broadcastForceRemove
+)
+
 // Bytes returns a copy of this broadcast's bytes. Manipulating the contents
 // of this slice will not be reflected in the contents of the broadcast.
 func (b *Broadcast) Bytes() []byte {
@@ -93,12 +101,30 @@ func (b *Broadcast) Origin() *Node {
 // through the cluster will not receive the message. The maximum broadcast
 // length is 256 bytes.
 func BroadcastBytes(bytes []byte) error {
+	_, err := emitBroadcast(broadcastUser, bytes)
+
+	return err
+}
+
+// BroadcastString allows a user to emit a short broadcast in the form of a
+// string, which will be transmitted at most once to all other healthy current
+// members. Members that join after the broadcast has already propagated
+// through the cluster will not receive the message. The maximum broadcast
+// length is 256 bytes.
+func BroadcastString(str string) error {
+	return BroadcastBytes([]byte(str))
+}
+
+// emitBroadcast adds a broadcast of the specified type to the map of emitted
+// broadcasts, from which it will be piggybacked onto outgoing messages.
+// Returns the broadcast's index.
+func emitBroadcast(kind broadcastType, bytes []byte) (uint32, error) {
 	if len(bytes) > GetMaxBroadcastBytes() {
 		emsg := fmt.Sprintf(
 			"broadcast payload length exceeds %d bytes",
 			GetMaxBroadcastBytes())
 
-		return errors.New(emsg)
+		return 0, errors.New(emsg)
 	}
 
 	broadcasts.Lock()
@@ -107,7 +133,8 @@ func BroadcastBytes(bytes []byte) error {
 		origin:      thisHost,
 		index:       indexCounter,
 		bytes:       bytes,
-		emitCounter: int8(emitCount())}
+		emitCounter: int8(emitCount()),
+		kind:        kind}
 
 	broadcasts.m[bcast.Label()] = &bcast
 
@@ -115,16 +142,7 @@ func BroadcastBytes(bytes []byte) error {
 
 	broadcasts.Unlock()
 
-	return nil
-}
-
-// BroadcastString allows a user to emit a short broadcast in the form of a
-// string, which will be transmitted at most once to all other healthy current
-// members. Members that join after the broadcast has already propagated
-// through the cluster will not receive the message. The maximum broadcast
-// length is 256 bytes.
-func BroadcastString(str string) error {
-	return BroadcastBytes([]byte(str))
+	return bcast.index, nil
 }
 
 // Message contents for IPv6
@@ -133,10 +151,11 @@ func BroadcastString(str string) error {
 // Bytes 00-15 Origin IP (00-03 for IPv4)
 // Bytes 16-17 Origin response port (04-05 for IPv4)
 // Bytes 18-21 Origin broadcast counter (06-09 for IPv4)
-// Bytes 22-23 Payload length (bytes) (10-11 for IPv4)
-// Bytes 24-NN Payload (12-NN for IPv4)
+// Bytes 22    Broadcast type (10 for IPv4)
+// Bytes 23-24 Payload length (bytes) (11-12 for IPv4)
+// Bytes 25-NN Payload (13-NN for IPv4)
 func (b *Broadcast) encode() []byte {
-	size := 8 + ipLen + len(b.bytes)
+	size := 9 + ipLen + len(b.bytes)
 	bytes := make([]byte, size, size)
 
 	// Index pointer
@@ -159,10 +178,13 @@ func (b *Broadcast) encode() []byte {
 	// Bytes 18-21 Origin broadcast counter
 	p += encodeUint32(b.index, bytes, p)
 
-	// Bytes 22-23 Payload length (bytes)
+	// Bytes 22 Broadcast type
+	p += encodeByte(byte(b.kind), bytes, p)
+
+	// Bytes 23-24 Payload length (bytes)
 	p += encodeUint16(uint16(len(b.bytes)), bytes, p)
 
-	// Bytes 24-NN Payload
+	// Bytes 25-NN Payload
 	for i, by := range b.bytes {
 		bytes[i+p] = by
 	}
@@ -180,17 +202,25 @@ func (b *Broadcast) encode() []byte {
 // Bytes 00-15 Origin IP (00-03 on IPv4)
 // Bytes 16-17 Origin response port (04-05 on IPv4)
 // Bytes 18-21 Origin broadcast counter (06-09 on IPv4)
-// Bytes 22-23 Payload length (bytes) (10-11 on IPv4)
-// Bytes 24-NN Payload (12-NN on IPv4)
+// Bytes 22    Broadcast type (10 on IPv4)
+// Bytes 23-24 Payload length (bytes) (11-12 on IPv4)
+// Bytes 25-NN Payload (13-NN on IPv4)
 func decodeBroadcast(bytes []byte) (*Broadcast, error) {
 	var index uint32
 	var port uint16
 	var ip net.IP
+	var kind byte
 	var length uint16
 
 	// An index pointer
 	p := 0
 
+	// The origin, counter, type and length are always present.
+	err := checkLength("broadcast", bytes, p, ipLen+9)
+	if err != nil {
+		return nil, err
+	}
+
 	if ipLen == net.IPv6len {
 		// Bytes 00-15 Origin IP
 		ip = make(net.IP, net.IPv6len)
@@ -208,9 +238,21 @@ func decodeBroadcast(bytes []byte) (*Broadcast, error) {
 	// Bytes 18-21 Origin broadcast counter
 	index, p = decodeUint32(bytes, p)
 
-	// Bytes 22-23 Payload length (bytes)
+	// Bytes 22 Broadcast type
+	kind, p = decodeByte(bytes, p)
+
+	// Bytes 23-24 Payload length (bytes)
 	length, p = decodeUint16(bytes, p)
 
+	if int(length) > GetMaxBroadcastBytes() {
+		return nil, &DecodeError{Part: "broadcast", Offset: p - 2, Err: ErrTooLong}
+	}
+
+	err = checkLength("broadcast", bytes, p, int(length))
+	if err != nil {
+		return nil, err
+	}
+
 	// Now that we have the IP and port, we can find the Node.
 	origin := knownNodes.getByIP(ip, port)
 
@@ -219,58 +261,71 @@ func decodeBroadcast(bytes []byte) (*Broadcast, error) {
 		origin, _ = CreateNodeByIP(ip, port)
 	}
 
+	// The message bytes are in a receive buffer that will be reused, so the
+	// payload has to be copied out of it.
+	payload := make([]byte, int(length))
+	copy(payload, bytes[p:p+int(length)])
+
 	bcast := Broadcast{
 		origin:      origin,
 		index:       index,
-		bytes:       bytes[p : p+int(length)],
-		emitCounter: int8(emitCount())}
+		bytes:       payload,
+		emitCounter: int8(emitCount()),
+		kind:        broadcastType(kind)}
 
-	err := checkOrigin(origin)
+	err = checkOrigin(origin)
 	if err != nil {
 		logWarn(err)
 		return &bcast, err
 	}
 
-	if int(length) > GetMaxBroadcastBytes() {
-		return &bcast,
-			errors.New("message length exceeds maximum length")
-	}
-
 	return &bcast, nil
 }
 
 // getBroadcastToEmit identifies the single known broadcast with the highest
-// emitCounter value (which can be negative), and returns it. If multiple
-// broadcasts have the same value, one is arbitrarily chosen.
+// emitCounter value (which can be negative), and decrements its counter.
+// Emit counters for broadcasts can be less than 0. We transmit positive
+// numbers, and decrement all the others. At some value < 0, the broadcast
+// is removed from the map all together. Returns the broadcast if it is to
+// be transmitted, or nil otherwise. If multiple broadcasts have the same
+// value, one is arbitrarily chosen.
 func getBroadcastToEmit() *Broadcast {
-	// Get all broadcast messages.
-	values := make([]*Broadcast, 0, 0)
-	broadcasts.RLock()
-	for _, v := range broadcasts.m {
-		values = append(values, v)
-	}
-	broadcasts.RUnlock()
+	broadcasts.Lock()
+	defer broadcasts.Unlock()
+
+	// Emit counters for broadcasts can be less than 0. We transmit positive
+	// numbers, and decrement all the others. Once a counter reaches minus the
+	// broadcast retention, the broadcast is removed from the map all
+	// together. This ensures broadcasts are emitted briefly, but retained
+	// long enough to not be received twice.
+	removeValue := -GetBroadcastRetention()
 
 	// Remove all overly-emitted messages from the list
-	broadcastSlice := make([]*Broadcast, 0, 0)
-	broadcasts.Lock()
-	for _, b := range values {
-		if b.emitCounter <= broadcastRemoveValue {
+	broadcastSlice := make([]*Broadcast, 0, len(broadcasts.m))
+	for _, b := range broadcasts.m {
+		if int(b.emitCounter) <= removeValue {
 			logDebug("Removing", b.Label(), "from recently updated list")
 			delete(broadcasts.m, b.Label())
 		} else {
 			broadcastSlice = append(broadcastSlice, b)
 		}
 	}
-	broadcasts.Unlock()
 
-	if len(broadcastSlice) > 0 {
-		// Put the newest nodes on top.
-		sort.Sort(byBroadcastEmitCounter(broadcastSlice))
-		return broadcastSlice[0]
+	if len(broadcastSlice) == 0 {
+		return nil
 	}
 
-	return nil
+	// Put the newest nodes on top.
+	sort.Sort(byBroadcastEmitCounter(broadcastSlice))
+
+	broadcast := broadcastSlice[0]
+	broadcast.emitCounter--
+
+	if broadcast.emitCounter < 0 {
+		return nil
+	}
+
+	return broadcast
 }
 
 // receiveBroadcast is called by receiveMessageUDP when a broadcast payload
@@ -286,6 +341,13 @@ func receiveBroadcast(broadcast *Broadcast) {
 		return
 	}
 
+	// The address filter and bans apply to a broadcast's origin as well as
+	// to whoever relayed it, so a banned member can't act through others.
+	if !nodePermitted(broadcast.Origin()) {
+		logfDebug("Ignoring broadcast from forbidden origin %s", broadcast.Origin().Address())
+		return
+	}
+
 	label := broadcast.Label()
 
 	broadcasts.Lock()
@@ -296,11 +358,24 @@ func receiveBroadcast(broadcast *Broadcast) {
 	broadcasts.Unlock()
 
 	if !contains {
-		logfInfo("Broadcast [%s]=%s",
-			label,
-			string(broadcast.Bytes()))
-
-		doBroadcastUpdate(broadcast)
+		switch broadcast.kind {
+		case broadcastQuery:
+			logfDebug("Query [%s]", label)
+
+			receiveQuery(broadcast)
+		case broadcastForceRemove:
+			logfDebug("Forced removal [%s]", label)
+
+			receiveForceRemove(broadcast)
+		default:
+			logfInfo("Broadcast [%s]=%s",
+				label,
+				string(broadcast.Bytes()))
+
+			queueHandlerCall(func() {
+				doBroadcastUpdate(broadcast)
+			})
+		}
 	}
 }
 
@@ -0,0 +1,273 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// When set, TestMultiNodeHelper runs a cluster member rather than returning.
+// Its value is the member's listen port and the port of its seed, separated
+// by a comma.
+const clusterNodeEnvVar = "SMUDGE_TEST_CLUSTER_NODE"
+
+const clusterSize = 4
+
+// clusterMember is a cluster member running in a child process.
+type clusterMember struct {
+	port  int
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	// Closed once the member's output has been read to the end.
+	done chan struct{}
+
+	lock    sync.Mutex
+	healthy int
+	output  strings.Builder
+}
+
+func (m *clusterMember) healthyCount() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.healthy
+}
+
+func (m *clusterMember) outputString() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.output.String()
+}
+
+// Collects the member's output, recording the latest healthy member count
+// that it reports.
+func (m *clusterMember) scan(r io.Reader) {
+	defer close(m.done)
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		m.lock.Lock()
+		m.output.WriteString(line + "\n")
+
+		if strings.HasPrefix(line, "healthy=") {
+			m.healthy, _ = strconv.Atoi(strings.TrimPrefix(line, "healthy="))
+		}
+
+		m.lock.Unlock()
+	}
+}
+
+// Runs a cluster of members in separate processes (built with the race
+// detector, if this test binary was) on the loopback interface, while they
+// broadcast, query each other and message one another concurrently. Once
+// they've converged, one is killed and the others are expected to notice.
+func TestMultiNodeCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping multi-node cluster in short mode")
+	}
+
+	ports := freeUDPPorts(t, clusterSize)
+	members := make([]*clusterMember, clusterSize)
+
+	for i, port := range ports {
+		m := &clusterMember{port: port, done: make(chan struct{})}
+
+		m.cmd = exec.Command(os.Args[0], "-test.run=^TestMultiNodeHelper$")
+		m.cmd.Env = append(os.Environ(),
+			fmt.Sprintf("%s=%d,%d", clusterNodeEnvVar, port, ports[0]))
+
+		stdin, err := m.cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.stdin = stdin
+
+		stdout, err := m.cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m.cmd.Stderr = m.cmd.Stdout
+
+		err = m.cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go m.scan(stdout)
+
+		members[i] = m
+	}
+
+	defer func() {
+		for _, m := range members {
+			m.stdin.Close()
+			<-m.done
+			m.cmd.Wait()
+
+			output := m.outputString()
+			if strings.Contains(output, "DATA RACE") {
+				t.Errorf("Member on port %d reported a data race:\n%s", m.port, output)
+			}
+		}
+	}()
+
+	waitForHealthy(t, members, clusterSize)
+
+	// Kill the last member; the others should mark it as dead.
+	killed := members[len(members)-1]
+	killed.cmd.Process.Kill()
+
+	waitForHealthy(t, members[:len(members)-1], clusterSize-1)
+}
+
+// Runs a single cluster member for TestMultiNodeCluster. It exits when its
+// standard input is closed.
+func TestMultiNodeHelper(t *testing.T) {
+	spec := os.Getenv(clusterNodeEnvVar)
+	if spec == "" {
+		return
+	}
+
+	var port, seed int
+	fmt.Sscanf(spec, "%d,%d", &port, &seed)
+
+	SetLogThreshold(LogOff)
+	SetListenIP(net.IPv4(127, 0, 0, 1))
+	SetListenPort(port)
+	SetMulticastEnabled(false)
+	SetHeartbeatMillis(100)
+
+	if port != seed {
+		node, err := CreateNodeByAddress(fmt.Sprintf("127.0.0.1:%d", seed))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		AddNode(node)
+	}
+
+	SetQueryHandler("port", clusterQueryHandler{})
+
+	go Begin()
+
+	// Consume events, as an application would.
+	events := Events()
+	go func() {
+		for e := range events.C() {
+			_ = e.Node.Address
+		}
+	}()
+
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		os.Exit(0)
+	}()
+
+	for i := 0; ; i++ {
+		time.Sleep(100 * time.Millisecond)
+
+		BroadcastString(fmt.Sprintf("%d:%d", port, i))
+
+		response, err := Query("port", nil, nil, 100*time.Millisecond)
+		if err == nil {
+			go func() {
+				for range response.Responses() {
+				}
+			}()
+		}
+
+		for _, n := range AllNodes() {
+			_ = n.Status.String()
+		}
+
+		for _, info := range HealthyNodes() {
+			if node, _ := LookupNode(info.Address); node != nil {
+				SendTo(node, []byte(fmt.Sprintf("%d:%d", port, i)))
+			}
+		}
+
+		fmt.Printf("healthy=%d\n", len(HealthyNodes()))
+	}
+}
+
+type clusterQueryHandler struct{}
+
+func (clusterQueryHandler) OnQuery(from *Node, name string, payload []byte) ([]byte, error) {
+	return []byte(strconv.Itoa(GetListenPort())), nil
+}
+
+// Waits for every member to report the expected number of healthy members.
+func waitForHealthy(t *testing.T, members []*clusterMember, expected int) {
+	deadline := time.Now().Add(30 * time.Second)
+
+	for time.Now().Before(deadline) {
+		converged := true
+
+		for _, m := range members {
+			if m.healthyCount() != expected {
+				converged = false
+			}
+		}
+
+		if converged {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, m := range members {
+		t.Logf("Member on port %d reports %d healthy; output:\n%s",
+			m.port, m.healthyCount(), m.outputString())
+	}
+
+	t.Fatalf("Members didn't all report %d healthy members", expected)
+}
+
+// Returns distinct UDP ports that are free on the loopback interface.
+func freeUDPPorts(t *testing.T, count int) []int {
+	ports := make([]int, count)
+
+	for i := range ports {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		ports[i] = c.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	return ports
+}
@@ -0,0 +1,482 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Config holds the complete configuration of a member. Rather than building
+// one from scratch, start from the preset that best fits the network
+// (DefaultLANConfig(), DefaultWANConfig() or DefaultLocalConfig()), or load
+// one with LoadConfig(), adjust it as needed, and pass it to ApplyConfig().
+//
+// The keys used for each field in configuration files are given in its
+// comment, along with the environment variable that overrides it.
+type Config struct {
+	// ClusterName is the name of the cluster for the purposes of multicast
+	// announcements (cluster_name, SMUDGE_CLUSTER_NAME). At most 255 bytes.
+	ClusterName string
+
+	// ListenIP is the IP to listen on (listen_ip, SMUDGE_LISTEN_IP).
+	ListenIP net.IP
+
+	// ListenPort is the UDP port to listen on (listen_port,
+	// SMUDGE_LISTEN_PORT).
+	ListenPort int
+
+	// InitialHosts are the addresses, as IP or IP:PORT, of the members
+	// initially known (initial_hosts, SMUDGE_INITIAL_HOSTS).
+	InitialHosts []string
+
+	// MaxBroadcastBytes is the maximum byte length of broadcast payloads
+	// (max_broadcast_bytes, SMUDGE_MAX_BROADCAST_BYTES).
+	MaxBroadcastBytes int
+
+	// MulticastEnabled is whether to announce this member, and listen for
+	// the announcements of others, by multicast (multicast_enabled,
+	// SMUDGE_MULTICAST_ENABLED).
+	MulticastEnabled bool
+
+	// MulticastAddress is the multicast address; empty means 224.0.0.0 for
+	// IPv4 and [ff02::1] for IPv6 (multicast_address,
+	// SMUDGE_MULTICAST_ADDRESS).
+	MulticastAddress string
+
+	// MulticastPort is the multicast announcement listening port
+	// (multicast_port, SMUDGE_MULTICAST_PORT).
+	MulticastPort int
+
+	// MulticastAnnounceIntervalSeconds is the number of seconds between
+	// multicast announcements; zero announces only on startup
+	// (multicast_announce_interval, SMUDGE_MULTICAST_ANNOUNCE_INTERVAL).
+	MulticastAnnounceIntervalSeconds int
+
+	// LogLevel is the logging threshold, by name: "all", "trace", "debug",
+	// "info", "warn", "error", "fatal" or "off" (log_level,
+	// SMUDGE_LOG_LEVEL).
+	LogLevel LogLevel
+
+	// HeartbeatMillis is the probe interval, in milliseconds
+	// (heartbeat_millis, SMUDGE_HEARTBEAT_MILLIS).
+	HeartbeatMillis int
+
+	// PingHistoryFrontload is the ping response time, in milliseconds,
+	// assumed until real ones have been measured. It sets the initial ping
+	// timeouts (ping_history_frontload, SMUDGE_PING_HISTORY_FRONTLOAD).
+	PingHistoryFrontload int
+
+	// MinPingTime is the lower bound on recorded ping response times, in
+	// milliseconds, and so on ping timeouts (min_ping_time,
+	// SMUDGE_MIN_PING_TIME).
+	MinPingTime int
+
+	// Lambda is the retransmit multiplier: each status update is emitted,
+	// and each failed probe is retried through other members, (lambda *
+	// log(node count)) times (lambda, SMUDGE_LAMBDA).
+	Lambda float64
+
+	// IndirectProbeCount is the number of members asked to ping a node
+	// indirectly when a direct ping to it times out. Zero derives it from
+	// Lambda and the cluster size (indirect_probe_count,
+	// SMUDGE_INDIRECT_PROBE_COUNT).
+	IndirectProbeCount int
+
+	// TimeoutToleranceSigmas is how many standard deviations beyond the mean
+	// ping response time the default failure detector waits before timing
+	// out an ACK (timeout_tolerance_sigmas, SMUDGE_TIMEOUT_TOLERANCE_SIGMAS).
+	TimeoutToleranceSigmas float64
+
+	// PingRequestTimeoutMultiplier is how many times longer than a direct
+	// ping a ping request, which takes two round trips, is allowed to take
+	// (ping_request_timeout_multiplier,
+	// SMUDGE_PING_REQUEST_TIMEOUT_MULTIPLIER).
+	PingRequestTimeoutMultiplier float64
+
+	// PingHistorySize is the number of ping response times kept to calculate
+	// timeouts for nodes without enough history of their own
+	// (ping_history_size, SMUDGE_PING_HISTORY_SIZE).
+	PingHistorySize int
+
+	// MaxDeadNodeRetries is how many times a dead node is probed, with
+	// exponential backoff, before it's forgotten (max_dead_node_retries,
+	// SMUDGE_MAX_DEAD_NODE_RETRIES).
+	MaxDeadNodeRetries int
+
+	// ReapTimeoutSeconds is for how many seconds a removed member is
+	// remembered as a tombstone, so that older gossip about it can't add it
+	// back (reap_timeout_seconds, SMUDGE_REAP_TIMEOUT_SECONDS).
+	ReapTimeoutSeconds int
+
+	// BroadcastRetention is for how many more messages a broadcast is
+	// remembered once it's no longer emitted, so that it isn't received
+	// twice. At most 128 (broadcast_retention, SMUDGE_BROADCAST_RETENTION).
+	BroadcastRetention int
+
+	// AllowedNetworks are the networks that members' addresses must belong
+	// to; if there are none, any address is allowed (allowed_networks,
+	// SMUDGE_ALLOWED_NETWORKS). In files and the environment, each is given
+	// as a CIDR or an IP.
+	AllowedNetworks []*net.IPNet
+
+	// BlockedNetworks are the networks that members' addresses must not
+	// belong to (blocked_networks, SMUDGE_BLOCKED_NETWORKS).
+	BlockedNetworks []*net.IPNet
+
+	// SourceRateLimit is the number of packets per second accepted from each
+	// source address, on average; zero disables the limit
+	// (source_rate_limit, SMUDGE_SOURCE_RATE_LIMIT).
+	SourceRateLimit float64
+
+	// SourceRateBurst is the number of packets that a source address can
+	// send in a burst, beyond its rate limit (source_rate_burst,
+	// SMUDGE_SOURCE_RATE_BURST).
+	SourceRateBurst int
+
+	// MaxMembers is the most members, including this one, that can be known
+	// at once; zero disables the limit (max_members, SMUDGE_MAX_MEMBERS).
+	MaxMembers int
+
+	// MaxNewMembers is the most members that can be learned of from other
+	// members in each new member interval; zero disables the limit
+	// (max_new_members, SMUDGE_MAX_NEW_MEMBERS).
+	MaxNewMembers int
+
+	// NewMembersIntervalMillis is the length, in milliseconds, of the
+	// interval to which MaxNewMembers applies (new_members_interval_millis,
+	// SMUDGE_NEW_MEMBERS_INTERVAL_MILLIS).
+	NewMembersIntervalMillis int
+
+	// SnapshotPath is the path of the file in which membership is recorded,
+	// so that a restarted member can rejoin the peers it knew; empty
+	// disables it (snapshot_path, SMUDGE_SNAPSHOT_PATH).
+	SnapshotPath string
+
+	// IsolationThreshold is the fraction of the most live members recently
+	// seen below which this member considers itself isolated, and re-seeds;
+	// zero leaves only the loss of all live members as isolation
+	// (isolation_threshold, SMUDGE_ISOLATION_THRESHOLD).
+	IsolationThreshold float64
+
+	// ReseedIntervalMillis is the delay, in milliseconds, after the first
+	// re-seed of an isolated member, which doubles with each further attempt
+	// (reseed_interval_millis, SMUDGE_RESEED_INTERVAL_MILLIS).
+	ReseedIntervalMillis int
+
+	// ReseedMaxIntervalMillis is the longest delay, in milliseconds, between
+	// re-seeds (reseed_max_interval_millis, SMUDGE_RESEED_MAX_INTERVAL_MILLIS).
+	ReseedMaxIntervalMillis int
+
+	// PartitionThreshold is the fraction of the members that must die within
+	// the partition window for a partition to be suspected; zero disables
+	// partition detection (partition_threshold, SMUDGE_PARTITION_THRESHOLD).
+	PartitionThreshold float64
+
+	// PartitionWindowSeconds is the length, in seconds, of the window within
+	// which deaths are taken together as evidence of a partition
+	// (partition_window_seconds, SMUDGE_PARTITION_WINDOW_SECONDS).
+	PartitionWindowSeconds int
+
+	// PartitionRedialTimeoutSeconds is how long, in seconds, the members lost
+	// to a suspected partition are redialed for
+	// (partition_redial_timeout_seconds,
+	// SMUDGE_PARTITION_REDIAL_TIMEOUT_SECONDS).
+	PartitionRedialTimeoutSeconds int
+}
+
+// DefaultLANConfig returns a configuration suited to a local area network,
+// which is also the default.
+func DefaultLANConfig() Config {
+	return Config{
+		ClusterName:                      DefaultClusterName,
+		ListenIP:                         net.ParseIP(DefaultListenIP),
+		ListenPort:                       DefaultListenPort,
+		InitialHosts:                     splitDelimmitedString(DefaultInitialHosts, stringListDelimitRegex),
+		MaxBroadcastBytes:                DefaultMaxBroadcastBytes,
+		MulticastEnabled:                 DefaultMulticastEnabled == "true",
+		MulticastAddress:                 DefaultMulticastAddress,
+		MulticastPort:                    DefaultMulticastPort,
+		MulticastAnnounceIntervalSeconds: DefaultMulticastAnnounceIntervalSeconds,
+		LogLevel:                         LogInfo,
+		HeartbeatMillis:                  DefaultHeartbeatMillis,
+		PingHistoryFrontload:             DefaultPingHistoryFrontload,
+		MinPingTime:                      DefaultMinPingTime,
+		Lambda:                           DefaultLambda,
+		IndirectProbeCount:               DefaultIndirectProbeCount,
+		TimeoutToleranceSigmas:           DefaultTimeoutToleranceSigmas,
+		PingRequestTimeoutMultiplier:     DefaultPingRequestTimeoutMultiplier,
+		PingHistorySize:                  DefaultPingHistorySize,
+		MaxDeadNodeRetries:               DefaultMaxDeadNodeRetries,
+		ReapTimeoutSeconds:               DefaultReapTimeoutSeconds,
+		BroadcastRetention:               DefaultBroadcastRetention,
+		AllowedNetworks:                  mustParseNetworks(DefaultAllowedNetworks),
+		BlockedNetworks:                  mustParseNetworks(DefaultBlockedNetworks),
+		SourceRateLimit:                  DefaultSourceRateLimit,
+		SourceRateBurst:                  DefaultSourceRateBurst,
+		MaxMembers:                       DefaultMaxMembers,
+		MaxNewMembers:                    DefaultMaxNewMembers,
+		NewMembersIntervalMillis:         DefaultNewMembersIntervalMillis,
+		SnapshotPath:                     DefaultSnapshotPath,
+		IsolationThreshold:               DefaultIsolationThreshold,
+		ReseedIntervalMillis:             DefaultReseedIntervalMillis,
+		ReseedMaxIntervalMillis:          DefaultReseedMaxIntervalMillis,
+		PartitionThreshold:               DefaultPartitionThreshold,
+		PartitionWindowSeconds:           DefaultPartitionWindowSeconds,
+		PartitionRedialTimeoutSeconds:    DefaultPartitionRedialTimeoutSeconds,
+	}
+}
+
+// DefaultWANConfig returns a configuration suited to a wide area network, in
+// which round trips are longer and vary more, and packets are more likely to
+// be lost. Probes are less frequent and more tolerant, and updates and
+// indirect probes are spread more widely.
+func DefaultWANConfig() Config {
+	c := DefaultLANConfig()
+
+	c.HeartbeatMillis = 1000
+	c.PingHistoryFrontload = 500
+	c.MinPingTime = 300
+	c.Lambda = 3.0
+	c.IndirectProbeCount = 4
+	c.TimeoutToleranceSigmas = 4.0
+	c.PingRequestTimeoutMultiplier = 2.5
+	c.PingHistorySize = 100
+	c.MaxDeadNodeRetries = 15
+	c.ReapTimeoutSeconds = 900
+
+	return c
+}
+
+// DefaultLocalConfig returns a configuration suited to members running on
+// the same host, such as in tests, where round trips are very short and
+// failures are detected quickly.
+func DefaultLocalConfig() Config {
+	c := DefaultLANConfig()
+
+	c.HeartbeatMillis = 100
+	c.PingHistoryFrontload = 20
+	c.MinPingTime = 5
+	c.Lambda = 2.0
+	c.IndirectProbeCount = 1
+	c.PingHistorySize = 20
+	c.MaxDeadNodeRetries = 5
+	c.ReapTimeoutSeconds = 30
+	c.BroadcastRetention = 50
+
+	return c
+}
+
+// FieldError describes a configuration field with an invalid value.
+type FieldError struct {
+	// Field is the field's configuration file key.
+	Field string
+
+	// Source is where the value came from: a file path, an environment
+	// variable name, or empty for a value set in code.
+	Source string
+
+	// Value is the invalid value.
+	Value string
+
+	// Problem describes what's wrong with the value.
+	Problem string
+}
+
+func (e FieldError) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("%s: %q %s", e.Field, e.Value, e.Problem)
+	}
+
+	return fmt.Sprintf("%s (from %s): %q %s", e.Field, e.Source, e.Value, e.Problem)
+}
+
+// ConfigError is returned when a configuration is invalid. It lists every
+// invalid field, rather than only the first.
+type ConfigError struct {
+	Fields []FieldError
+}
+
+func (e *ConfigError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = f.Error()
+	}
+
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(problems, "; "))
+}
+
+// Validate checks each of the configuration's fields, returning a
+// *ConfigError that lists all of the invalid ones, or nil if there are none.
+func (c Config) Validate() error {
+	var fields []FieldError
+
+	invalid := func(field string, value interface{}, problem string) {
+		fields = append(fields, FieldError{
+			Field:   field,
+			Value:   fmt.Sprint(value),
+			Problem: problem,
+		})
+	}
+
+	intRange := func(field string, value, min, max int) {
+		if value < min || value > max {
+			invalid(field, value, fmt.Sprintf("isn't between %d and %d", min, max))
+		}
+	}
+
+	positive := func(field string, value float64) {
+		if value <= 0 {
+			invalid(field, value, "isn't positive")
+		}
+	}
+
+	if len(c.ClusterName) > 0xFF {
+		invalid("cluster_name", c.ClusterName, "is longer than 255 bytes")
+	}
+
+	if c.ListenIP == nil {
+		invalid("listen_ip", "", "isn't an IP address")
+	}
+
+	intRange("listen_port", c.ListenPort, 1, 0xFFFF)
+	intRange("max_broadcast_bytes", c.MaxBroadcastBytes, 1, maxBroadcastBytes)
+
+	if c.MulticastAddress != "" &&
+		net.ParseIP(strings.Trim(c.MulticastAddress, "[]")) == nil {
+		invalid("multicast_address", c.MulticastAddress, "isn't an IP address")
+	}
+
+	intRange("multicast_port", c.MulticastPort, 1, 0xFFFF)
+
+	if c.MulticastAnnounceIntervalSeconds < 0 {
+		invalid("multicast_announce_interval", c.MulticastAnnounceIntervalSeconds, "is negative")
+	}
+
+	if c.LogLevel > LogOff {
+		invalid("log_level", c.LogLevel, "isn't a log level")
+	}
+
+	positive("heartbeat_millis", float64(c.HeartbeatMillis))
+	positive("ping_history_frontload", float64(c.PingHistoryFrontload))
+	positive("min_ping_time", float64(c.MinPingTime))
+	positive("lambda", c.Lambda)
+
+	if c.IndirectProbeCount < 0 {
+		invalid("indirect_probe_count", c.IndirectProbeCount, "is negative")
+	}
+
+	positive("timeout_tolerance_sigmas", c.TimeoutToleranceSigmas)
+
+	if c.PingRequestTimeoutMultiplier < 1 {
+		invalid("ping_request_timeout_multiplier", c.PingRequestTimeoutMultiplier, "is less than 1")
+	}
+
+	positive("ping_history_size", float64(c.PingHistorySize))
+	positive("max_dead_node_retries", float64(c.MaxDeadNodeRetries))
+	positive("reap_timeout_seconds", float64(c.ReapTimeoutSeconds))
+	intRange("broadcast_retention", c.BroadcastRetention, 1, maxBroadcastRetention)
+
+	if c.SourceRateLimit < 0 {
+		invalid("source_rate_limit", c.SourceRateLimit, "is negative")
+	}
+
+	positive("source_rate_burst", float64(c.SourceRateBurst))
+
+	if c.MaxMembers < 0 {
+		invalid("max_members", c.MaxMembers, "is negative")
+	}
+
+	if c.MaxNewMembers < 0 {
+		invalid("max_new_members", c.MaxNewMembers, "is negative")
+	}
+
+	positive("new_members_interval_millis", float64(c.NewMembersIntervalMillis))
+
+	if c.IsolationThreshold < 0 || c.IsolationThreshold > 1 {
+		invalid("isolation_threshold", c.IsolationThreshold, "is not between 0 and 1")
+	}
+
+	positive("reseed_interval_millis", float64(c.ReseedIntervalMillis))
+
+	if c.ReseedMaxIntervalMillis < c.ReseedIntervalMillis {
+		invalid("reseed_max_interval_millis", c.ReseedMaxIntervalMillis, "is less than reseed_interval_millis")
+	}
+
+	if c.PartitionThreshold < 0 || c.PartitionThreshold > 1 {
+		invalid("partition_threshold", c.PartitionThreshold, "is not between 0 and 1")
+	}
+
+	positive("partition_window_seconds", float64(c.PartitionWindowSeconds))
+	positive("partition_redial_timeout_seconds", float64(c.PartitionRedialTimeoutSeconds))
+
+	if len(fields) > 0 {
+		return &ConfigError{Fields: fields}
+	}
+
+	return nil
+}
+
+// ApplyConfig validates the configuration and, if it's valid, makes it the
+// configuration in effect. Otherwise it returns a *ConfigError listing the
+// invalid fields, and sets nothing. The listen IP and port, the multicast
+// settings, the ping history settings and the snapshot path have no effect
+// once Begin() has been called.
+func ApplyConfig(c Config) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+
+	if c.ClusterName == "" {
+		c.ClusterName = DefaultClusterName
+	}
+
+	setProperties(c)
+
+	return nil
+}
+
+// Parses a default list of networks, which is known to be valid.
+func mustParseNetworks(value string) []*net.IPNet {
+	networks, err := parseNetworks(splitDelimmitedString(value, stringListDelimitRegex))
+	if err != nil {
+		panic(err)
+	}
+
+	return networks
+}
+
+// Returns the preset named by the SMUDGE_PROFILE environment variable, whose
+// values are the defaults of the protocol properties that aren't otherwise
+// set.
+func profileConfig() Config {
+	profile := strings.ToLower(getStringVar(EnvVarProfile, DefaultProfile))
+
+	switch profile {
+	case "lan":
+		return DefaultLANConfig()
+	case "wan":
+		return DefaultWANConfig()
+	case "local":
+		return DefaultLocalConfig()
+	default:
+		logfWarn("Unknown %s value %q. Using %q.", EnvVarProfile, profile, DefaultProfile)
+		return DefaultLANConfig()
+	}
+}
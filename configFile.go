@@ -0,0 +1,511 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Configuration files contain only top-level keys with scalar or list
+// values, so rather than depending on full JSON, YAML and TOML libraries,
+// each format is read into the same flat list of key/value pairs. Lists are
+// joined with commas, just as they are in environment variables.
+
+// configValue is a single key/value pair read from a configuration file.
+type configValue struct {
+	key   string
+	value string
+	line  int
+}
+
+// configField describes how a configuration field is read from files and
+// the environment.
+type configField struct {
+	key   string
+	env   string
+	parse func(c *Config, value string) error
+}
+
+func intField(key, env string, field func(*Config) *int) configField {
+	return configField{key, env, func(c *Config, value string) error {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("isn't an integer")
+		}
+
+		*field(c) = i
+		return nil
+	}}
+}
+
+func floatField(key, env string, field func(*Config) *float64) configField {
+	return configField{key, env, func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("isn't a number")
+		}
+
+		*field(c) = f
+		return nil
+	}}
+}
+
+func boolField(key, env string, field func(*Config) *bool) configField {
+	return configField{key, env, func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("isn't a boolean")
+		}
+
+		*field(c) = b
+		return nil
+	}}
+}
+
+func stringField(key, env string, field func(*Config) *string) configField {
+	return configField{key, env, func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func networksField(key, env string, field func(*Config) *[]*net.IPNet) configField {
+	return configField{key, env, func(c *Config, value string) error {
+		networks, err := parseNetworks(splitDelimmitedString(value, stringListDelimitRegex))
+		if err != nil {
+			return err
+		}
+
+		*field(c) = networks
+		return nil
+	}}
+}
+
+// The fields of a Config, in the order in which they're declared.
+var configFields = []configField{
+	stringField("cluster_name", EnvVarClusterName,
+		func(c *Config) *string { return &c.ClusterName }),
+	{"listen_ip", EnvVarListenIP, func(c *Config, value string) error {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("isn't an IP address")
+		}
+
+		c.ListenIP = ip
+		return nil
+	}},
+	intField("listen_port", EnvVarListenPort,
+		func(c *Config) *int { return &c.ListenPort }),
+	{"initial_hosts", EnvVarInitialHosts, func(c *Config, value string) error {
+		c.InitialHosts = splitDelimmitedString(value, stringListDelimitRegex)
+		return nil
+	}},
+	intField("max_broadcast_bytes", EnvVarMaxBroadcastBytes,
+		func(c *Config) *int { return &c.MaxBroadcastBytes }),
+	boolField("multicast_enabled", EnvVarMulticastEnabled,
+		func(c *Config) *bool { return &c.MulticastEnabled }),
+	stringField("multicast_address", EnvVarMulticastAddress,
+		func(c *Config) *string { return &c.MulticastAddress }),
+	intField("multicast_port", EnvVarMulticastPort,
+		func(c *Config) *int { return &c.MulticastPort }),
+	intField("multicast_announce_interval", EnvVarMulticastAnnounceIntervalSeconds,
+		func(c *Config) *int { return &c.MulticastAnnounceIntervalSeconds }),
+	{"log_level", EnvVarLogLevel, func(c *Config, value string) error {
+		level, err := ParseLogLevel(value)
+		if err != nil {
+			return fmt.Errorf("isn't a log level")
+		}
+
+		c.LogLevel = level
+		return nil
+	}},
+	intField("heartbeat_millis", EnvVarHeartbeatMillis,
+		func(c *Config) *int { return &c.HeartbeatMillis }),
+	intField("ping_history_frontload", EnvVarPingHistoryFrontload,
+		func(c *Config) *int { return &c.PingHistoryFrontload }),
+	intField("min_ping_time", EnvVarMinPingTime,
+		func(c *Config) *int { return &c.MinPingTime }),
+	floatField("lambda", EnvVarLambda,
+		func(c *Config) *float64 { return &c.Lambda }),
+	intField("indirect_probe_count", EnvVarIndirectProbeCount,
+		func(c *Config) *int { return &c.IndirectProbeCount }),
+	floatField("timeout_tolerance_sigmas", EnvVarTimeoutToleranceSigmas,
+		func(c *Config) *float64 { return &c.TimeoutToleranceSigmas }),
+	floatField("ping_request_timeout_multiplier", EnvVarPingRequestTimeoutMultiplier,
+		func(c *Config) *float64 { return &c.PingRequestTimeoutMultiplier }),
+	intField("ping_history_size", EnvVarPingHistorySize,
+		func(c *Config) *int { return &c.PingHistorySize }),
+	intField("max_dead_node_retries", EnvVarMaxDeadNodeRetries,
+		func(c *Config) *int { return &c.MaxDeadNodeRetries }),
+	intField("reap_timeout_seconds", EnvVarReapTimeoutSeconds,
+		func(c *Config) *int { return &c.ReapTimeoutSeconds }),
+	intField("broadcast_retention", EnvVarBroadcastRetention,
+		func(c *Config) *int { return &c.BroadcastRetention }),
+	networksField("allowed_networks", EnvVarAllowedNetworks,
+		func(c *Config) *[]*net.IPNet { return &c.AllowedNetworks }),
+	networksField("blocked_networks", EnvVarBlockedNetworks,
+		func(c *Config) *[]*net.IPNet { return &c.BlockedNetworks }),
+	floatField("source_rate_limit", EnvVarSourceRateLimit,
+		func(c *Config) *float64 { return &c.SourceRateLimit }),
+	intField("source_rate_burst", EnvVarSourceRateBurst,
+		func(c *Config) *int { return &c.SourceRateBurst }),
+	intField("max_members", EnvVarMaxMembers,
+		func(c *Config) *int { return &c.MaxMembers }),
+	intField("max_new_members", EnvVarMaxNewMembers,
+		func(c *Config) *int { return &c.MaxNewMembers }),
+	intField("new_members_interval_millis", EnvVarNewMembersIntervalMillis,
+		func(c *Config) *int { return &c.NewMembersIntervalMillis }),
+	stringField("snapshot_path", EnvVarSnapshotPath,
+		func(c *Config) *string { return &c.SnapshotPath }),
+	floatField("isolation_threshold", EnvVarIsolationThreshold,
+		func(c *Config) *float64 { return &c.IsolationThreshold }),
+	intField("reseed_interval_millis", EnvVarReseedIntervalMillis,
+		func(c *Config) *int { return &c.ReseedIntervalMillis }),
+	intField("reseed_max_interval_millis", EnvVarReseedMaxIntervalMillis,
+		func(c *Config) *int { return &c.ReseedMaxIntervalMillis }),
+	floatField("partition_threshold", EnvVarPartitionThreshold,
+		func(c *Config) *float64 { return &c.PartitionThreshold }),
+	intField("partition_window_seconds", EnvVarPartitionWindowSeconds,
+		func(c *Config) *int { return &c.PartitionWindowSeconds }),
+	intField("partition_redial_timeout_seconds", EnvVarPartitionRedialTimeoutSeconds,
+		func(c *Config) *int { return &c.PartitionRedialTimeoutSeconds }),
+}
+
+// LoadConfig returns a configuration built up in layers: the preset named by
+// the SMUDGE_PROFILE environment variable (by default, DefaultLANConfig()),
+// then the values in the file at path, if it isn't empty, and finally the
+// values of any SMUDGE_* environment variables. The file's format is chosen
+// by its extension: .json, .yaml, .yml or .toml.
+//
+// If the file can't be read, its error is returned. Otherwise, if any field
+// is unknown, can't be parsed, or is invalid, a *ConfigError listing every
+// such field is returned along with the configuration.
+func LoadConfig(path string) (Config, error) {
+	return LoadConfigOver(profileConfig(), path)
+}
+
+// LoadConfigOver is like LoadConfig(), but layers the file and the
+// environment over base rather than over a preset.
+func LoadConfigOver(base Config, path string) (Config, error) {
+	config := base.clone()
+
+	var values []configValue
+	var problems []FieldError
+
+	// Where each field that was read successfully came from.
+	sources := make(map[string]string)
+
+	if path != "" {
+		var err error
+
+		values, err = readConfigFile(path)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	fields := make(map[string]configField, len(configFields))
+	for _, f := range configFields {
+		fields[f.key] = f
+	}
+
+	for _, v := range values {
+		source := path
+		if v.line > 0 {
+			source = fmt.Sprintf("%s:%d", path, v.line)
+		}
+
+		f, ok := fields[v.key]
+		if !ok {
+			problems = append(problems, FieldError{v.key, source, v.value, "isn't a known field"})
+			continue
+		}
+
+		err := f.parse(&config, v.value)
+		if err != nil {
+			problems = append(problems, FieldError{v.key, source, v.value, err.Error()})
+		} else {
+			sources[v.key] = source
+		}
+	}
+
+	for _, f := range configFields {
+		value := os.Getenv(f.env)
+		if value == "" {
+			continue
+		}
+
+		err := f.parse(&config, value)
+		if err != nil {
+			problems = append(problems, FieldError{f.key, f.env, value, err.Error()})
+		} else {
+			sources[f.key] = f.env
+		}
+	}
+
+	// Only check the fields that were read successfully, which hold either
+	// the value read or a valid default.
+	if err := config.Validate(); err != nil {
+		for _, f := range err.(*ConfigError).Fields {
+			f.Source = sources[f.Field]
+			problems = append(problems, f)
+		}
+	}
+
+	if len(problems) > 0 {
+		return config, &ConfigError{Fields: problems}
+	}
+
+	return config, nil
+}
+
+// Reads the key/value pairs from a configuration file, in a format chosen by
+// its extension.
+func readConfigFile(path string) ([]configValue, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []configValue
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		values, err = parseJSONConfig(data)
+	case ".yaml", ".yml":
+		values, err = parseYAMLConfig(data)
+	case ".toml":
+		values, err = parseTOMLConfig(data)
+	default:
+		return nil, fmt.Errorf("%s: unknown configuration file format", path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return values, nil
+}
+
+// Reads a JSON object whose values are strings, numbers, booleans or arrays
+// of them.
+func parseJSONConfig(data []byte) ([]configValue, error) {
+	var object map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&object)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]configValue, 0, len(keys))
+
+	for _, key := range keys {
+		var value string
+
+		switch v := object[key].(type) {
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+
+			value = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("%s: nested objects aren't supported", key)
+		case nil:
+			value = ""
+		default:
+			value = fmt.Sprint(v)
+		}
+
+		values = append(values, configValue{key: key, value: value})
+	}
+
+	return values, nil
+}
+
+// Reads YAML consisting of top-level "key: value" pairs. Lists can be given
+// either in flow style, as [a, b], or as indented "- item" lines.
+func parseYAMLConfig(data []byte) ([]configValue, error) {
+	var values []configValue
+
+	// The index of the list whose items are being read, or -1.
+	list := -1
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(stripConfigComment(scanner.Text()), " \t")
+
+		if strings.TrimSpace(text) == "" || text == "---" {
+			continue
+		}
+
+		indented := text[0] == ' ' || text[0] == '\t'
+		text = strings.TrimSpace(text)
+
+		if indented {
+			if list < 0 || !strings.HasPrefix(text, "-") {
+				return nil, fmt.Errorf("line %d: nested values aren't supported", line)
+			}
+
+			item := unquoteConfigValue(strings.TrimSpace(text[1:]))
+
+			if values[list].value == "" {
+				values[list].value = item
+			} else {
+				values[list].value += "," + item
+			}
+
+			continue
+		}
+
+		colon := strings.Index(text, ":")
+		if colon < 1 {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", line)
+		}
+
+		values = append(values, configValue{
+			key:   strings.TrimSpace(text[:colon]),
+			value: parseConfigScalarOrList(strings.TrimSpace(text[colon+1:])),
+			line:  line,
+		})
+
+		list = -1
+		if values[len(values)-1].value == "" {
+			list = len(values) - 1
+		}
+	}
+
+	return values, scanner.Err()
+}
+
+// Reads TOML consisting of top-level "key = value" pairs, with lists given
+// as single-line arrays.
+func parseTOMLConfig(data []byte) ([]configValue, error) {
+	var values []configValue
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripConfigComment(scanner.Text()))
+
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			return nil, fmt.Errorf("line %d: tables aren't supported", line)
+		}
+
+		equals := strings.Index(text, "=")
+		if equals < 1 {
+			return nil, fmt.Errorf("line %d: expected \"key = value\"", line)
+		}
+
+		value := strings.TrimSpace(text[equals+1:])
+
+		if strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") {
+			return nil, fmt.Errorf("line %d: multi-line arrays aren't supported", line)
+		}
+
+		values = append(values, configValue{
+			key:   unquoteConfigValue(strings.TrimSpace(text[:equals])),
+			value: parseConfigScalarOrList(value),
+			line:  line,
+		})
+	}
+
+	return values, scanner.Err()
+}
+
+// Returns a scalar value, unquoted, or the items of a [a, b] list, unquoted
+// and joined with commas.
+func parseConfigScalarOrList(value string) string {
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return unquoteConfigValue(value)
+	}
+
+	inner := strings.TrimSpace(value[1 : len(value)-1])
+	if inner == "" {
+		return ""
+	}
+
+	items := strings.Split(inner, ",")
+	for i, item := range items {
+		items[i] = unquoteConfigValue(strings.TrimSpace(item))
+	}
+
+	return strings.Join(items, ",")
+}
+
+// Removes the quotes from a single- or double-quoted value.
+func unquoteConfigValue(value string) string {
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			if s, err := strconv.Unquote(value); err == nil {
+				return s
+			}
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return value[1 : len(value)-1]
+		}
+	}
+
+	return value
+}
+
+// Removes a # comment from a line, unless the # is inside quotes.
+func stripConfigComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
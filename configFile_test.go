@@ -0,0 +1,159 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var configFiles = map[string]string{
+	"smudge.json": `{
+	"cluster_name": "test # cluster",
+	"listen_ip": "10.0.0.1",
+	"listen_port": 10001,
+	"initial_hosts": ["10.0.0.2:10001", "10.0.0.3"],
+	"multicast_enabled": false,
+	"log_level": "debug",
+	"lambda": 3.5,
+	"blocked_networks": ["10.9.0.0/16", "10.0.0.9"]
+}`,
+
+	"smudge.yaml": `# A comment
+cluster_name: "test # cluster"
+listen_ip: 10.0.0.1
+listen_port: 10001   # Another comment
+initial_hosts:
+  - 10.0.0.2:10001
+  - '10.0.0.3'
+multicast_enabled: false
+log_level: Debug
+lambda: 3.5
+blocked_networks: [10.9.0.0/16, 10.0.0.9]
+`,
+
+	"smudge.toml": `# A comment
+cluster_name = "test # cluster"
+listen_ip = "10.0.0.1"
+listen_port = 10001   # Another comment
+initial_hosts = ["10.0.0.2:10001", "10.0.0.3"]
+multicast_enabled = false
+log_level = "DEBUG"
+lambda = 3.5
+blocked_networks = ["10.9.0.0/16", "10.0.0.9"]
+`,
+}
+
+// Each file format must produce the same configuration, layered over the
+// defaults.
+func TestLoadConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+
+	expected := DefaultLANConfig()
+	expected.ClusterName = "test # cluster"
+	expected.ListenIP = net.ParseIP("10.0.0.1")
+	expected.ListenPort = 10001
+	expected.InitialHosts = []string{"10.0.0.2:10001", "10.0.0.3"}
+	expected.MulticastEnabled = false
+	expected.LogLevel = LogDebug
+	expected.Lambda = 3.5
+	expected.BlockedNetworks, _ = parseNetworks([]string{"10.9.0.0/16", "10.0.0.9"})
+
+	for name, contents := range configFiles {
+		path := filepath.Join(dir, name)
+
+		err := ioutil.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: expected %+v, found %+v", name, expected, config)
+		}
+	}
+}
+
+// Environment variables must override the file, and every unknown,
+// unparseable or invalid field must be reported at once.
+func TestLoadConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smudge.yaml")
+
+	err := ioutil.WriteFile(path, []byte(`listen_port: 70000
+heartbeat_millis: often
+colour: blue
+lambda: 2
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(EnvVarLambda, "4")
+	t.Setenv(EnvVarMinPingTime, "-1")
+
+	config, err := LoadConfig(path)
+
+	if config.Lambda != 4 {
+		t.Errorf("Expected the environment's lambda of 4, found %v", config.Lambda)
+	}
+
+	cerr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("Expected a *ConfigError, found %v", err)
+	}
+
+	var fields []string
+	for _, f := range cerr.Fields {
+		fields = append(fields, f.Field)
+	}
+
+	expected := []string{"heartbeat_millis", "colour", "listen_port", "min_ping_time"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected invalid fields %v, found %v (%v)", expected, fields, err)
+	}
+}
+
+// A file layered over a configuration of one's own must leave the fields it
+// doesn't give as they were.
+func TestLoadConfigOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smudge.toml")
+
+	err := ioutil.WriteFile(path, []byte("listen_port = 10001\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := DefaultLANConfig()
+	base.ListenIP = net.ParseIP("10.0.0.1")
+
+	config, err := LoadConfigOver(base, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !config.ListenIP.Equal(base.ListenIP) || config.ListenPort != 10001 {
+		t.Errorf("Expected 10.0.0.1:10001, found %v:%d", config.ListenIP, config.ListenPort)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"testing"
+)
+
+// Unset protocol properties must take their values from the profile named by
+// SMUDGE_PROFILE, unless they have environment variables of their own.
+func TestProfileDefaults(t *testing.T) {
+	t.Setenv(EnvVarProfile, "wan")
+	t.Setenv(EnvVarTimeoutToleranceSigmas, "5.5")
+
+	propertiesLock.Lock()
+	properties.Store((*Config)(nil))
+	propertiesLock.Unlock()
+
+	defer ApplyConfig(DefaultLANConfig())
+
+	wan := DefaultWANConfig()
+
+	if GetLambda() != wan.Lambda {
+		t.Errorf("Expected the WAN lambda of %v, found %v", wan.Lambda, GetLambda())
+	}
+
+	if GetIndirectProbeCount() != wan.IndirectProbeCount {
+		t.Errorf("Expected the WAN indirect probe count of %d, found %d",
+			wan.IndirectProbeCount, GetIndirectProbeCount())
+	}
+
+	if GetTimeoutToleranceSigmas() != 5.5 {
+		t.Errorf("Expected sigmas of 5.5 from the environment, found %v", GetTimeoutToleranceSigmas())
+	}
+}
+
+// Applying a preset must set each of its properties, while applying an
+// invalid configuration must set none of them.
+func TestApplyConfig(t *testing.T) {
+	defer ApplyConfig(DefaultLANConfig())
+
+	local := DefaultLocalConfig()
+
+	invalid := local
+	invalid.BroadcastRetention = 1000
+
+	if _, ok := ApplyConfig(invalid).(*ConfigError); !ok {
+		t.Error("Expected a broadcast retention of 1000 to be rejected")
+	}
+
+	invalid = local
+	invalid.MaxBroadcastBytes = udpBufferSize
+
+	if _, ok := ApplyConfig(invalid).(*ConfigError); !ok {
+		t.Error("Expected broadcasts that can't fit in the receive buffer to be rejected")
+	}
+
+	if GetHeartbeatMillis() == local.HeartbeatMillis {
+		t.Error("Expected no properties to be set from an invalid configuration")
+	}
+
+	err := ApplyConfig(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if GetHeartbeatMillis() != local.HeartbeatMillis {
+		t.Errorf("Expected heartbeat of %d, found %d", local.HeartbeatMillis, GetHeartbeatMillis())
+	}
+
+	if GetMaxDeadNodeRetries() != local.MaxDeadNodeRetries {
+		t.Errorf("Expected %d dead node retries, found %d",
+			local.MaxDeadNodeRetries, GetMaxDeadNodeRetries())
+	}
+
+	if GetPingRequestTimeoutMultiplier() != local.PingRequestTimeoutMultiplier {
+		t.Errorf("Expected multiplier of %v, found %v",
+			local.PingRequestTimeoutMultiplier, GetPingRequestTimeoutMultiplier())
+	}
+
+	if GetBroadcastRetention() != local.BroadcastRetention {
+		t.Errorf("Expected broadcast retention of %d, found %d",
+			local.BroadcastRetention, GetBroadcastRetention())
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTruncated indicates that a received packet ended before the data
+	// that it declares.
+	ErrTruncated = errors.New("truncated")
+
+	// ErrChecksum indicates that a received packet's checksum didn't match
+	// its contents.
+	ErrChecksum = errors.New("checksum mismatch")
+
+	// ErrTooLong indicates that a length declared in a received packet
+	// exceeds the permitted maximum.
+	ErrTooLong = errors.New("length exceeds maximum")
+
+	// ErrClusterMismatch indicates that a received packet was sent by a
+	// member of a differently-named cluster.
+	ErrClusterMismatch = errors.New("cluster mismatch")
+
+	// ErrVersionMismatch indicates that a received packet was sent by a
+	// member using a different version of the wire protocol.
+	ErrVersionMismatch = errors.New("protocol version mismatch")
+)
+
+// DecodeError is returned when a received packet can't be decoded. Its Err
+// is one of ErrTruncated, ErrChecksum, ErrTooLong, ErrClusterMismatch or
+// ErrVersionMismatch, so it can be tested with errors.Is().
+type DecodeError struct {
+	// Part is the part of the packet being decoded: "message", "members",
+	// "payload", "broadcast", "multicast" or "query".
+	Part string
+
+	// Offset is the position within the part at which decoding failed.
+	Offset int
+
+	// Err is the reason that decoding failed.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("cannot decode %s at byte %d: %v", e.Part, e.Offset, e.Err)
+}
+
+// Unwrap returns the reason that decoding failed.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Convenience function. Returns ErrTruncated as a DecodeError if fewer than
+// need bytes are available from offset p, or nil otherwise.
+func checkLength(part string, bytes []byte, p int, need int) error {
+	if need < 0 || len(bytes)-p < need {
+		return &DecodeError{Part: part, Offset: p, Err: ErrTruncated}
+	}
+
+	return nil
+}
@@ -16,18 +16,334 @@ limitations under the License.
 
 package smudge
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The most events that a subscription queues for its consumer, beyond the
+// snapshot that it starts with. Once the queue is full, further events are
+// dropped and counted until the consumer catches up.
+const eventQueueLength = 4096
 
 var broadcastListeners = struct {
 	sync.RWMutex
 	s []BroadcastListener
 }{s: make([]BroadcastListener, 0, 16)}
 
+var messageListeners = struct {
+	sync.RWMutex
+	s []MessageListener
+}{s: make([]MessageListener, 0, 16)}
+
 var statusListeners = struct {
 	sync.RWMutex
 	s []StatusListener
 }{s: make([]StatusListener, 0, 16)}
 
+var eventSubscriptions = struct {
+	sync.RWMutex
+	m map[*EventSubscription]bool
+}{m: make(map[*EventSubscription]bool)}
+
+// EventType represents the kind of membership change described by an Event.
+type EventType byte
+
+const (
+	// EventJoin indicates that a member has been added to the known nodes.
+	EventJoin EventType = iota
+
+	// EventUpdate indicates that a member's status has changed to alive.
+	EventUpdate
+
+	// EventSuspect indicates that a member is suspected of being dead.
+	EventSuspect
+
+	// EventDead indicates that a member has been declared dead.
+	EventDead
+
+	// EventLeft indicates that a member was explicitly removed from the
+	// known nodes via RemoveNode(), rather than being forgotten after
+	// failing.
+	EventLeft
+
+	// EventRemoved indicates that a dead member has been forgotten after
+	// exhausting its retries.
+	EventRemoved
+
+	// EventIsolated indicates that this member has lost all of its live
+	// peers, or most of those it recently knew, and has begun re-seeding.
+	// Its Node is this member.
+	EventIsolated
+
+	// EventPartitionSuspected indicates that so many members have died at
+	// once that this member is taking them to have been split from it by a
+	// network partition, and is redialing them. Its Node is this member.
+	EventPartitionSuspected
+
+	// EventMerged indicates that a member lost to a suspected partition has
+	// been heard from again, so the partition has healed. Its Node is that
+	// member.
+	EventMerged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventJoin:
+		return "JOIN"
+	case EventUpdate:
+		return "UPDATE"
+	case EventSuspect:
+		return "SUSPECT"
+	case EventDead:
+		return "DEAD"
+	case EventLeft:
+		return "LEFT"
+	case EventRemoved:
+		return "REMOVED"
+	case EventIsolated:
+		return "ISOLATED"
+	case EventPartitionSuspected:
+		return "PARTITION_SUSPECTED"
+	case EventMerged:
+		return "MERGED"
+	default:
+		return "UNDEFINED"
+	}
+}
+
+// Event describes a single change in cluster membership, as delivered by an
+// EventSubscription.
+type Event struct {
+	// Type is the kind of membership change.
+	Type EventType
+
+	// Node is a snapshot of the member that the event concerns, taken when
+	// the change was made.
+	Node NodeInfo
+
+	// Status is the member's status after the change.
+	Status NodeStatus
+
+	// PreviousStatus is the member's status before the change.
+	PreviousStatus NodeStatus
+
+	// Source is the node that originally reported the change; the source
+	// of the gossip. This node for locally detected changes.
+	Source NodeInfo
+
+	// Cause records why the member's status last changed, and the evidence
+	// behind the change.
+	Cause StatusCause
+
+	// Timestamp is the local time at which the change was observed.
+	Timestamp time.Time
+
+	// Snapshot is true for the EventJoin events that describe the known
+	// members at the time of subscription.
+	Snapshot bool
+}
+
+// EventSubscription delivers membership events on a channel. Events are
+// queued per subscription and dispatched asynchronously, so a slow consumer
+// never stalls the protocol or other subscribers. The queue is bounded: a
+// consumer that falls too far behind loses the newest events, which are
+// counted by Dropped().
+type EventSubscription struct {
+	ch      chan Event
+	lock    sync.Mutex
+	queue   []Event
+	limit   int
+	dropped uint64
+	signal  chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Events subscribes to membership events. The returned subscription first
+// delivers an EventJoin for each currently known member (with Snapshot set),
+// followed by each subsequent change. Call Unsubscribe() when done.
+func Events() *EventSubscription {
+	sub := &EventSubscription{
+		ch:     make(chan Event),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	// The snapshot is taken, and the subscription registered, while holding
+	// the lock that the registry holds while it adds or removes a member and
+	// emits the event. A member is therefore either in the snapshot or
+	// reported by a later event, but never both.
+	eventSubscriptions.Lock()
+
+	nodes := knownNodes.values()
+	sub.limit = len(nodes) + eventQueueLength
+
+	now := time.Now()
+	for _, n := range nodes {
+		info := n.Info()
+
+		sub.push(Event{
+			Type:      EventJoin,
+			Node:      info,
+			Status:    info.Status,
+			Source:    infoOf(n.StatusSource()),
+			Cause:     info.StatusCause,
+			Timestamp: now,
+			Snapshot:  true,
+		})
+	}
+
+	eventSubscriptions.m[sub] = true
+	eventSubscriptions.Unlock()
+
+	go sub.run()
+
+	return sub
+}
+
+// C returns the channel on which events are delivered. It is closed once
+// Unsubscribe() is called.
+func (s *EventSubscription) C() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events that were discarded because the
+// subscription's queue was full.
+func (s *EventSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops the delivery of events and closes the event channel.
+// Any undelivered events are discarded.
+func (s *EventSubscription) Unsubscribe() {
+	eventSubscriptions.Lock()
+	delete(eventSubscriptions.m, s)
+	eventSubscriptions.Unlock()
+
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *EventSubscription) push(e Event) {
+	s.lock.Lock()
+	full := len(s.queue) >= s.limit
+	if !full {
+		s.queue = append(s.queue, e)
+	}
+	s.lock.Unlock()
+
+	if full {
+		dropped := atomic.AddUint64(&s.dropped, 1)
+
+		// Warn at powers of two, so that a stalled consumer doesn't flood
+		// the log.
+		if dropped&(dropped-1) == 0 {
+			logfWarn("Event queue full: %d events dropped", dropped)
+		} else {
+			logfDebug("Event queue full: dropping %v event", e.Type)
+		}
+
+		return
+	}
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *EventSubscription) run() {
+	defer close(s.ch)
+
+	for {
+		s.lock.Lock()
+		if len(s.queue) == 0 {
+			s.lock.Unlock()
+
+			select {
+			case <-s.signal:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		// Events are taken off the queue one at a time, so that it bounds
+		// all of the events waiting to be delivered.
+		e := s.queue[0]
+		s.queue[0] = Event{}
+		s.queue = s.queue[1:]
+		s.lock.Unlock()
+
+		select {
+		case s.ch <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// emitEvent queues an event for delivery to every subscription. It never
+// blocks on a subscriber.
+func emitEvent(eventType EventType, node *Node, previous NodeStatus, source *Node) {
+	eventSubscriptions.RLock()
+	pushEvent(eventType, node, previous, source)
+	eventSubscriptions.RUnlock()
+}
+
+// emitEventOnChange calls change, which adds a member to or removes one from
+// the registry, and emits an event if it reports a change. Both are done
+// while holding the subscriptions' lock, so that a new subscription's
+// snapshot can't include a member and then report it again.
+func emitEventOnChange(change func() bool, eventType EventType, node *Node, previous NodeStatus, source *Node) bool {
+	eventSubscriptions.RLock()
+	defer eventSubscriptions.RUnlock()
+
+	if !change() {
+		return false
+	}
+
+	pushEvent(eventType, node, previous, source)
+
+	return true
+}
+
+// Queues an event for every subscription. The caller must hold the
+// subscriptions' lock.
+func pushEvent(eventType EventType, node *Node, previous NodeStatus, source *Node) {
+	info := node.Info()
+
+	e := Event{
+		Type:           eventType,
+		Node:           info,
+		Status:         info.Status,
+		PreviousStatus: previous,
+		Source:         infoOf(source),
+		Cause:          info.StatusCause,
+		Timestamp:      time.Now(),
+	}
+
+	for sub := range eventSubscriptions.m {
+		sub.push(e)
+	}
+}
+
+// statusEventType returns the type of event that describes a change to the
+// specified status.
+func statusEventType(status NodeStatus) EventType {
+	switch status {
+	case StatusSuspected:
+		return EventSuspect
+	case StatusDead:
+		return EventDead
+	default:
+		return EventUpdate
+	}
+}
+
 // BroadcastListener is the interface that must be implemented to take advantage
 // of the cluster member status update notification functionality provided by
 // the AddBroadcastListener() function.
@@ -54,12 +370,38 @@ func doBroadcastUpdate(broadcast *Broadcast) {
 	broadcastListeners.RUnlock()
 }
 
+// MessageListener is the interface that must be implemented to receive the
+// point-to-point messages sent by other nodes via the SendTo() function.
+type MessageListener interface {
+	// The OnMessage() function is called whenever the node receives a
+	// message addressed directly to it.
+	OnMessage(from *Node, payload []byte)
+}
+
+// AddMessageListener allows the submission of a MessageListener
+// implementation whose OnMessage() function will be called whenever the node
+// receives a message sent directly to it by another node.
+func AddMessageListener(listener MessageListener) {
+	messageListeners.Lock()
+	messageListeners.s = append(messageListeners.s, listener)
+	messageListeners.Unlock()
+}
+
+func doMessageUpdate(from *Node, payload []byte) {
+	messageListeners.RLock()
+	for _, ml := range messageListeners.s {
+		ml.OnMessage(from, payload)
+	}
+	messageListeners.RUnlock()
+}
+
 // StatusListener is the interface that must be implemented to take advantage
 // of the cluster member status update notification functionality provided by
 // the AddStatusListener() function.
 type StatusListener interface {
 	// The OnChange() function is called whenever the node is notified of any
-	// change in the status of a cluster member.
+	// change in the status of a cluster member. It's called on one of the
+	// handler goroutines rather than by the protocol itself.
 	OnChange(node *Node, status NodeStatus)
 }
 
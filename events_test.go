@@ -0,0 +1,84 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"testing"
+	"time"
+)
+
+// A subscription should deliver queued events in order, without the
+// emitter blocking on the consumer, and close its channel on unsubscribe.
+func TestEventSubscriptionOrdering(t *testing.T) {
+	sub := Events()
+
+	node, _ := CreateNodeByAddress("127.0.0.1:10101")
+	node.status = StatusSuspected
+
+	// Nothing is reading yet, so these must not block.
+	for i := 0; i < 100; i++ {
+		emitEvent(EventSuspect, node, StatusAlive, node)
+	}
+
+	for i := 0; i < 100; i++ {
+		if e := waitForEvent(t, sub, EventSuspect); e.PreviousStatus != StatusAlive {
+			t.Errorf("Unexpected event: %v", e)
+		}
+	}
+
+	sub.Unsubscribe()
+
+	select {
+	case _, ok := <-sub.C():
+		if ok {
+			t.Error("Expected the channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for the channel to close")
+	}
+}
+
+// A subscription whose consumer stalls must drop and count the events that
+// overflow its queue, and still deliver those it queued.
+func TestEventSubscriptionOverflow(t *testing.T) {
+	sub := Events()
+	defer sub.Unsubscribe()
+
+	node, _ := CreateNodeByAddress("127.0.0.1:10102")
+	node.status = StatusSuspected
+
+	threshold := GetLogThreshold()
+	SetLogThreshold(LogOff)
+	defer SetLogThreshold(threshold)
+
+	emitted := sub.limit + 10
+	for i := 0; i < emitted; i++ {
+		emitEvent(EventSuspect, node, StatusAlive, node)
+	}
+
+	// The subscription's goroutine may already have taken the first event
+	// off the queue, and be waiting to deliver it.
+	if d := sub.Dropped(); d != 9 && d != 10 {
+		t.Errorf("Expected 9 or 10 dropped events but found %d", d)
+	}
+
+	select {
+	case <-sub.C():
+	case <-time.After(time.Second):
+		t.Error("Expected the queued events to be delivered")
+	}
+}
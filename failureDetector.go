@@ -0,0 +1,191 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPhiThreshold is the default suspicion threshold of the
+	// phi-accrual failure detector: a node fails a ping once the chance that
+	// a healthy node would have taken so long to respond drops below 10^-8.
+	DefaultPhiThreshold = 8.0
+
+	// DefaultPhiMinStdDev is the default lower bound on the standard
+	// deviation of the round-trip times used by the phi-accrual failure
+	// detector, which keeps nodes with very steady response times from being
+	// failed by the slightest delay.
+	DefaultPhiMinStdDev = 100 * time.Millisecond
+)
+
+// FailureDetector decides how long the probe machinery waits for a node to
+// acknowledge a direct ping before it's considered to have failed it. A node
+// that fails a direct ping is then pinged indirectly through other members,
+// and suspected if those pings fail too.
+type FailureDetector interface {
+	// AckTimeout returns how long to wait for the node to acknowledge a
+	// direct ping.
+	AckTimeout(node *Node) time.Duration
+
+	// Observe is called with the round-trip time of each direct ping that a
+	// node acknowledges, after the node's RTTStats() have been updated.
+	Observe(node *Node, rtt time.Duration)
+}
+
+// AccrualFailureDetector is a FailureDetector whose suspicion of a node
+// that has yet to acknowledge a direct ping accrues with the time waited.
+// When the ack timeout passes, the probe machinery asks it whether the node
+// has failed the ping; if it hasn't, the timeout is worked out afresh and the
+// node is asked about again once that passes. A node whose new timeout has
+// also passed fails the ping.
+type AccrualFailureDetector interface {
+	FailureDetector
+
+	// Failed returns whether the node has failed a direct ping that it has
+	// yet to acknowledge, sent the given time ago.
+	Failed(node *Node, elapsed time.Duration) bool
+}
+
+// The failure detector that the probe machinery consults.
+var failureDetector = struct {
+	sync.RWMutex
+	d FailureDetector
+}{d: sigmaFailureDetector{}}
+
+// SetFailureDetector sets the failure detector that the probe machinery
+// consults. Passing nil restores the default, which waits for the mean
+// round-trip time plus the number of standard deviations set by
+// SetTimeoutToleranceSigmas().
+func SetFailureDetector(d FailureDetector) {
+	if d == nil {
+		d = sigmaFailureDetector{}
+	}
+
+	failureDetector.Lock()
+	failureDetector.d = d
+	failureDetector.Unlock()
+}
+
+func getFailureDetector() FailureDetector {
+	failureDetector.RLock()
+	defer failureDetector.RUnlock()
+
+	return failureDetector.d
+}
+
+// sigmaFailureDetector is the default failure detector, which waits for a
+// fixed number of standard deviations beyond the mean round-trip time.
+type sigmaFailureDetector struct{}
+
+func (sigmaFailureDetector) AckTimeout(node *Node) time.Duration {
+	return time.Duration(probeTimeoutMillis(node)) * time.Millisecond
+}
+
+func (sigmaFailureDetector) Observe(node *Node, rtt time.Duration) {
+}
+
+// PhiAccrualFailureDetector is an AccrualFailureDetector based on "The Phi
+// Accrual Failure Detector" by Hayashibara et al. Rather than a fixed number
+// of standard deviations, it expresses its suspicion of a node that has yet
+// to respond as phi = -log10(P), where P is the probability that a healthy
+// node would take at least as long, and fails the node once phi reaches the
+// threshold. Round-trip times are assumed to be normally distributed, with
+// the node's own moving averages (or the global ones, until the node has
+// enough samples) as their mean and standard deviation.
+//
+// Raising the threshold makes false positives less likely, at the cost of
+// slower detection: a threshold of 1 fails a node that's slower than 90% of
+// its responses, 3 than 99.9% of them, and so on.
+type PhiAccrualFailureDetector struct {
+	// Threshold is the value of phi at which a node fails a ping.
+	Threshold float64
+
+	// MinStdDev is the lower bound on the standard deviation of the
+	// round-trip times.
+	MinStdDev time.Duration
+}
+
+// NewPhiAccrualFailureDetector returns a phi-accrual failure detector with
+// the given threshold, and the default minimum standard deviation. A
+// threshold that isn't positive is replaced by DefaultPhiThreshold.
+func NewPhiAccrualFailureDetector(threshold float64) *PhiAccrualFailureDetector {
+	if threshold <= 0 {
+		threshold = DefaultPhiThreshold
+	}
+
+	return &PhiAccrualFailureDetector{
+		Threshold: threshold,
+		MinStdDev: DefaultPhiMinStdDev,
+	}
+}
+
+// AckTimeout returns the time after which phi is expected to reach the
+// threshold, which is when the node is next checked.
+func (d *PhiAccrualFailureDetector) AckTimeout(node *Node) time.Duration {
+	mean, stddev := d.distribution(node)
+
+	// Solve P(X > t) = 10^-threshold for t.
+	z := math.Sqrt2 * math.Erfcinv(2*math.Pow(10, -d.Threshold))
+
+	return time.Duration((mean + z*stddev) * float64(time.Millisecond))
+}
+
+// Observe does nothing: the detector uses the node's RTTStats(), which have
+// already been updated.
+func (d *PhiAccrualFailureDetector) Observe(node *Node, rtt time.Duration) {
+}
+
+// Failed returns whether phi has reached the threshold.
+func (d *PhiAccrualFailureDetector) Failed(node *Node, elapsed time.Duration) bool {
+	return d.Phi(node, elapsed) >= d.Threshold
+}
+
+// Phi returns the suspicion level of a node that has yet to acknowledge a
+// ping sent the given time ago.
+func (d *PhiAccrualFailureDetector) Phi(node *Node, elapsed time.Duration) float64 {
+	mean, stddev := d.distribution(node)
+
+	millis := float64(elapsed) / float64(time.Millisecond)
+	p := 0.5 * math.Erfc((millis-mean)/(stddev*math.Sqrt2))
+
+	return -math.Log10(p)
+}
+
+// Returns the mean and standard deviation of the node's round-trip times, in
+// milliseconds.
+func (d *PhiAccrualFailureDetector) distribution(node *Node) (float64, float64) {
+	var mean, stddev float64
+
+	rtt := node.RTTStats()
+
+	if rtt.Samples >= minRTTSamples {
+		mean = float64(rtt.Mean) / float64(time.Millisecond)
+		stddev = float64(rtt.StdDev) / float64(time.Millisecond)
+	} else {
+		mean, stddev = pingdata.data()
+	}
+
+	minStdDev := float64(d.MinStdDev) / float64(time.Millisecond)
+	if stddev < minStdDev {
+		stddev = minStdDev
+	}
+
+	return mean, stddev
+}
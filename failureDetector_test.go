@@ -0,0 +1,142 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+type fixedFailureDetector struct {
+	timeout time.Duration
+}
+
+func (d fixedFailureDetector) AckTimeout(node *Node) time.Duration {
+	return d.timeout
+}
+
+func (d fixedFailureDetector) Observe(node *Node, rtt time.Duration) {
+}
+
+// The ack timeouts must be those of the configured failure detector, and
+// those of the default one once it's reset.
+func TestSetFailureDetector(t *testing.T) {
+	node := &Node{ip: net.IPv4(10, 0, 1, 1), port: 9999}
+	relay := &Node{ip: net.IPv4(10, 0, 1, 2), port: 9999}
+
+	SetFailureDetector(fixedFailureDetector{timeout: 700 * time.Millisecond})
+	defer SetFailureDetector(nil)
+
+	if timeout := ackTimeoutMillis(&pendingAck{node: node, packType: packPing}); timeout != 700 {
+		t.Errorf("Expected a PING timeout of 700ms, found %dms", timeout)
+	}
+
+	pack := &pendingAck{node: relay, callback: node, packType: packPingReq}
+	if timeout := ackTimeoutMillis(pack); timeout != 1400 {
+		t.Errorf("Expected a PINGREQ timeout of 1400ms, found %dms", timeout)
+	}
+
+	SetFailureDetector(nil)
+
+	expected := probeTimeoutMillis(node)
+	if timeout := ackTimeoutMillis(&pendingAck{node: node, packType: packPing}); timeout != expected {
+		t.Errorf("Expected the default PING timeout of %dms, found %dms", expected, timeout)
+	}
+}
+
+// Phi must grow with the time waited, reach the threshold at the ack
+// timeout, and fail the node beyond it, and a higher threshold must mean a
+// longer timeout.
+func TestPhiAccrualFailureDetector(t *testing.T) {
+	node := &Node{ip: net.IPv4(10, 0, 1, 3), port: 9999}
+
+	for i := 0; i < 20; i++ {
+		node.addRTTSample(200)
+		node.addRTTSample(400)
+	}
+
+	d := NewPhiAccrualFailureDetector(DefaultPhiThreshold)
+
+	if a, b := d.Phi(node, 300*time.Millisecond), d.Phi(node, time.Second); a >= b {
+		t.Errorf("Expected phi to grow with time waited, found %.2f then %.2f", a, b)
+	}
+
+	timeout := d.AckTimeout(node)
+	if phi := d.Phi(node, timeout); math.Abs(phi-d.Threshold) > 0.01 {
+		t.Errorf("Expected phi of %.2f at the %v timeout, found %.2f", d.Threshold, timeout, phi)
+	}
+
+	if d.Failed(node, timeout/2) || !d.Failed(node, 2*timeout) {
+		t.Error("Expected the node to fail only once phi reaches the threshold")
+	}
+
+	if lower := NewPhiAccrualFailureDetector(2).AckTimeout(node); lower >= timeout {
+		t.Errorf("Expected a lower threshold to time out sooner than %v, found %v", timeout, lower)
+	}
+}
+
+// Fails a node only once it has been asked about the specified number of
+// times.
+type countingFailureDetector struct {
+	fixedFailureDetector
+	checks, failAfter int
+}
+
+func (d *countingFailureDetector) Failed(node *Node, elapsed time.Duration) bool {
+	d.checks++
+	return d.checks >= d.failAfter
+}
+
+// A direct ping whose timeout passes must only be failed once an accrual
+// failure detector says so, and be checked again until then.
+func TestAccrualFailureDetector(t *testing.T) {
+	node := &Node{ip: net.IPv4(10, 0, 1, 4), port: 9999}
+
+	d := &countingFailureDetector{
+		fixedFailureDetector: fixedFailureDetector{timeout: time.Hour},
+		failAfter:            2,
+	}
+
+	SetFailureDetector(d)
+	defer SetFailureDetector(nil)
+
+	pack := &pendingAck{node: node, startTime: time.Now(), packType: packPing}
+	addPendingAck(pack, 1)
+	defer cancelPendingAck(pack.key)
+
+	if !stillAccruing(pack) {
+		t.Fatal("Expected the node not to have failed at the first check")
+	}
+
+	if pack.timeoutMillis <= uint32(time.Hour/time.Millisecond) {
+		t.Errorf("Expected the ack to be rescheduled past the timeout, found %dms", pack.timeoutMillis)
+	}
+
+	if stillAccruing(pack) {
+		t.Error("Expected the node to have failed at the second check")
+	}
+
+	if stillAccruing(&pendingAck{node: node, callback: node, packType: packPingReq}) {
+		t.Error("Expected a ping request to time out regardless of the detector")
+	}
+
+	if d.checks != 2 {
+		t.Errorf("Expected the detector to be asked twice, found %d", d.checks)
+	}
+}
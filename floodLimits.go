@@ -0,0 +1,219 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the token buckets of sources that have gone quiet are discarded.
+const sourceBucketPruneInterval = time.Minute
+
+// The most sources whose token buckets are kept at once. When there are this
+// many, an arbitrary one is discarded to make room for a new source, so that
+// packets from a flood of spoofed addresses can't exhaust memory.
+const maxSourceBuckets = 16384
+
+// A token bucket for each source address, keyed on its 16-byte IP. Buckets
+// are keyed on the IP alone, rather than on the IP and port, because a host
+// can send from as many ports as it likes: keyed on both, a single flooder
+// could multiply its limit by changing ports. Members that share a host share
+// its bucket, so the limit should allow for them.
+//
+// Buckets are created full, so a bucket that has refilled is no different
+// from a missing one, and can be discarded.
+var sourceBuckets = struct {
+	sync.Mutex
+	m      map[string]*tokenBucket
+	pruned time.Time
+}{m: make(map[string]*tokenBucket)}
+
+// The number of members learned of from other members in the current new
+// member interval, and the members that have been admitted but not yet
+// added, keyed on address. Admitted members count toward both member limits
+// until they're added, so that concurrent receive workers can't together
+// exceed them.
+var newMembers = struct {
+	sync.Mutex
+	start    time.Time
+	count    int
+	reserved map[string]bool
+}{reserved: make(map[string]bool)}
+
+// tokenBucket limits the rate of packets from a single source.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+
+	// The number of packets dropped since the source was last within its
+	// limit.
+	dropped uint64
+}
+
+// Refills the bucket for the time elapsed since it was last updated.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.updated).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+
+	b.updated = now
+}
+
+// Returns whether a packet from the IP is within the source rate limit,
+// taking a token from its bucket if it is. Dropped packets are counted, and
+// a warning is logged when a source first exceeds the limit.
+func allowPacket(ip net.IP) bool {
+	rate := GetSourceRateLimit()
+	if rate == 0 {
+		return true
+	}
+
+	burst := float64(GetSourceRateBurst())
+	now := time.Now()
+	key := string(ip.To16())
+
+	sourceBuckets.Lock()
+
+	if now.Sub(sourceBuckets.pruned) >= sourceBucketPruneInterval {
+		for k, b := range sourceBuckets.m {
+			b.refill(now, rate, burst)
+			if b.tokens >= burst {
+				delete(sourceBuckets.m, k)
+			}
+		}
+
+		sourceBuckets.pruned = now
+	}
+
+	b, ok := sourceBuckets.m[key]
+	if !ok {
+		if len(sourceBuckets.m) >= maxSourceBuckets {
+			for k := range sourceBuckets.m {
+				delete(sourceBuckets.m, k)
+				break
+			}
+		}
+
+		b = &tokenBucket{tokens: burst, updated: now}
+		sourceBuckets.m[key] = b
+	}
+
+	b.refill(now, rate, burst)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		dropped := b.dropped
+		b.dropped = 0
+
+		sourceBuckets.Unlock()
+
+		if dropped > 0 {
+			logfInfo("No longer rate limiting packets from %v (%d dropped)", ip, dropped)
+		}
+
+		return true
+	}
+
+	b.dropped++
+	dropped := b.dropped
+
+	sourceBuckets.Unlock()
+
+	atomic.AddUint64(&metrics.packetsLimited, 1)
+
+	if dropped == 1 {
+		logfWarn("Rate limiting packets from %v: more than %v per second", ip, rate)
+	} else {
+		logfTrace("Rate limited packet from %v", ip)
+	}
+
+	return false
+}
+
+// Returns whether a node that isn't yet known, and that was learned of from
+// another member, may be added: neither the member limit nor the new member
+// limit may have been reached. An admitted node holds its place toward both
+// limits until it's passed to addLearnedNode(), which every admission must be
+// followed by. Rejections are counted, and warned of with decreasing
+// frequency.
+func admitMember(node *Node) bool {
+	maxMembers := GetMaxMembers()
+	maxNew := GetMaxNewMembers()
+	interval := time.Duration(GetNewMembersIntervalMillis()) * time.Millisecond
+	address := node.Address()
+	now := time.Now()
+
+	newMembers.Lock()
+
+	if newMembers.reserved[address] {
+		newMembers.Unlock()
+		return true
+	}
+
+	if now.Sub(newMembers.start) >= interval {
+		newMembers.start = now
+		newMembers.count = 0
+	}
+
+	pending := len(newMembers.reserved)
+
+	if maxMembers > 0 && knownNodes.length()+pending >= maxMembers {
+		newMembers.Unlock()
+		noteMemberRejected(node, "the limit of %d members has been reached", maxMembers)
+		return false
+	}
+
+	if maxNew > 0 && newMembers.count+pending >= maxNew {
+		newMembers.Unlock()
+		noteMemberRejected(node, "the limit of %d new members per %v has been reached", maxNew, interval)
+		return false
+	}
+
+	newMembers.reserved[address] = true
+	newMembers.Unlock()
+
+	return true
+}
+
+// Adds a node learned of from another member, releasing its admission, and
+// counting it toward the new member limit if it wasn't already known.
+func addLearnedNode(node *Node) {
+	added := addNode(node)
+
+	newMembers.Lock()
+	delete(newMembers.reserved, node.Address())
+	if added {
+		newMembers.count++
+	}
+	newMembers.Unlock()
+}
+
+func noteMemberRejected(node *Node, reason string, a ...interface{}) {
+	count := atomic.AddUint64(&metrics.membersRejected, 1)
+
+	a = append([]interface{}{node.Address()}, a...)
+
+	if count&(count-1) == 0 {
+		logfWarn("Ignoring new member %s: "+reason, a...)
+	} else {
+		logfDebug("Ignoring new member %s: "+reason, a...)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A source may send its burst at once, after which its packets are dropped
+// and counted; other sources are unaffected.
+func TestAllowPacket(t *testing.T) {
+	defer SetSourceRateLimit(GetSourceRateLimit())
+	defer SetSourceRateBurst(GetSourceRateBurst())
+
+	SetSourceRateLimit(0.001)
+	SetSourceRateBurst(3)
+
+	flooder := net.IPv4(10, 77, 0, 1)
+	before := GetMetrics().PacketsRateLimited
+
+	for i := 0; i < 3; i++ {
+		if !allowPacket(flooder) {
+			t.Fatalf("Expected packet %d of the burst to be allowed", i)
+		}
+	}
+
+	if allowPacket(flooder) {
+		t.Error("Expected the packet after the burst to be dropped")
+	}
+
+	if !allowPacket(net.IPv4(10, 77, 0, 2)) {
+		t.Error("Expected another source's packet to be allowed")
+	}
+
+	if limited := GetMetrics().PacketsRateLimited - before; limited != 1 {
+		t.Errorf("Expected 1 rate limited packet, found %d", limited)
+	}
+
+	SetSourceRateLimit(0)
+
+	if !allowPacket(flooder) {
+		t.Error("Expected no limit when the rate is 0")
+	}
+}
+
+// However many sources send packets, only so many buckets may be kept.
+func TestSourceBucketsCapped(t *testing.T) {
+	defer SetSourceRateLimit(GetSourceRateLimit())
+	SetSourceRateLimit(1)
+
+	for i := 0; i < maxSourceBuckets+10; i++ {
+		allowPacket(net.IPv4(10, 79, byte(i>>8), byte(i)))
+	}
+
+	sourceBuckets.Lock()
+	count := len(sourceBuckets.m)
+	sourceBuckets.Unlock()
+
+	if count > maxSourceBuckets {
+		t.Errorf("Expected at most %d buckets, found %d", maxSourceBuckets, count)
+	}
+}
+
+func TestAdmitMember(t *testing.T) {
+	_, cleanup := populateRegistry(3)
+	defer cleanup()
+
+	defer SetMaxMembers(GetMaxMembers())
+	defer SetMaxNewMembers(GetMaxNewMembers())
+	defer SetNewMembersIntervalMillis(GetNewMembersIntervalMillis())
+
+	node := &Node{ip: net.IPv4(10, 78, 0, 1), port: 9999}
+
+	SetMaxMembers(knownNodes.length())
+	SetMaxNewMembers(0)
+
+	if admitMember(node) {
+		t.Error("Expected a member beyond the member limit to be rejected")
+	}
+
+	SetMaxMembers(0)
+	SetMaxNewMembers(2)
+	SetNewMembersIntervalMillis(60000)
+
+	// Start a new interval.
+	newMembers.Lock()
+	newMembers.start = time.Time{}
+	newMembers.Unlock()
+
+	first := &Node{ip: net.IPv4(10, 78, 1, 0), port: 9999, status: StatusAlive}
+	second := &Node{ip: net.IPv4(10, 78, 1, 1), port: 9999, status: StatusAlive}
+
+	// Admitting the same member again doesn't take another place.
+	for i := 0; i < 2; i++ {
+		if !admitMember(first) {
+			t.Fatalf("Expected the first member to be admitted (%d)", i)
+		}
+	}
+
+	if !admitMember(second) {
+		t.Fatal("Expected the second member to be admitted")
+	}
+
+	// Members that have been admitted but not yet added hold their places.
+	if admitMember(node) {
+		t.Error("Expected a member beyond the admitted members to be rejected")
+	}
+
+	for _, added := range []*Node{first, second} {
+		addLearnedNode(added)
+		defer RemoveNode(added)
+	}
+
+	if admitMember(node) {
+		t.Error("Expected a member beyond the new member limit to be rejected")
+	}
+}
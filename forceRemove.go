@@ -0,0 +1,121 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"math"
+	"net"
+)
+
+// ForceRemove removes a member from the whole cluster, rather than only from
+// this node's known nodes as RemoveNode() does. The removal is broadcast, and
+// each member that receives it removes the node (emitting EventLeft if it
+// knew it) and tombstones it, so that until the tombstone is reaped no gossip
+// about the node can add it back. This is meant for cleaning up hosts that
+// were decommissioned without leaving: a node that's still running will be
+// added back by any member that it contacts directly.
+func ForceRemove(node *Node) error {
+	if node.Address() == thisHostAddress {
+		return errors.New("can't force-remove this node")
+	}
+
+	_, err := emitBroadcast(broadcastForceRemove, encodeForceRemove(node))
+	if err != nil {
+		return err
+	}
+
+	logInfo("Force-removing", node.Address())
+
+	forceRemove(node.IP(), node.Port())
+
+	return nil
+}
+
+// Removes and tombstones the node at the IP and port, whether or not it's
+// known. The tombstone rejects all gossip, however recent, since the members
+// that haven't yet received the removal may still be marking the node as
+// suspected or dead at newer heartbeats.
+func forceRemove(ip net.IP, port uint16) {
+	node := knownNodes.getByIP(ip, port)
+	if node == nil {
+		node, _ = CreateNodeByIP(ip, port)
+	} else {
+		removeNode(node, EventLeft)
+	}
+
+	deadNodeRetries.Lock()
+	delete(deadNodeRetries.m, node.Address())
+	deadNodeRetries.Unlock()
+
+	addTombstone(node, math.MaxUint32)
+}
+
+// Called by receiveBroadcast() when a forced removal is received.
+func receiveForceRemove(broadcast *Broadcast) {
+	ip, port, err := decodeForceRemove(broadcast.bytes)
+	if err != nil {
+		logfWarn("Bad forced removal from %s: %v", broadcast.Origin().Address(), err)
+		return
+	}
+
+	address := nodeAddressString(ip, port)
+
+	if address == thisHostAddress {
+		logfWarn("%s has force-removed this node from the cluster", broadcast.Origin().Address())
+		return
+	}
+
+	logfInfo("%s has force-removed %s from the cluster", broadcast.Origin().Address(), address)
+
+	forceRemove(ip, port)
+}
+
+// Forced removal contents for IPv6
+// Bytes       Content
+// ------------------------
+// Bytes 00-15 Removed node IP (00-03 for IPv4)
+// Bytes 16-17 Removed node port (04-05 for IPv4)
+func encodeForceRemove(node *Node) []byte {
+	bytes := make([]byte, ipLen+2)
+
+	ip := node.IP()
+	if ipLen == net.IPv4len {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+
+	copy(bytes, ip)
+	encodeUint16(node.Port(), bytes, ipLen)
+
+	return bytes
+}
+
+func decodeForceRemove(bytes []byte) (net.IP, uint16, error) {
+	err := checkLength("forced removal", bytes, 0, ipLen+2)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := make(net.IP, ipLen)
+	copy(ip, bytes[:ipLen])
+
+	port, _ := decodeUint16(bytes, ipLen)
+
+	return ip, port, nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+)
+
+// A received forced removal must remove the node, and no gossip about it,
+// however recent, may add it back.
+func TestReceiveForceRemove(t *testing.T) {
+	ipLen = net.IPv4len
+
+	nodes, cleanup := populateRegistry(2)
+	defer cleanup()
+
+	removed, reporter := nodes[0], nodes[1]
+
+	sub := Events()
+	defer sub.Unsubscribe()
+
+	receiveForceRemove(&Broadcast{
+		origin: reporter,
+		bytes:  encodeForceRemove(removed),
+		kind:   broadcastForceRemove,
+	})
+
+	if knownNodes.contains(removed) {
+		t.Fatal("Expected the node to be removed")
+	}
+
+	if e := waitForEvent(t, sub, EventLeft); e.Node.Address != removed.Address() {
+		t.Errorf("Expected an EventLeft for %s, found one for %s", removed.Address(), e.Node.Address)
+	}
+
+	msg := newMessage(verbPing, reporter, reporter.Heartbeat())
+	msg.addMember(&Node{ip: removed.ip, port: removed.port}, StatusSuspected, removed.Heartbeat()+1000, reporter)
+
+	updateStatusesFromMessage(msg)
+
+	if knownNodes.containsByAddress(removed.Address()) {
+		t.Error("Expected gossip about the force-removed node to be ignored")
+	}
+}
+
+// A forced removal relayed from a banned origin mustn't be applied.
+func TestForbiddenOriginForceRemove(t *testing.T) {
+	ipLen = net.IPv4len
+
+	nodes, cleanup := populateRegistry(2)
+	defer cleanup()
+
+	removed, origin := nodes[0], nodes[1]
+
+	if err := Ban(origin.Address()); err != nil {
+		t.Fatal(err)
+	}
+	defer Unban(origin.Address())
+
+	receiveBroadcast(&Broadcast{
+		origin: origin,
+		bytes:  encodeForceRemove(removed),
+		kind:   broadcastForceRemove,
+		index:  1,
+	})
+
+	if !knownNodes.contains(removed) {
+		t.Error("Expected a forced removal from a banned origin to be ignored")
+	}
+}
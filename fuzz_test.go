@@ -0,0 +1,173 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"hash/adler32"
+	"net"
+	"testing"
+)
+
+// Returns the encoded forms of the messages round-tripped by the tests in
+// message_test.go, for use as fuzzing seeds.
+func fuzzSeedMessages(ipv6 bool) [][]byte {
+	defer func(l int) { ipLen = l }(ipLen)
+
+	sender := &Node{ip: net.IP([]byte{127, 0, 0, 1}), port: 1234}
+	member := &Node{ip: net.IP([]byte{127, 0, 0, 2}), port: 9000}
+
+	ipLen = net.IPv4len
+	if ipv6 {
+		ipLen = net.IPv6len
+		sender.ip = net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50}
+		member.ip = net.IP{10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110, 120, 130, 140, 150, 160}
+	}
+
+	basic := newMessage(verbPing, sender, 255)
+
+	oneMember := newMessage(verbPing, sender, 255)
+	oneMember.addMember(member, StatusDead, 38, member)
+
+	withBroadcast := newMessage(verbPing, sender, 255)
+	withBroadcast.addMember(member, StatusDead, 38, member)
+	withBroadcast.addBroadcast(&Broadcast{
+		bytes:  []byte("This is a message"),
+		origin: sender,
+		index:  42})
+
+	withPayload := newMessage(verbRequest, sender, 255)
+	withPayload.addMember(member, StatusAlive, 38, member)
+	withPayload.addPayload(42, payloadOK, []byte("This is a request"))
+
+	return [][]byte{
+		basic.encode(),
+		oneMember.encode(),
+		withBroadcast.encode(),
+		withPayload.encode(),
+	}
+}
+
+// Decoding arbitrary bytes must return an error rather than panic. The
+// checksum is corrected before decoding, so that the fuzzer can explore past
+// it.
+func FuzzDecodeMessage(f *testing.F) {
+	for _, ipv6 := range []bool{false, true} {
+		for _, seed := range fuzzSeedMessages(ipv6) {
+			f.Add(seed, ipv6)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, ipv6 bool) {
+		defer func(l int) { ipLen = l }(ipLen)
+
+		ip := net.IP([]byte{127, 0, 0, 1})
+		ipLen = net.IPv4len
+		if ipv6 {
+			ip = net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50}
+			ipLen = net.IPv6len
+		}
+
+		bytes := make([]byte, len(data))
+		copy(bytes, data)
+
+		// Give the message this member's cluster ID, so that it isn't
+		// rejected before it's decoded.
+		if len(bytes) >= 9 {
+			encodeUint32(clusterID(), bytes, 5)
+		}
+
+		if len(bytes) >= 4 {
+			encodeUint32(adler32.Checksum(bytes[4:]), bytes, 0)
+		}
+
+		decodeMessage(ip, bytes)
+	})
+}
+
+// Handling arbitrary messages from a permitted sender must not panic either.
+// Any members the messages add are removed again after each input.
+func FuzzReceiveMessage(f *testing.F) {
+	for _, seed := range fuzzSeedMessages(false) {
+		f.Add(seed)
+	}
+
+	sender := &Node{ip: net.IP([]byte{127, 0, 0, 1}), port: 1234}
+	member := &Node{ip: net.IP([]byte{127, 0, 0, 2}), port: 9000}
+
+	empty := newMessage(verbPingRequest, sender, 255)
+	f.Add(empty.encode())
+
+	forward := newMessage(verbPingRequest, sender, 255)
+	forward.addMember(member, StatusAlive, 38, member)
+	f.Add(forward.encode())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, cleanup := populateRegistry(0)
+		defer cleanup()
+
+		if ipLen != net.IPv4len {
+			defer func(l int) { ipLen = l }(ipLen)
+			ipLen = net.IPv4len
+		}
+
+		known := make(map[*Node]bool)
+		for _, n := range knownNodes.values() {
+			known[n] = true
+		}
+
+		defer func() {
+			for _, n := range knownNodes.values() {
+				if !known[n] {
+					knownNodes.delete(n)
+				}
+			}
+		}()
+
+		bytes := make([]byte, len(data))
+		copy(bytes, data)
+
+		if len(bytes) >= 9 {
+			encodeUint32(clusterID(), bytes, 5)
+		}
+
+		if len(bytes) >= 4 {
+			encodeUint32(adler32.Checksum(bytes[4:]), bytes, 0)
+		}
+
+		receiveMessageUDP(&net.UDPAddr{IP: sender.ip, Port: int(sender.port)}, bytes)
+	})
+}
+
+func FuzzDecodeMulticastAnnounce(f *testing.F) {
+	for _, seed := range fuzzSeedMessages(false) {
+		f.Add(append([]byte{7}, append([]byte("cluster"), seed...)...))
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeMulticastAnnounceBytes(data)
+	})
+}
+
+func FuzzDecodeQuery(f *testing.F) {
+	seed, _ := encodeQuery("has-file", map[string]string{"role": "storage"}, []byte("file-x"))
+	f.Add(seed)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeQuery(data)
+	})
+}
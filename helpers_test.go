@@ -0,0 +1,155 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The loopback socket shared by the tests that exchange messages over the
+// network, and the result of opening it.
+var loopback struct {
+	sync.Once
+	conn *net.UDPConn
+	err  error
+}
+
+// Makes this process a member listening on a loopback socket, and returns it
+// along with a function that forgets it again. The transport is started once
+// per test binary, as it can't be stopped, and the member remains this host
+// for the rest of the tests: its goroutines may still be using it.
+func startLoopbackMember(t *testing.T) (*Node, func()) {
+	loopback.Do(func() {
+		loopback.conn, loopback.err = net.ListenUDP("udp",
+			&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if loopback.err != nil {
+			return
+		}
+
+		addr := loopback.conn.LocalAddr().(*net.UDPAddr)
+
+		thisHost = &Node{
+			ip:         addr.IP.To4(),
+			port:       uint16(addr.Port),
+			status:     StatusAlive,
+			timestamp:  time.Now(),
+			pingMillis: PingNoData,
+		}
+
+		thisHostAddress = thisHost.Address()
+		udpConn = loopback.conn
+
+		startReceiveWorkers()
+		startHandlerWorkers()
+
+		go listenUDP(loopback.conn)
+		go sendUDP(loopback.conn)
+	})
+
+	if loopback.err != nil {
+		t.Skip("cannot open a loopback socket:", loopback.err)
+	}
+
+	threshold := GetLogThreshold()
+	SetLogThreshold(LogOff)
+
+	knownNodes.add(thisHost)
+
+	return thisHost, func() {
+		knownNodes.delete(thisHost)
+		SetLogThreshold(threshold)
+	}
+}
+
+// Opens a loopback socket to stand in for a remote member, and returns it
+// along with the member. The member is forgotten when the socket is closed.
+func openLoopbackPeer(t *testing.T) (*net.UDPConn, *Node, func()) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := c.LocalAddr().(*net.UDPAddr)
+	node := &Node{ip: addr.IP.To4(), port: uint16(addr.Port), status: StatusAlive}
+
+	return c, node, func() {
+		c.Close()
+
+		if known := knownNodes.getByIP(node.IP(), node.Port()); known != nil {
+			RemoveNode(known)
+		}
+	}
+}
+
+// Fills the registry with size live nodes, all with pending updates, and
+// returns them along with a function that removes them again.
+func populateRegistry(size int) ([]*Node, func()) {
+	threshold := GetLogThreshold()
+	SetLogThreshold(LogOff)
+
+	self := thisHost
+	if thisHost == nil {
+		thisHost = &Node{ip: net.IPv4(10, 255, 255, 255), port: 9999}
+	}
+
+	nodes := make([]*Node, size)
+	for i := range nodes {
+		nodes[i] = &Node{
+			ip:     net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)),
+			port:   9999,
+			status: StatusAlive,
+		}
+
+		knownNodes.add(nodes[i])
+	}
+
+	for _, n := range nodes {
+		n.setEmitCounter(int8(emitCount()))
+		updatedNodes.push(n)
+	}
+
+	return nodes, func() {
+		for _, n := range nodes {
+			knownNodes.delete(n)
+			n.setEmitCounter(0)
+		}
+
+		updatedNodes.take(updatedNodes.length())
+
+		thisHost = self
+		SetLogThreshold(threshold)
+	}
+}
+
+// Waits for an event of the specified type, skipping any others.
+func waitForEvent(t *testing.T, sub *EventSubscription, eventType EventType) Event {
+	timeout := time.After(time.Second)
+
+	for {
+		select {
+		case e := <-sub.C():
+			if e.Type == eventType {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("Expected an %v event", eventType)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often this member checks whether it has become isolated.
+const isolationCheckInterval = time.Second
+
+// How long the largest view of the cluster is remembered for. A view that
+// stays smaller than it for this long is taken to be the new cluster size.
+const isolationPeakWindow = 10 * time.Minute
+
+// The state of isolation detection. A member is isolated when it has no live
+// peers although it has had some, or has initial hosts to join; or when
+// enough of the peers it has recently seen have died to leave it markedly
+// fewer. Peers that leave, or are removed, lower the recent peak instead, as
+// the cluster has simply shrunk. While isolated, it
+// re-seeds with exponential backoff, and only peers that have answered a ping
+// count towards ending its isolation.
+var isolation = struct {
+	sync.Mutex
+
+	// The most live peers seen in the peak window, and when it was seen.
+	peak     int
+	peakTime time.Time
+
+	// Whether a live peer has ever been seen.
+	joined bool
+
+	isolated   bool
+	attempts   int
+	nextReseed time.Time
+}{}
+
+// Checks for isolation once per isolation check interval, re-seeding when
+// it's due.
+func startIsolationCheckLoop() {
+	for {
+		time.Sleep(isolationCheckInterval)
+
+		if checkIsolation(time.Now()) {
+			reseed()
+		}
+	}
+}
+
+// Updates the isolation state from the current view of the cluster, and
+// returns whether it's time to re-seed. An EventIsolated is emitted when
+// this member becomes isolated.
+func checkIsolation(now time.Time) bool {
+	live, confirmed, dead := peerCounts()
+	threshold := GetIsolationThreshold()
+	seeded := len(GetInitialHosts()) > 0
+
+	isolation.Lock()
+
+	if confirmed > 0 {
+		isolation.joined = true
+	}
+
+	if confirmed >= isolation.peak || now.Sub(isolation.peakTime) >= isolationPeakWindow {
+		isolation.peak = confirmed
+		isolation.peakTime = now
+	}
+
+	peak := isolation.peak
+	wasIsolated := isolation.isolated
+
+	// Re-seeding adds the initial hosts back before they've responded, so
+	// they can't end an isolation.
+	if wasIsolated {
+		live = confirmed
+	}
+
+	// Only deaths can take a member below the threshold, as the peak is
+	// lowered when peers leave.
+	isolated := live == 0 && (isolation.joined || seeded)
+	if threshold > 0 && live > 0 && dead > 0 && float64(live) < threshold*float64(peak) {
+		isolated = true
+	}
+
+	reseedDue := false
+
+	switch {
+	case isolated && !wasIsolated:
+		isolation.isolated = true
+		isolation.attempts = 0
+		isolation.nextReseed = now
+		fallthrough
+	case isolated && !now.Before(isolation.nextReseed):
+		reseedDue = true
+		isolation.attempts++
+		isolation.nextReseed = now.Add(reseedBackoff(isolation.attempts))
+	case !isolated:
+		isolation.isolated = false
+	}
+
+	isolation.Unlock()
+
+	if isolated && !wasIsolated {
+		if live == 0 {
+			logWarn("Isolated: no live members. Re-seeding.")
+		} else {
+			logfWarn("Isolated: %d live members, where recently there were %d. Re-seeding.", live, peak)
+		}
+
+		emitEvent(EventIsolated, thisHost, thisHost.Status(), thisHost)
+	} else if !isolated && wasIsolated {
+		logfInfo("No longer isolated: %d live members", live)
+	}
+
+	return reseedDue
+}
+
+// Returns the delay before the re-seed that follows the specified number of
+// attempts, which doubles with each attempt up to the maximum interval.
+func reseedBackoff(attempts int) time.Duration {
+	interval := time.Duration(GetReseedIntervalMillis()) * time.Millisecond
+	max := time.Duration(GetReseedMaxIntervalMillis()) * time.Millisecond
+
+	for i := 1; i < attempts && interval < max; i++ {
+		interval *= 2
+	}
+
+	if interval > max {
+		interval = max
+	}
+
+	return interval
+}
+
+// Lowers the recent peak of live peers when a peer leaves or is removed.
+func noteIsolationDeparture() {
+	isolation.Lock()
+	if isolation.peak > 0 {
+		isolation.peak--
+	}
+	isolation.Unlock()
+}
+
+// Returns the number of known members, other than this one, that aren't
+// dead, how many of those answered their last ping, and how many are dead.
+func peerCounts() (live, confirmed, dead int) {
+	for _, n := range knownNodes.values() {
+		if n.Address() == thisHostAddress {
+			continue
+		}
+
+		if n.Status() == StatusDead {
+			dead++
+			continue
+		}
+
+		live++
+
+		if n.PingMillis() >= 0 {
+			confirmed++
+		}
+	}
+
+	return live, confirmed, dead
+}
+
+// Tries to rejoin the cluster as this member did at startup: the initial
+// hosts are resolved again and pinged, and re-added if they've since been
+// forgotten, and presence is announced by multicast if it's enabled.
+func reseed() {
+	for _, address := range GetInitialHosts() {
+		n, err := CreateNodeByAddress(address)
+		if err != nil {
+			logfError("Could not create node %s: %v", address, err)
+			continue
+		}
+
+		if n.Address() == thisHostAddress || !nodePermitted(n) {
+			continue
+		}
+
+		if known := knownNodes.getByIP(n.IP(), n.Port()); known != nil {
+			n = known
+		} else {
+			AddNode(n)
+		}
+
+		// Give a dead seed its full retries again.
+		deadNodeRetries.Lock()
+		delete(deadNodeRetries.m, n.Address())
+		deadNodeRetries.Unlock()
+
+		PingNode(n)
+	}
+
+	if GetMulticastEnabled() {
+		addr := GetMulticastAddress()
+		if addr == "" {
+			addr = guessMulticastAddress()
+		}
+
+		fullAddr := addr + ":" + strconv.FormatInt(int64(GetMulticastPort()), 10)
+
+		address, err := net.ResolveUDPAddr("udp", fullAddr)
+		if err == nil {
+			err = queuePacket(address, encodeMulticastAnnounceBytes())
+		}
+
+		if err != nil {
+			logError(err)
+		}
+	}
+
+	logDebug("Re-seeded")
+}
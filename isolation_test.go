@@ -0,0 +1,119 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"testing"
+	"time"
+)
+
+// Losing most of the recently seen members must be detected as isolation,
+// emitting an EventIsolated, and re-seeding must back off until the members
+// return.
+func TestCheckIsolation(t *testing.T) {
+	defer SetIsolationThreshold(GetIsolationThreshold())
+	defer SetReseedIntervalMillis(GetReseedIntervalMillis())
+	defer SetReseedMaxIntervalMillis(GetReseedMaxIntervalMillis())
+
+	SetIsolationThreshold(0.5)
+	SetReseedIntervalMillis(1000)
+	SetReseedMaxIntervalMillis(3000)
+
+	nodes, cleanup := populateRegistry(4)
+	defer cleanup()
+
+	defer func() {
+		isolation.Lock()
+		isolation.peak, isolation.joined, isolation.isolated = 0, false, false
+		isolation.Unlock()
+	}()
+
+	sub := Events()
+	defer sub.Unsubscribe()
+
+	now := time.Now()
+
+	if checkIsolation(now) {
+		t.Fatal("Expected a member with all of its peers not to re-seed")
+	}
+
+	for _, n := range nodes[:3] {
+		n.status = StatusDead
+	}
+
+	expected := []struct {
+		after  time.Duration
+		reseed bool
+	}{
+		{0, true},
+		{999 * time.Millisecond, false},
+		{time.Second, true},
+		{3 * time.Second, true},
+		{5 * time.Second, false},
+		{6 * time.Second, true},
+		{9 * time.Second, true},
+	}
+
+	for _, e := range expected {
+		if checkIsolation(now.Add(e.after)) != e.reseed {
+			t.Errorf("Expected re-seeding after %v to be %v", e.after, e.reseed)
+		}
+	}
+
+	waitForEvent(t, sub, EventIsolated)
+
+	for _, n := range nodes[:3] {
+		n.status = StatusAlive
+	}
+
+	if checkIsolation(now.Add(12 * time.Second)) {
+		t.Error("Expected a member whose peers have returned not to re-seed")
+	}
+}
+
+// Members leaving must shrink the cluster rather than isolate this member.
+func TestIsolationIgnoresDepartures(t *testing.T) {
+	defer SetIsolationThreshold(GetIsolationThreshold())
+	SetIsolationThreshold(0.5)
+
+	nodes, cleanup := populateRegistry(4)
+	defer cleanup()
+
+	defer func() {
+		isolation.Lock()
+		isolation.peak, isolation.joined, isolation.isolated = 0, false, false
+		isolation.Unlock()
+	}()
+
+	now := time.Now()
+	checkIsolation(now)
+
+	for _, n := range nodes[:3] {
+		RemoveNode(n)
+	}
+
+	if checkIsolation(now.Add(time.Second)) {
+		t.Error("Expected a member whose peers have left not to re-seed")
+	}
+
+	nodes[3].status = StatusDead
+	defer func() { nodes[3].status = StatusAlive }()
+
+	if !checkIsolation(now.Add(2 * time.Second)) {
+		t.Error("Expected a member whose last peer has died to re-seed")
+	}
+}
@@ -19,6 +19,8 @@ package smudge
 import (
 	"fmt"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -85,14 +87,22 @@ type Logger interface {
 type DefaultLogger struct{}
 
 var (
-	logThreshhold LogLevel
-	logger        Logger
+	// The logging threshold, as a LogLevel. Only ever accessed atomically,
+	// so that it can be changed while the member is running.
+	logThreshhold uint32
+
+	logger Logger
 )
 
+// GetLogThreshold returns the logging priority threshold.
+func GetLogThreshold() LogLevel {
+	return LogLevel(atomic.LoadUint32(&logThreshhold))
+}
+
 // SetLogThreshold allows the output noise level to be adjusted by setting
-// the logging priority threshold.
+// the logging priority threshold. It can be called at any time.
 func SetLogThreshold(level LogLevel) {
-	logThreshhold = level
+	atomic.StoreUint32(&logThreshhold, uint32(level))
 }
 
 // SetLogger plugs in another logger to control the output of the library
@@ -102,7 +112,7 @@ func SetLogger(l Logger) {
 
 // Log writes a log message of a certain level to the logger
 func (d DefaultLogger) Log(level LogLevel, a ...interface{}) (n int, err error) {
-	if level >= logThreshhold {
+	if level >= GetLogThreshold() {
 		fmt.Fprint(os.Stderr, prefix(level)+" ")
 		return fmt.Fprintln(os.Stderr, a...)
 	}
@@ -111,26 +121,45 @@ func (d DefaultLogger) Log(level LogLevel, a ...interface{}) (n int, err error)
 
 // Logf writes a log message with a specific format to the logger
 func (d DefaultLogger) Logf(level LogLevel, format string, a ...interface{}) (n int, err error) {
-	if level >= logThreshhold {
+	if level >= GetLogThreshold() {
 		return fmt.Fprintf(os.Stderr, prefix(level)+" "+format+"\n", a...)
 	}
 
 	return 0, nil
 }
 
+// ParseLogLevel returns the log level with the given name, ignoring case, as
+// returned by its String() method.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level := LogAll; level <= LogOff; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+
+	return LogInfo, fmt.Errorf("unknown log level %q", name)
+}
+
 func init() {
 	SetLogger(DefaultLogger{})
-	SetLogThreshold(LogInfo)
+
+	level, err := ParseLogLevel(getStringVar(EnvVarLogLevel, DefaultLogLevel))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse env property %s: %v. Using default.\n",
+			EnvVarLogLevel, err)
+	}
+
+	SetLogThreshold(level)
 }
 
 func log(level LogLevel, a ...interface{}) (n int, err error) {
-	if level >= logThreshhold {
+	if level >= GetLogThreshold() {
 		return logger.Log(level, a...)
 	}
 	return 0, nil
 }
 func logf(level LogLevel, format string, a ...interface{}) (n int, err error) {
-	if level >= logThreshhold {
+	if level >= GetLogThreshold() {
 		return logger.Logf(level, format, a...)
 	}
 	return 0, nil
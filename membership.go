@@ -18,30 +18,21 @@ package smudge
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"net"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// A scalar value used to calculate a variety of limits
-const lambda = 2.5
-
-// How many standard deviations beyond the mean PING/ACK response time we
-// allow before timing out an ACK.
-const timeoutToleranceSigmas = 3.0
-
 const defaultIPv4MulticastAddress = "224.0.0.0"
 
 const defaultIPv6MulticastAddress = "[ff02::1]"
 
-var currentHeartbeat uint32
-
-var pendingAcks = struct {
-	sync.RWMutex
-	m map[string]*pendingAck
-}{m: make(map[string]*pendingAck)}
+// This node's heartbeat, which is incremented with each probe. Only ever
+// accessed atomically.
+var heartbeatCounter uint32
 
 var thisHostAddress string
 
@@ -49,10 +40,7 @@ var thisHost *Node
 
 var ipLen = net.IPv4len
 
-// This flag is set whenever a known node is added or removed.
-var knownNodesModifiedFlag = false
-
-var pingdata = newPingData(GetPingHistoryFrontload(), 50)
+var pingdata = newPingData(DefaultPingHistoryFrontload, DefaultPingHistorySize)
 
 /******************************************************************************
  * Exported functions (for public consumption)
@@ -61,18 +49,22 @@ var pingdata = newPingData(GetPingHistoryFrontload(), 50)
 // Begin starts the server by opening a UDP port and beginning the heartbeat.
 // Note that this is a blocking function, so act appropriately.
 func Begin() {
+	atomic.StoreUint32(&begun, 1)
+
 	// Add this host.
-	logfInfo("Using listen IP: %s", listenIP)
+	logfInfo("Using listen IP: %s", GetListenIP())
 
 	// Use IPv6 address length if the listen IP is not an IPv4 address
-	if listenIP.To4() == nil {
+	if GetListenIP().To4() == nil {
 		ipLen = net.IPv6len
 	}
 
+	pingdata.reset(GetPingHistoryFrontload(), GetPingHistorySize())
+
 	me := Node{
-		ip:         listenIP,
+		ip:         GetListenIP(),
 		port:       uint16(GetListenPort()),
-		timestamp:  GetNowInMillis(),
+		timestamp:  time.Now(),
 		pingMillis: PingNoData,
 	}
 
@@ -83,10 +75,22 @@ func Begin() {
 
 	// Add this node's status. Don't update any other node's statuses: they'll
 	// report those back to us.
-	updateNodeStatus(thisHost, StatusAlive, 0, thisHost)
+	updateNodeStatus(thisHost, StatusAlive, 0, thisHost, newStatusCause(ReasonLocal))
 	AddNode(thisHost)
 
-	go listenUDP(GetListenPort())
+	c, err := openUDP(GetListenPort())
+	if err != nil {
+		logError("Could not open UDP socket:", err)
+		return
+	}
+
+	udpConn = c
+
+	startReceiveWorkers()
+	startHandlerWorkers()
+
+	go listenUDP(c)
+	go sendUDP(c)
 
 	// Add initial hosts as specified by the SMUDGE_INITIAL_HOSTS property
 	for _, address := range GetInitialHosts() {
@@ -98,86 +102,96 @@ func Begin() {
 		}
 	}
 
+	// Rejoin the members recorded in the snapshot, if there is one.
+	if path := GetSnapshotPath(); path != "" {
+		startSnapshot(path)
+	}
+
 	if GetMulticastEnabled() {
 		go listenUDPMulticast(GetMulticastPort())
 		go multicastAnnounce(GetMulticastAddress())
 	}
 
 	go startTimeoutCheckLoop()
+	go startIsolationCheckLoop()
+	go startPartitionRedialLoop()
 
-	// Loop over a randomized list of all known nodes (except for this host
-	// node), pinging one at a time. If the knownNodesModifiedFlag is set to
-	// true by AddNode() or RemoveNode(), the we get a fresh list and start
-	// again.
+	// Probe all known nodes (except for this host node) one at a time, in
+	// the randomized round-robin order maintained by the probe list. Nodes
+	// that are added or removed by AddNode() or RemoveNode() are inserted
+	// into or removed from the list as they change.
 
-	for {
-		var randomAllNodes = knownNodes.getRandomNodes(0, thisHost)
-		var pingCounter int
-
-		for _, node := range randomAllNodes {
-			// Exponential backoff of dead nodes, until such time as they are removed.
-			if node.status == StatusDead {
-				var dnc *deadNodeCounter
-				var ok bool
-
-				deadNodeRetries.Lock()
-				if dnc, ok = deadNodeRetries.m[node.Address()]; !ok {
-					dnc = &deadNodeCounter{retry: 1, retryCountdown: 2}
-					deadNodeRetries.m[node.Address()] = dnc
-				}
-				deadNodeRetries.Unlock()
+	// The number of nodes skipped in a row, to avoid spinning when all of
+	// them are dead and backing off.
+	var skipped int
 
-				dnc.retryCountdown--
+	for {
+		node := probes.nextNode()
 
-				if dnc.retryCountdown <= 0 {
-					dnc.retry++
-					dnc.retryCountdown = int(math.Pow(2.0, float64(dnc.retry)))
+		if node == nil {
+			logDebug("No nodes to ping. So lonely. :(")
+			time.Sleep(time.Millisecond * time.Duration(GetHeartbeatMillis()))
+			continue
+		}
 
-					if dnc.retry > maxDeadNodeRetries {
-						logDebug("Forgetting dead node", node.Address())
+		if skipped >= probes.length() {
+			skipped = 0
+			time.Sleep(time.Millisecond * time.Duration(GetHeartbeatMillis()))
+		}
 
-						deadNodeRetries.Lock()
-						delete(deadNodeRetries.m, node.Address())
-						deadNodeRetries.Unlock()
+		// Exponential backoff of dead nodes, until such time as they are removed.
+		if node.Status() == StatusDead {
+			var dnc *deadNodeCounter
+			var ok bool
 
-						RemoveNode(node)
-						continue
-					}
-				} else {
-					continue
-				}
+			deadNodeRetries.Lock()
+			if dnc, ok = deadNodeRetries.m[node.Address()]; !ok {
+				dnc = &deadNodeCounter{retry: 1, retryCountdown: 2}
+				deadNodeRetries.m[node.Address()] = dnc
 			}
+			deadNodeRetries.Unlock()
 
-			currentHeartbeat++
+			dnc.retryCountdown--
 
-			logfTrace("%d - hosts=%d (announce=%d forward=%d)",
-				currentHeartbeat,
-				len(randomAllNodes),
-				emitCount(),
-				pingRequestCount())
+			if dnc.retryCountdown <= 0 {
+				dnc.retry++
+				dnc.retryCountdown = int(math.Pow(2.0, float64(dnc.retry)))
 
-			PingNode(node)
-			pingCounter++
+				if dnc.retry > GetMaxDeadNodeRetries() {
+					logDebug("Forgetting dead node", node.Address())
 
-			time.Sleep(time.Millisecond * time.Duration(GetHeartbeatMillis()))
+					deadNodeRetries.Lock()
+					delete(deadNodeRetries.m, node.Address())
+					deadNodeRetries.Unlock()
 
-			if knownNodesModifiedFlag {
-				knownNodesModifiedFlag = false
-				break
+					removeNode(node, EventRemoved)
+					continue
+				}
+			} else {
+				skipped++
+				continue
 			}
 		}
 
-		if pingCounter == 0 {
-			logDebug("No nodes to ping. So lonely. :(")
-			time.Sleep(time.Millisecond * time.Duration(GetHeartbeatMillis()))
-		}
+		skipped = 0
+		heartbeat := atomic.AddUint32(&heartbeatCounter, 1)
+
+		logfTrace("%d - hosts=%d (announce=%d forward=%d)",
+			heartbeat,
+			probes.length(),
+			emitCount(),
+			pingRequestCount())
+
+		PingNode(node)
+
+		time.Sleep(time.Millisecond * time.Duration(GetHeartbeatMillis()))
 	}
 }
 
 // PingNode can be used to explicitly ping a node. Calls the low-level
 // doPingNode(), and outputs a message (and returns an error) if it fails.
 func PingNode(node *Node) error {
-	err := transmitVerbPingUDP(node, currentHeartbeat)
+	err := transmitVerbPingUDP(node, currentHeartbeat())
 	if err != nil {
 		logInfo("Failure to ping", node, "->", err)
 	}
@@ -194,10 +208,16 @@ func PingNode(node *Node) error {
 // Bytes 1 to N - Cluster name bytes
 // Bytes N+1... - A message (without members)
 func decodeMulticastAnnounceBytes(bytes []byte) (string, []byte, error) {
+	err := checkLength("multicast", bytes, 0, 1)
+	if err != nil {
+		return "", nil, err
+	}
+
 	nameBytesLen := int(bytes[0])
 
-	if nameBytesLen+1 > len(bytes) {
-		return "", nil, errors.New("Invalid multicast message received")
+	err = checkLength("multicast", bytes, 1, nameBytesLen)
+	if err != nil {
+		return "", nil, err
 	}
 
 	nameBytes := bytes[1 : nameBytesLen+1]
@@ -207,14 +227,40 @@ func decodeMulticastAnnounceBytes(bytes []byte) (string, []byte, error) {
 	return name, msgBytes, nil
 }
 
-func doForwardOnTimeout(pack *pendingAck) {
+// Returns this node's current heartbeat.
+func currentHeartbeat() uint32 {
+	return atomic.LoadUint32(&heartbeatCounter)
+}
+
+// Advances this node's heartbeat to the specified value, if it's behind.
+func advanceHeartbeat(heartbeat uint32) {
+	for {
+		current := atomic.LoadUint32(&heartbeatCounter)
+		if heartbeat <= current {
+			return
+		}
+
+		if atomic.CompareAndSwapUint32(&heartbeatCounter, current, heartbeat) {
+			logfTrace("Heartbeat advanced from %d to %d", current, heartbeat)
+			return
+		}
+	}
+}
+
+func doForwardOnTimeout(pack *pendingAck, timeoutMillis uint32) {
 	filteredNodes := getTargetNodes(pingRequestCount(), thisHost, pack.node)
 
 	if len(filteredNodes) == 0 {
 		logDebug(thisHost.Address(), "Cannot forward ping request: no more nodes")
 
-		updateNodeStatus(pack.node, StatusDead, currentHeartbeat, thisHost)
+		cause := newTimeoutCause(ReasonPingTimeout, pack.packType, timeoutMillis)
+		updateNodeStatus(pack.node, StatusDead, currentHeartbeat(), thisHost, cause)
 	} else {
+		relays := make([]string, len(filteredNodes))
+		for i, n := range filteredNodes {
+			relays[i] = n.Address()
+		}
+
 		for i, n := range filteredNodes {
 			logfDebug("(%d/%d) Requesting indirect ping of %s via %s",
 				i+1,
@@ -222,16 +268,21 @@ func doForwardOnTimeout(pack *pendingAck) {
 				pack.node.Address(),
 				n.Address())
 
-			transmitVerbForwardUDP(n, pack.node, currentHeartbeat)
+			transmitVerbForwardUDP(n, pack.node, currentHeartbeat(), relays)
 		}
 	}
 }
 
 // The number of times any node's new status should be emitted after changes.
-// Currently set to (lambda * log(node count)).
+// Currently set to (lambda * log(node count)), within the range of an emit
+// counter.
 func emitCount() int {
 	logn := math.Log(float64(knownNodes.length()))
-	mult := (lambda * logn) + 0.5
+	mult := (GetLambda() * logn) + 0.5
+
+	if mult > math.MaxInt8 {
+		return math.MaxInt8
+	}
 
 	return int(mult)
 }
@@ -250,7 +301,7 @@ func encodeMulticastAnnounceBytes() []byte {
 			" bytes (max 254)")
 	}
 
-	msg := newMessage(verbPing, thisHost, currentHeartbeat)
+	msg := newMessage(verbPing, thisHost, currentHeartbeat())
 	msgBytes := msg.encode()
 	msgBytesLen := len(msgBytes)
 
@@ -271,123 +322,119 @@ func encodeMulticastAnnounceBytes() []byte {
 }
 
 func guessMulticastAddress() string {
-	if multicastAddress == "" {
-		if ipLen == net.IPv6len {
-			multicastAddress = defaultIPv6MulticastAddress
-		} else if ipLen == net.IPv4len {
-			multicastAddress = defaultIPv4MulticastAddress
-		} else {
-			logFatal("Failed to determine IPv4/IPv6")
-		}
+	propertiesLock.Lock()
+	defer propertiesLock.Unlock()
+
+	if address := currentProperties().MulticastAddress; address != "" {
+		return address
+	}
+
+	config := currentProperties().clone()
+
+	if ipLen == net.IPv6len {
+		config.MulticastAddress = defaultIPv6MulticastAddress
+	} else if ipLen == net.IPv4len {
+		config.MulticastAddress = defaultIPv4MulticastAddress
+	} else {
+		logFatal("Failed to determine IPv4/IPv6")
 	}
 
-	return multicastAddress
+	storeProperties(&config)
+
+	return config.MulticastAddress
 }
 
 // Returns a random slice of valid ping/forward request targets; i.e., not
 // this node, and not dead.
 func getTargetNodes(count int, exclude ...*Node) []*Node {
-	randomNodes := knownNodes.getRandomNodes(0, exclude...)
-	filteredNodes := make([]*Node, 0, count)
-
-	for _, n := range randomNodes {
-		if len(filteredNodes) >= count {
-			break
-		}
-
-		if n.status == StatusDead {
-			continue
-		}
-
-		filteredNodes = append(filteredNodes, n)
+	if count <= 0 {
+		return []*Node{}
 	}
 
-	return filteredNodes
+	return knownNodes.sample(count, func(n *Node) bool {
+		return n.Status() != StatusDead && !isExcluded(n, exclude)
+	})
 }
 
-func listenUDP(port int) error {
-	listenAddress, err := net.ResolveUDPAddr("udp", ":"+strconv.FormatInt(int64(port), 10))
+func listenUDPMulticast(port int) error {
+	addr := GetMulticastAddress()
+	if addr == "" {
+		addr = guessMulticastAddress()
+	}
+
+	listenAddress, err := net.ResolveUDPAddr("udp", addr+":"+strconv.FormatInt(int64(port), 10))
 	if err != nil {
 		return err
 	}
 
 	/* Now listen at selected port */
-	c, err := net.ListenUDP("udp", listenAddress)
+	c, err := net.ListenMulticastUDP("udp", nil, listenAddress)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
 	for {
-		buf := make([]byte, 2048) // big enough to fit 1280 IPv6 UDP message
-		n, addr, err := c.ReadFromUDP(buf)
+		buf := bufferPool.Get().(*[]byte)
+
+		n, addr, err := c.ReadFromUDP(*buf)
 		if err != nil {
-			logError("UDP read error: ", err)
+			logError("UDP read error:", err)
+			bufferPool.Put(buf)
+			continue
 		}
 
-		go func(addr *net.UDPAddr, msg []byte) {
-			err = receiveMessageUDP(addr, buf[0:n])
-			if err != nil {
-				logError(err)
-			}
-		}(addr, buf[0:n])
+		queueInbound(inboundPacket{
+			addr:      addr,
+			buf:       buf,
+			size:      n,
+			multicast: true,
+		})
 	}
 }
 
-func listenUDPMulticast(port int) error {
-	addr := GetMulticastAddress()
-	if addr == "" {
-		addr = guessMulticastAddress()
+// receiveMulticastUDP processes a multicast announcement, updating the
+// statuses of the sender if it belongs to this cluster.
+func receiveMulticastUDP(addr *net.UDPAddr, bytes []byte) error {
+	name, msgBytes, err := decodeMulticastAnnounceBytes(bytes)
+	if err != nil {
+		logDebug("Ignoring unexpected multicast message.")
+		return nil
 	}
 
-	listenAddress, err := net.ResolveUDPAddr("udp", addr+":"+strconv.FormatInt(int64(port), 10))
-	if err != nil {
-		return err
+	if GetClusterName() != name {
+		return nil
 	}
 
-	/* Now listen at selected port */
-	c, err := net.ListenMulticastUDP("udp", nil, listenAddress)
-	if err != nil {
+	msg, err := decodeMessage(addr.IP, msgBytes)
+	if errors.Is(err, ErrVersionMismatch) {
+		noteVersionMismatch(addr)
+		return nil
+	} else if err != nil {
 		return err
 	}
-	defer c.Close()
 
-	for {
-		buf := make([]byte, 2048) // big enough to fit 1280 IPv6 UDP message
-		n, addr, err := c.ReadFromUDP(buf)
-		if err != nil {
-			logError("UDP read error:", err)
-		}
+	if !nodePermitted(msg.sender) {
+		noteForbiddenPacket(addr)
+		return nil
+	}
 
-		go func(addr *net.UDPAddr, bytes []byte) {
-			name, msgBytes, err := decodeMulticastAnnounceBytes(bytes)
+	logfTrace("Got multicast %v from %v code=%d",
+		msg.verb,
+		msg.sender.Address(),
+		msg.senderHeartbeat)
 
-			if err != nil {
-				logDebug("Ignoring unexpected multicast message.")
-			} else {
-				if GetClusterName() == name {
-					msg, err := decodeMessage(addr.IP, msgBytes)
-					if err == nil {
-						logfTrace("Got multicast %v from %v code=%d",
-							msg.verb,
-							msg.sender.Address(),
-							msg.senderHeartbeat)
-
-						// Update statuses of the sender.
-						updateStatusesFromMessage(msg)
-					} else {
-						logError(err)
-					}
-				}
-			}
-		}(addr, buf[0:n])
-	}
+	// Update statuses of the sender.
+	updateStatusesFromMessage(msg)
+
+	return nil
 }
 
 // multicastAnnounce is called when the server first starts to broadcast its
 // presence to all listening servers within the specified subnet and continues
 // to broadcast its presence every multicastAnnounceIntervalSeconds in case
-// this value is larger than zero.
+// this value is larger than zero. Changes to the interval made by Reload()
+// take effect straight away.
 func multicastAnnounce(addr string) error {
 	if addr == "" {
 		addr = guessMulticastAddress()
@@ -404,15 +451,9 @@ func multicastAnnounce(addr string) error {
 	}
 
 	for {
-		c, err := net.DialUDP("udp", nil, address)
-		if err != nil {
-			logError(err)
-			return err
-		}
-
 		// Compose and send the multicast announcement
 		msgBytes := encodeMulticastAnnounceBytes()
-		_, err = c.Write(msgBytes)
+		err = queuePacket(address, msgBytes)
 		if err != nil {
 			logError(err)
 			return err
@@ -420,27 +461,102 @@ func multicastAnnounce(addr string) error {
 
 		logfTrace("Sent announcement multicast to %v", fullAddr)
 
-		if GetMulticastAnnounceIntervalSeconds() > 0 {
-			time.Sleep(time.Second * time.Duration(GetMulticastAnnounceIntervalSeconds()))
-		} else {
-			return nil
+		waitForMulticastAnnounce()
+	}
+}
+
+// Waits until the next multicast announcement is due, after the announce
+// interval. While the interval is zero, there are no announcements after the
+// first, unless a reload changes it. A reload restarts the wait.
+func waitForMulticastAnnounce() {
+	for {
+		interval := GetMulticastAnnounceIntervalSeconds()
+
+		if interval <= 0 {
+			<-propertiesReloaded
+			continue
+		}
+
+		timer := time.NewTimer(time.Second * time.Duration(interval))
+
+		select {
+		case <-timer.C:
+			return
+		case <-propertiesReloaded:
+			timer.Stop()
 		}
 	}
 }
 
-// The number of nodes to send a PINGREQ to when a PING times out.
-// Currently set to (lambda * log(node count)).
+// The number of nodes to send a PINGREQ to when a PING times out. Unless
+// it's configured, this is the same as the piggyback count.
 func pingRequestCount() int {
-	logn := math.Log(float64(knownNodes.length()))
-	mult := (lambda * logn) + 0.5
+	if count := GetIndirectProbeCount(); count > 0 {
+		return count
+	}
+
+	return piggybackCount()
+}
+
+// The number of node statuses to piggyback on each message.
+// Currently set to (lambda * log(node count)).
+func piggybackCount() int {
+	// With no known nodes the log would be -Inf.
+	count := knownNodes.length()
+	if count == 0 {
+		return 0
+	}
+
+	logn := math.Log(float64(count))
+	mult := (GetLambda() * logn) + 0.5
 
 	return int(mult)
 }
 
+// Counts a packet rejected because it came from a member of another cluster,
+// warning (with decreasing frequency) since it usually means a member has
+// been misconfigured, or two clusters share an address range.
+func noteClusterMismatch(addr *net.UDPAddr) {
+	count := atomic.AddUint64(&metrics.clusterMismatches, 1)
+
+	if count&(count-1) == 0 {
+		logfWarn("Rejected packet from %v: sender is not in cluster %q (%d rejected so far)",
+			addr, GetClusterName(), count)
+	} else {
+		logfDebug("Rejected packet from %v: sender is not in cluster %q",
+			addr, GetClusterName())
+	}
+}
+
+// Counts a packet rejected because it was sent using another version of the
+// wire protocol, warning (with decreasing frequency) since it usually means
+// that the cluster is part way through an upgrade.
+func noteVersionMismatch(addr *net.UDPAddr) {
+	count := atomic.AddUint64(&metrics.versionMismatches, 1)
+
+	if count&(count-1) == 0 {
+		logfWarn("Rejected packet from %v: sender uses a different protocol version (%d rejected so far)",
+			addr, count)
+	} else {
+		logfDebug("Rejected packet from %v: sender uses a different protocol version", addr)
+	}
+}
+
 func receiveMessageUDP(addr *net.UDPAddr, msgBytes []byte) error {
 	msg, err := decodeMessage(addr.IP, msgBytes)
-	if err != nil {
-		return err
+	if errors.Is(err, ErrVersionMismatch) {
+		noteVersionMismatch(addr)
+		return nil
+	} else if errors.Is(err, ErrClusterMismatch) {
+		noteClusterMismatch(addr)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("message from %v: %w", addr, err)
+	}
+
+	if !nodePermitted(msg.sender) {
+		noteForbiddenPacket(addr)
+		return nil
 	}
 
 	logfTrace("Got %v from %v code=%d",
@@ -449,12 +565,8 @@ func receiveMessageUDP(addr *net.UDPAddr, msgBytes []byte) error {
 		msg.senderHeartbeat)
 
 	// Synchronize heartbeats
-	if msg.senderHeartbeat > 0 && msg.senderHeartbeat-1 > currentHeartbeat {
-		logfTrace("Heartbeat advanced from %d to %d",
-			currentHeartbeat,
-			msg.senderHeartbeat-1)
-
-		currentHeartbeat = msg.senderHeartbeat - 1
+	if msg.senderHeartbeat > 0 {
+		advanceHeartbeat(msg.senderHeartbeat - 1)
 	}
 
 	// Update statuses of the sender and any members the message includes.
@@ -473,6 +585,14 @@ func receiveMessageUDP(addr *net.UDPAddr, msgBytes []byte) error {
 		err = receiveVerbForwardUDP(msg)
 	case verbNonForwardingPing:
 		err = receiveVerbNonForwardPingUDP(msg)
+	case verbUserMessage:
+		err = receiveVerbUserMessageUDP(msg)
+	case verbRequest:
+		err = receiveVerbRequestUDP(msg)
+	case verbResponse:
+		err = receiveVerbResponseUDP(msg)
+	case verbQueryResponse:
+		err = receiveVerbQueryResponseUDP(msg)
 	}
 
 	if err != nil {
@@ -483,30 +603,20 @@ func receiveMessageUDP(addr *net.UDPAddr, msgBytes []byte) error {
 }
 
 func receiveVerbAckUDP(msg message) error {
-	key := msg.sender.Address() + ":" + strconv.FormatInt(int64(msg.senderHeartbeat), 10)
+	key := pendingAckKey(msg.sender, msg.senderHeartbeat)
 
-	pendingAcks.RLock()
-	_, ok := pendingAcks.m[key]
-	pendingAcks.RUnlock()
-
-	if ok {
+	pack := cancelPendingAck(key)
+	if pack != nil {
 		msg.sender.Touch()
 
-		pendingAcks.Lock()
-
-		if pack, ok := pendingAcks.m[key]; ok {
-			// If this is a response to a requested ping, respond to the
-			// callback node
-			if pack.callback != nil {
-				go transmitVerbAckUDP(pack.callback, pack.callbackCode)
-			} else {
-				// Note the ping response time.
-				notePingResponseTime(pack)
-			}
+		// If this is a response to a requested ping, respond to the
+		// callback node
+		if pack.callback != nil {
+			go transmitVerbAckUDP(pack.callback, pack.callbackCode)
+		} else {
+			// Note the ping response time.
+			notePingResponseTime(pack)
 		}
-
-		delete(pendingAcks.m, key)
-		pendingAcks.Unlock()
 	}
 
 	return nil
@@ -514,9 +624,9 @@ func receiveVerbAckUDP(msg message) error {
 
 func notePingResponseTime(pack *pendingAck) {
 	// Note the elapsed time
-	elapsedMillis := pack.elapsed()
+	elapsedMillis := uint32(pack.elapsed() / time.Millisecond)
 
-	pack.node.pingMillis = int(elapsedMillis)
+	pack.node.setPingMillis(int(elapsedMillis))
 
 	// For the purposes of timeout tolerance, we treat all pings less than
 	// the ping lower bound as that lower bound.
@@ -526,43 +636,41 @@ func notePingResponseTime(pack *pendingAck) {
 	}
 
 	pingdata.add(elapsedMillis)
+	pack.node.addRTTSample(elapsedMillis)
+
+	getFailureDetector().Observe(pack.node, time.Duration(elapsedMillis)*time.Millisecond)
 
-	mean, stddev := pingdata.data()
-	sigmas := pingdata.nSigma(timeoutToleranceSigmas)
+	rtt := pack.node.RTTStats()
 
-	logfTrace("Got ACK in %dms (mean=%.02f stddev=%.02f sigmas=%.02f)",
+	logfTrace("Got ACK from %s in %dms (mean=%v stddev=%v timeout=%v)",
+		pack.node.Address(),
 		elapsedMillis,
-		mean,
-		stddev,
-		sigmas)
+		rtt.Mean,
+		rtt.StdDev,
+		getFailureDetector().AckTimeout(pack.node))
 }
 
 func receiveVerbForwardUDP(msg message) error {
-	// We don't forward to a node that we don't know.
-
-	if len(msg.members) >= 0 &&
-		msg.members[0].status == StatusForwardTo {
-
-		member := msg.members[0]
-		node := member.node
-		code := member.heartbeat
-		key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
+	// A PINGREQ must name the node to forward to as its first member.
+	member := msg.getForwardTo()
+	if member == nil {
+		return errors.New("PINGREQ message without a node to forward to from " +
+			msg.sender.Address())
+	}
 
-		pack := pendingAck{
-			node:         node,
-			startTime:    GetNowInMillis(),
-			callback:     msg.sender,
-			callbackCode: code,
-			packType:     packNFP}
+	node := member.node
+	code := member.heartbeat
 
-		pendingAcks.Lock()
-		pendingAcks.m[key] = &pack
-		pendingAcks.Unlock()
+	pack := pendingAck{
+		node:         node,
+		startTime:    time.Now(),
+		callback:     msg.sender,
+		callbackCode: code,
+		packType:     packNFP}
 
-		return transmitVerbGenericUDP(node, nil, verbNonForwardingPing, code)
-	}
+	addPendingAck(&pack, code)
 
-	return nil
+	return transmitVerbGenericUDP(node, nil, verbNonForwardingPing, code)
 }
 
 func receiveVerbPingUDP(msg message) error {
@@ -573,138 +681,74 @@ func receiveVerbNonForwardPingUDP(msg message) error {
 	return transmitVerbAckUDP(msg.sender, msg.senderHeartbeat)
 }
 
-func startTimeoutCheckLoop() {
-	for {
-		pendingAcks.Lock()
-		for k, pack := range pendingAcks.m {
-			elapsed := pack.elapsed()
-			timeoutMillis := uint32(pingdata.nSigma(timeoutToleranceSigmas))
-
-			// Ping requests are expected to take quite a bit longer.
-			// Just call it 2x for now.
-			if pack.packType == packPingReq {
-				timeoutMillis *= 2
-			}
-
-			// This pending ACK has taken longer than expected. Mark it as
-			// timed out.
-			if elapsed > timeoutMillis {
-				switch pack.packType {
-				case packPing:
-					go doForwardOnTimeout(pack)
-				case packPingReq:
-					logDebug(k, "timed out after", timeoutMillis, "milliseconds (dropped PINGREQ)")
-
-					if knownNodes.contains(pack.callback) {
-						switch pack.callback.Status() {
-						case StatusDead:
-							break
-						case StatusSuspected:
-							updateNodeStatus(pack.callback, StatusDead, currentHeartbeat, thisHost)
-							pack.callback.pingMillis = PingTimedOut
-						default:
-							updateNodeStatus(pack.callback, StatusSuspected, currentHeartbeat, thisHost)
-							pack.callback.pingMillis = PingTimedOut
-						}
-					}
-				case packNFP:
-					logDebug(k, "timed out after", timeoutMillis, "milliseconds (dropped NFP)")
-
-					if knownNodes.contains(pack.node) {
-						switch pack.node.Status() {
-						case StatusDead:
-							break
-						case StatusSuspected:
-							updateNodeStatus(pack.node, StatusDead, currentHeartbeat, thisHost)
-							pack.callback.pingMillis = PingTimedOut
-						default:
-							updateNodeStatus(pack.node, StatusSuspected, currentHeartbeat, thisHost)
-							pack.callback.pingMillis = PingTimedOut
-						}
-					}
-				}
-
-				delete(pendingAcks.m, k)
-			}
-		}
-		pendingAcks.Unlock()
-
-		time.Sleep(time.Millisecond * 100)
-	}
-}
-
 func transmitVerbGenericUDP(node *Node, forwardTo *Node, verb messageVerb, code uint32) error {
-	// Transmit the ACK
-	remoteAddr, err := net.ResolveUDPAddr("udp", node.Address())
-
-	c, err := net.DialUDP("udp", nil, remoteAddr)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
 	msg := newMessage(verb, thisHost, code)
 
 	if forwardTo != nil {
-		msg.addMember(forwardTo, StatusForwardTo, code, forwardTo.statusSource)
+		msg.addMember(forwardTo, StatusForwardTo, code, forwardTo.StatusSource())
 	}
 
-	// Add members for update.
-	nodes := getRandomUpdatedNodes(pingRequestCount(), node, thisHost)
+	return transmitMessageUDP(node, msg)
+}
+
+// transmitMessageUDP piggybacks any pending member updates and broadcast onto
+// an already-composed message, and queues it to be sent to the specified node
+// from the listening socket.
+func transmitMessageUDP(node *Node, msg message) error {
+	var err error
+
+	// Add members for update. They're returned to the update queue once
+	// their counters have been decremented.
+	updated := updatedNodes.take(piggybackCount(), node, thisHost)
+	defer updatedNodes.requeue(updated)
+
+	nodes := updated
 
 	// No updates to distribute? Send out a few updates on other known nodes.
 	if len(nodes) == 0 {
-		nodes = knownNodes.getRandomNodes(pingRequestCount(), node, thisHost)
+		nodes = knownNodes.getRandomNodes(piggybackCount(), node, thisHost)
 	}
 
 	for _, n := range nodes {
-		err = msg.addMember(n, n.status, n.heartbeat, n.statusSource)
+		status, heartbeat, source := n.gossip()
+
+		err = msg.addMember(n, status, heartbeat, source)
 		if err != nil {
 			return err
 		}
 
-		n.emitCounter--
+		n.decrementEmitCounter()
 	}
 
-	// Emit counters for broadcasts can be less than 0. We transmit positive
-	// numbers, and decrement all the others. At some value < 0, the broadcast
-	// is removed from the map all together.
 	broadcast := getBroadcastToEmit()
 	if broadcast != nil {
-		if broadcast.emitCounter > 0 {
-			msg.addBroadcast(broadcast)
-		}
-
-		broadcast.emitCounter--
+		msg.addBroadcast(broadcast)
 	}
 
-	_, err = c.Write(msg.encode())
+	err = queuePacket(udpAddrOf(node), msg.encode())
 	if err != nil {
 		return err
 	}
 
 	// Decrement the update counters on those nodes
 	for _, m := range msg.members {
-		m.node.emitCounter--
+		m.node.decrementEmitCounter()
 	}
 
-	logfTrace("Sent %v to %v", verb, node.Address())
+	logfTrace("Sent %v to %v", msg.verb, node.Address())
 
 	return nil
 }
 
-func transmitVerbForwardUDP(node *Node, downstream *Node, code uint32) error {
-	key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
-
+func transmitVerbForwardUDP(node *Node, downstream *Node, code uint32, relays []string) error {
 	pack := pendingAck{
 		node:      node,
-		startTime: GetNowInMillis(),
+		startTime: time.Now(),
 		callback:  downstream,
-		packType:  packPingReq}
+		packType:  packPingReq,
+		relays:    relays}
 
-	pendingAcks.Lock()
-	pendingAcks.m[key] = &pack
-	pendingAcks.Unlock()
+	addPendingAck(&pack, code)
 
 	return transmitVerbGenericUDP(node, downstream, verbPingRequest, code)
 }
@@ -714,91 +758,86 @@ func transmitVerbAckUDP(node *Node, code uint32) error {
 }
 
 func transmitVerbPingUDP(node *Node, code uint32) error {
-	key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
 	pack := pendingAck{
 		node:      node,
-		startTime: GetNowInMillis(),
+		startTime: time.Now(),
 		packType:  packPing}
 
-	pendingAcks.Lock()
-	pendingAcks.m[key] = &pack
-	pendingAcks.Unlock()
+	addPendingAck(&pack, code)
 
 	return transmitVerbGenericUDP(node, nil, verbPing, code)
 }
 
 func updateStatusesFromMessage(msg message) {
+	// A sender that isn't yet known is subject to the member limits, and if
+	// it can't be added, nothing it says is taken in either.
+	if !knownNodes.contains(msg.sender) && !admitMember(msg.sender) {
+		return
+	}
+
+	// Obviously, we know the sender is alive. Report it as such.
+	if msg.senderHeartbeat > msg.sender.Heartbeat() {
+		cause := newStatusCause(ReasonDirectContact)
+		cause.Reporter = msg.sender.Address()
+
+		updateNodeStatus(msg.sender, StatusAlive, msg.senderHeartbeat, thisHost, cause)
+	}
+
+	// If we don't know the sender we add it to the known hosts map.
+	addLearnedNode(msg.sender)
+
 	for _, m := range msg.members {
 		// If the heartbeat in the message is less then the heartbeat
 		// associated with the last known status, then we conclude that the
 		// message is old and we drop it.
-		if m.heartbeat < m.node.heartbeat {
+		if known := m.node.Heartbeat(); m.heartbeat < known {
 			logfDebug("Message is old (%d vs %d): dropping",
-				m.node.heartbeat, m.heartbeat)
+				known, m.heartbeat)
 
 			continue
 		}
 
-		switch m.status {
-		case StatusForwardTo:
-			// The FORWARD_TO status isn't useful here, so we ignore those.
+		// Ignore gossip about members that may not be known, so that they
+		// aren't added back.
+		if !nodePermitted(m.node) {
 			continue
-		case StatusDead:
-			// Don't tell ME I'm dead.
-			if m.node.Address() != thisHost.Address() {
-				updateNodeStatus(m.node, m.status, m.heartbeat, m.source)
-				AddNode(m.node)
-			}
-		default:
-			updateNodeStatus(m.node, m.status, m.heartbeat, m.source)
-			AddNode(m.node)
 		}
-	}
 
-	// Obviously, we know the sender is alive. Report it as such.
-	if msg.senderHeartbeat > msg.sender.heartbeat {
-		updateNodeStatus(msg.sender, StatusAlive, msg.senderHeartbeat, thisHost)
-	}
+		// Don't let stale gossip bring back a member that's been removed.
+		if !knownNodes.contains(m.node) && tombstoned(m.node, m.status, m.heartbeat) {
+			logfDebug("Ignoring stale gossip about removed member %s", m.node.Address())
+			continue
+		}
 
-	// Finally, if we don't know the sender we add it to the known hosts map.
-	if !knownNodes.contains(msg.sender) {
-		AddNode(msg.sender)
-	}
-}
+		// The FORWARD_TO status isn't useful here, so we ignore those.
+		if m.status == StatusForwardTo {
+			continue
+		}
 
-// pendingAckType represents an expectation of a response to a previously
-// emitted PING, PINGREQ, or NFP.
-type pendingAck struct {
-	startTime    uint32
-	node         *Node
-	callback     *Node
-	callbackCode uint32
-	packType     pendingAckType
-}
+		// Don't tell ME I'm dead.
+		if m.status == StatusDead && m.node.Address() == thisHost.Address() {
+			continue
+		}
 
-func (a *pendingAck) elapsed() uint32 {
-	return GetNowInMillis() - a.startTime
-}
+		// Members that aren't yet known are subject to the member limits.
+		if !knownNodes.contains(m.node) && !admitMember(m.node) {
+			continue
+		}
 
-// pendingAckType represents the type of PING that a pendingAckType is waiting
-// for a response for: PING, PINGREQ, or NFP.
-type pendingAckType byte
+		updateNodeStatus(m.node, m.status, m.heartbeat, m.source, gossipCause(msg, m))
+		addLearnedNode(m.node)
+	}
+}
 
-const (
-	packPing pendingAckType = iota
-	packPingReq
-	packNFP
-)
+// Convenience function. Creates a cause describing a status gossiped by the
+// sender of a message.
+func gossipCause(msg message, m *messageMember) StatusCause {
+	cause := newStatusCause(ReasonGossip)
+	cause.Reporter = msg.sender.Address()
 
-func (p pendingAckType) String() string {
-	switch p {
-	case packPing:
-		return "PING"
-	case packPingReq:
-		return "PINGREQ"
-	case packNFP:
-		return "NFP"
-	default:
-		return "UNDEFINED"
+	if m.source != nil {
+		cause.Source = m.source.Address()
 	}
+
+	return cause
 }
@@ -19,32 +19,43 @@ package smudge
 import (
 	"errors"
 	"hash/adler32"
+	"hash/fnv"
 	"net"
+	"sync/atomic"
 )
 
 // Message contents
-// ---[ Base message (11 bytes)]---
+// ---[ Base message (16 bytes)]---
 // Bytes 00-03 Checksum (32-bit)
-// Bytes 04    Verb (one of {PING|ACK|PINGREQ|NFPING})
-// Bytes 05-06 Sender response port
-// Bytes 07-10 Sender current heartbeat
+// Bytes 04    Protocol version
+// Bytes 05-08 Cluster ID (32-bit hash of the cluster name)
+// Bytes 09    Verb (one of {PING|ACK|PINGREQ|NFPING|USER|REQUEST|RESPONSE|QRESPONSE})
+// Bytes 10-11 Sender response port
+// Bytes 12-15 Sender current heartbeat
 // ---[ Per member (23 bytes)]---
 // Bytes 00    Member status byte
 // Bytes 01-16 Member host IP (01-04 for IPv4)
 // Bytes 17-18 Member host response port (05-06 for IPv4)
 // Bytes 19-22 Sender current heartbeat (07-10 for IPv4)
-// ---[ Per broadcast (1 allowed) (23+N bytes) ]
+// ---[ User payload (USER, REQUEST, RESPONSE and QRESPONSE only) (7+N bytes) ]---
+// Bytes 00-03 Payload ID
+// Bytes 04    Payload flags
+// Bytes 05-06 Payload length (bytes)
+// Bytes 07-NN Payload
+// ---[ Per broadcast (1 allowed) (25+N bytes) ]
 // Bytes 00-15 Origin IP (00-03 for IPv4)
 // Bytes 16-17 Origin response port (04-05 for IPv4)
 // Bytes 18-21 Origin broadcast counter (06-09 for IPv4)
-// Bytes 22-23 Payload length (bytes) (10-11 for IPv4)
-// Bytes 24-NN Payload (12-NN for IPv4)
+// Bytes 22    Broadcast type (10 for IPv4)
+// Bytes 23-24 Payload length (bytes) (11-12 for IPv4)
+// Bytes 25-NN Payload (13-NN for IPv4)
 
 type message struct {
 	sender          *Node
 	senderHeartbeat uint32
 	verb            messageVerb
 	members         []*messageMember
+	payload         *messagePayload
 	broadcast       *Broadcast
 }
 
@@ -64,6 +75,36 @@ type messageMember struct {
 	status NodeStatus
 }
 
+// Represents the user payload carried by USER, REQUEST, RESPONSE and
+// QRESPONSE messages.
+type messagePayload struct {
+	// Correlates a RESPONSE to the REQUEST that prompted it. Unused by USER.
+	id uint32
+
+	// Qualifies the payload; for example, to flag a RESPONSE as an error.
+	flags payloadFlags
+
+	// The payload proper.
+	bytes []byte
+}
+
+// payloadFlags qualifies the contents of a message payload.
+type payloadFlags byte
+
+const (
+	// The payload contains the response (or message) bytes.
+	payloadOK payloadFlags = iota
+
+	// The recipient has no handler to respond to the request.
+	payloadNoHandler
+
+	// The recipient's handler returned an error; the payload is its text.
+	payloadError
+
+	// The recipient acknowledges receipt of a query.
+	payloadAck
+)
+
 // Convenience function. Creates a new message instance.
 func newMessage(verb messageVerb, sender *Node, senderHeartbeat uint32) message {
 	return message{
@@ -79,14 +120,20 @@ func (m *message) addBroadcast(broadcast *Broadcast) {
 	m.broadcast = broadcast
 }
 
+// Sets the user payload of this message. Only USER, REQUEST, RESPONSE and
+// QRESPONSE messages transmit a payload; it is ignored by all other verbs.
+func (m *message) addPayload(id uint32, flags payloadFlags, bytes []byte) {
+	m.payload = &messagePayload{id: id, flags: flags, bytes: bytes}
+}
+
 // Adds a member status update to this message. The maximum number of allowed
-// members is 2^6 - 1 = 63, though it is incredibly unlikely that this maximum
+// members is 2^5 - 1 = 31, though it is incredibly unlikely that this maximum
 // will be reached without an absurdly high lambda. There aren't yet many
-// 88 billion node clusters (assuming lambda of 2.5).
+// 250,000 node clusters (assuming lambda of 2.5).
 func (m *message) addMember(node *Node, status NodeStatus, heartbeat uint32, gossipSource *Node) error {
 	if m.members == nil {
 		m.members = make([]*messageMember, 0, 32)
-	} else if len(m.members) >= 63 {
+	} else if len(m.members) >= maxMessageMembers {
 		return errors.New("member list overflow")
 	}
 
@@ -102,12 +149,55 @@ func (m *message) addMember(node *Node, status NodeStatus, heartbeat uint32, gos
 	return nil
 }
 
+// The length of the base message, which every message starts with.
+const messageHeaderLength = 16
+
+// The most members that a message can carry, as counted by 5 bits of the
+// verb byte.
+const maxMessageMembers = 31
+
+// The version of the wire protocol, which is carried by every message.
+// Messages of any other version are rejected, as their layout can't be
+// relied on. The original, unversioned protocol is taken to be version 1.
+const protocolVersion = 2
+
+// The identifier of this member's cluster, which is computed whenever the
+// cluster name is set rather than for every message. Holds a uint32 once the
+// properties have been loaded.
+var cachedClusterID atomic.Value
+
+// Returns the identifier of this member's cluster, which is carried by every
+// message so that those from members of other clusters can be rejected: the
+// 32-bit FNV-1a hash of the cluster name.
+func clusterID() uint32 {
+	id, ok := cachedClusterID.Load().(uint32)
+	if !ok {
+		// Loading the properties caches the identifier.
+		GetClusterName()
+		id = cachedClusterID.Load().(uint32)
+	}
+
+	return id
+}
+
+// Caches the identifier of the named cluster. The caller must hold
+// propertiesLock, so that the cached identifier can't fall out of step with
+// the cluster name.
+func cacheClusterID(name string) {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	cachedClusterID.Store(h.Sum32())
+}
+
 // Message contents
-// ---[ Base message (12 bytes)]---
+// ---[ Base message (16 bytes)]---
 // Bytes 00-03 Checksum (32-bit)
-// Bytes 04    Verb (one of {PING|ACK|PINGREQ|NFPING})
-// Bytes 05-06 Sender response port
-// Bytes 07-10 Sender ID Code
+// Bytes 04    Protocol version
+// Bytes 05-08 Cluster ID
+// Bytes 09    Verb (one of {PING|ACK|PINGREQ|NFPING|USER|REQUEST|RESPONSE|QRESPONSE})
+// Bytes 10-11 Sender response port
+// Bytes 12-15 Sender ID Code
 // ---[ Per member (23 bytes, 17 bytes for IPv4)]---
 // Bytes 00    Member status byte
 // Bytes 01-16 Member host IP (01-04 for IPv4)
@@ -115,15 +205,24 @@ func (m *message) addMember(node *Node, status NodeStatus, heartbeat uint32, gos
 // Bytes 19-22 Member heartbeat (07-10 for IPv4)
 // Bytes 23-38 Gossip source IP (11-14 fit IPv4)
 // Bytes 39-40 Gossip source response port (15-16 for IPv4)
+// ---[ User payload (USER, REQUEST, RESPONSE and QRESPONSE only) (7+N bytes) ]---
+// Bytes 00-03 Payload ID
+// Bytes 04    Payload flags
+// Bytes 05-06 Payload length (bytes)
+// Bytes 07-NN Payload
 
 func (m *message) encode() []byte {
-	// Pre-calculate the message size. Each message prefix is 11 bytes.
+	// Pre-calculate the message size. Each message prefix is 16 bytes.
 	// Each member has a constant size of 9 bytes, plus 2 times the length of
 	// the IP (4 for IPv4, 16 for IPv6).
-	size := 11 + (len(m.members) * (9 + ipLen + ipLen))
+	size := messageHeaderLength + (len(m.members) * memberLength())
+
+	if m.verb.hasPayload() && m.payload != nil {
+		size += 7 + len(m.payload.bytes)
+	}
 
 	if m.broadcast != nil {
-		size += 8 + ipLen + len(m.broadcast.bytes)
+		size += 9 + ipLen + len(m.broadcast.bytes)
 	}
 
 	bytes := make([]byte, size, size)
@@ -131,17 +230,23 @@ func (m *message) encode() []byte {
 	// An index pointer (start at 4 to accommodate checksum)
 	p := 4
 
-	// Byte 00
-	// Rightmost 2 bits: verb (one of {P|A|F|N})
-	// Leftmost 6 bits: number of members in payload
+	// Byte 04 Protocol version
+	p += encodeByte(protocolVersion, bytes, p)
+
+	// Bytes 05-08 Cluster ID
+	p += encodeUint32(clusterID(), bytes, p)
+
+	// Byte 09
+	// Rightmost 3 bits: verb (one of {P|A|F|N|U|R|S|Q})
+	// Leftmost 5 bits: number of members in payload
 	verbByte := byte(len(m.members))
-	verbByte = (verbByte << 2) | byte(m.verb)
+	verbByte = (verbByte << 3) | byte(m.verb)
 	p += encodeByte(verbByte, bytes, p)
 
-	// Bytes 01-02 Sender response port
+	// Bytes 10-11 Sender response port
 	p += encodeUint16(m.sender.port, bytes, p)
 
-	// Bytes 03-06 ID Code
+	// Bytes 12-15 ID Code
 	p += encodeUint32(m.senderHeartbeat, bytes, p)
 
 	// Each member data requires 23 bytes (11 for IPv4).
@@ -206,6 +311,20 @@ func (m *message) encode() []byte {
 		}
 	}
 
+	if m.verb.hasPayload() && m.payload != nil {
+		// Payload ID
+		p += encodeUint32(m.payload.id, bytes, p)
+
+		// Payload flags
+		p += encodeByte(byte(m.payload.flags), bytes, p)
+
+		// Payload length (bytes)
+		p += encodeUint16(uint16(len(m.payload.bytes)), bytes, p)
+
+		// Payload proper
+		p += copy(bytes[p:], m.payload.bytes)
+	}
+
 	if m.broadcast != nil {
 		bbytes := m.broadcast.encode()
 		for i, v := range bbytes {
@@ -239,26 +358,47 @@ func decodeMessage(sourceIP net.IP, bytes []byte) (message, error) {
 	// An index pointer
 	p := 0
 
+	// The checksum, version, cluster ID, verb, sender port and heartbeat are
+	// always present.
+	err = checkLength("message", bytes, p, messageHeaderLength)
+	if err != nil {
+		return newMessage(255, nil, 0), err
+	}
+
 	// Bytes 00-03 Checksum (32-bit)
 	checksumStated, p := decodeUint32(bytes, p)
 	checksumCalculated := adler32.Checksum(bytes[4:])
 	if checksumCalculated != checksumStated {
 		return newMessage(255, nil, 0),
-			errors.New("checksum failure from " + sourceIP.String())
+			&DecodeError{Part: "message", Offset: 0, Err: ErrChecksum}
+	}
+
+	// Byte 04 Protocol version
+	version, p := decodeByte(bytes, p)
+	if version != protocolVersion {
+		return newMessage(255, nil, 0),
+			&DecodeError{Part: "message", Offset: 4, Err: ErrVersionMismatch}
+	}
+
+	// Bytes 05-08 Cluster ID
+	cluster, p := decodeUint32(bytes, p)
+	if cluster != clusterID() {
+		return newMessage(255, nil, 0),
+			&DecodeError{Part: "message", Offset: 5, Err: ErrClusterMismatch}
 	}
 
-	// Byte 04
-	// Rightmost 2 bits: verb (one of {P|A|F|N})
-	// Leftmost 6 bits: number of members in payload
+	// Byte 09
+	// Rightmost 3 bits: verb (one of {P|A|F|N|U|R|S|Q})
+	// Leftmost 5 bits: number of members in payload
 	v, p := decodeByte(bytes, p)
-	verb := messageVerb(v & 0x03)
+	verb := messageVerb(v & 0x07)
 
-	memberCount := int(v >> 2)
+	memberCount := int(v >> 3)
 
-	// Bytes 05-06 Sender response port
+	// Bytes 10-11 Sender response port
 	senderPort, p := decodeUint16(bytes, p)
 
-	// Bytes 07-10 Sender ID Code
+	// Bytes 12-15 Sender ID Code
 	senderHeartbeat, p := decodeUint32(bytes, p)
 
 	// Now that we have the IP and port, we can find the Node.
@@ -272,102 +412,149 @@ func decodeMessage(sourceIP net.IP, bytes []byte) (message, error) {
 	// Now that we have the verb, node, and code, we can build the mesage
 	m := newMessage(verb, sender, senderHeartbeat)
 
-	memberLastIndex := p + (memberCount * (9 + ipLen + ipLen))
+	memberLastIndex := p + (memberCount * memberLength())
+
+	err = checkLength("message", bytes, p, memberLastIndex-p)
+	if err != nil {
+		return m, err
+	}
 
 	if len(bytes) > p {
-		m.members = decodeMembers(memberCount, bytes[p:memberLastIndex])
+		m.members, err = decodeMembers(memberCount, bytes[p:memberLastIndex])
+		if err != nil {
+			return m, err
+		}
 	}
 
-	if len(bytes) > memberLastIndex {
-		m.broadcast, err = decodeBroadcast(bytes[memberLastIndex:])
+	p = memberLastIndex
+
+	if verb.hasPayload() && len(bytes) > p {
+		m.payload, p, err = decodePayload(bytes, p)
+		if err != nil {
+			return m, err
+		}
+	}
+
+	if len(bytes) > p {
+		m.broadcast, err = decodeBroadcast(bytes[p:])
 	}
 
 	return m, err
 }
 
-func decodeMembers(memberCount int, bytes []byte) []*messageMember {
+// Bytes 00-03 Payload ID
+// Bytes 04    Payload flags
+// Bytes 05-06 Payload length (bytes)
+// Bytes 07-NN Payload
+func decodePayload(bytes []byte, p int) (*messagePayload, int, error) {
+	err := checkLength("payload", bytes, p, 7)
+	if err != nil {
+		return nil, p, err
+	}
+
+	id, p := decodeUint32(bytes, p)
+	flags, p := decodeByte(bytes, p)
+	length, p := decodeUint16(bytes, p)
+
+	err = checkLength("payload", bytes, p, int(length))
+	if err != nil {
+		return nil, p, err
+	}
+
+	// Copy the payload bytes out of the receive buffer.
+	payloadBytes := make([]byte, length, length)
+	copy(payloadBytes, bytes[p:p+int(length)])
+	p += int(length)
+
+	payload := messagePayload{
+		id:    id,
+		flags: payloadFlags(flags),
+		bytes: payloadBytes,
+	}
+
+	return &payload, p, nil
+}
+
+// Returns the encoded length of a single member.
+func memberLength() int {
+	return 9 + ipLen + ipLen
+}
+
+func decodeMembers(memberCount int, bytes []byte) ([]*messageMember, error) {
 	// Bytes 00    Member status byte
 	// Bytes 01-16 Member host IP (01-04 for IPv4)
 	// Bytes 17-18 Member host response port (05-06 for IPv4)
 	// Bytes 19-22 Member heartbeat (07-10 for IPv4)
+	// Bytes 23-38 Source host IP (11-14 for IPv4)
+	// Bytes 39-40 Source host response port (15-16 for IPv4)
 
-	members := make([]*messageMember, 0, 1)
+	if len(bytes) != memberCount*memberLength() {
+		return nil, &DecodeError{Part: "members", Offset: len(bytes), Err: ErrTruncated}
+	}
+
+	// All of the members share a single backing array, so decoding costs two
+	// allocations however many members there are.
+	decoded := make([]messageMember, memberCount)
+	members := make([]*messageMember, 0, memberCount)
 
 	// An index pointer
 	p := 0
 
 	for p < len(bytes) {
-		var mstatus NodeStatus
-		var mip net.IP
-		var mport uint16
-		var mcode uint32
-		var mnode *Node
-		var sip net.IP
-		var sport uint16
-		var snode *Node
+		member := &decoded[len(members)]
 
 		// Byte 00 Member status byte
-		mstatus = NodeStatus(bytes[p])
+		member.status = NodeStatus(bytes[p])
 		p++
 
-		if ipLen == net.IPv6len {
-			// Bytes 01-16 member IP
-			mip = make(net.IP, net.IPv6len)
-			copy(mip, bytes[p:p+16])
-		} else {
-			// Bytes 01-04 member IPv4
-			mip = net.IPv4(bytes[p+0], bytes[p+1], bytes[p+2], bytes[p+3])
-		}
+		// Bytes 01-16 member IP (01-04 for IPv4)
+		mip := net.IP(bytes[p : p+ipLen])
 		p += ipLen
 
 		// Bytes 17-18 member response port
+		var mport uint16
 		mport, p = decodeUint16(bytes, p)
 
 		// Bytes 19-22 member heartbeat
-		mcode, p = decodeUint32(bytes, p)
+		member.heartbeat, p = decodeUint32(bytes, p)
 
-		if len(mip) > 0 {
-			// Find the sender by the address associated with the message
-			mnode = knownNodes.getByIP(mip, mport)
-
-			// We still don't know this node, so create a new one!
-			if mnode == nil {
-				mnode, _ = CreateNodeByIP(mip, mport)
-			}
-		}
+		member.node = decodeNode(mip, mport)
 
-		if ipLen == net.IPv6len {
-			// Bytes 01-16 member IP
-			sip = make(net.IP, net.IPv6len)
-			copy(sip, bytes[p:p+16])
-		} else {
-			// Bytes 01-04 member IPv4
-			sip = net.IPv4(bytes[p+0], bytes[p+1], bytes[p+2], bytes[p+3])
-		}
+		// Source IP
+		sip := net.IP(bytes[p : p+ipLen])
 		p += ipLen
 
-		// Bytes 17-18 member response port
+		// Source response port
+		var sport uint16
 		sport, p = decodeUint16(bytes, p)
 
-		if len(sip) > 0 {
-			// Find the sender by the address associated with the message
-			snode = knownNodes.getByIP(sip, sport)
+		member.source = decodeNode(sip, sport)
 
-			// We still don't know this node, so create a new one!
-			if snode == nil {
-				snode, _ = CreateNodeByIP(sip, sport)
-			}
-		}
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+// Finds the known node with the IP and port, which may be a slice of a
+// receive buffer. Only if the node is unknown is the IP copied and a new
+// node created for it.
+func decodeNode(ip net.IP, port uint16) *Node {
+	node := knownNodes.getByIP(ip, port)
+
+	// We still don't know this node, so create a new one!
+	if node == nil {
+		var nodeIP net.IP
 
-		member := messageMember{
-			heartbeat: mcode,
-			node:      mnode,
-			source:    snode,
-			status:    mstatus,
+		if ipLen == net.IPv6len {
+			nodeIP = make(net.IP, net.IPv6len)
+			copy(nodeIP, ip)
+		} else {
+			nodeIP = net.IPv4(ip[0], ip[1], ip[2], ip[3])
 		}
 
-		members = append(members, &member)
+		node, _ = CreateNodeByIP(nodeIP, port)
 	}
 
-	return members
+	return node
 }
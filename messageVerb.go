@@ -35,8 +35,32 @@ const (
 	// If the ping times out, the host does not follow up with a ping request
 	// to any other hosts.
 	verbNonForwardingPing
+
+	// VerbUserMessage represents a one-way user payload addressed to a single
+	// host. It expects no response.
+	verbUserMessage
+
+	// VerbRequest represents a user payload addressed to a single host that
+	// expects to be answered with a response.
+	verbRequest
+
+	// VerbResponse represents the answer to a previously received request.
+	verbResponse
+
+	// VerbQueryResponse represents an acknowledgement of, or the answer to,
+	// a query received via broadcast. It is sent directly to the query's
+	// origin.
+	verbQueryResponse
 )
 
+// hasPayload returns true if messages with this verb carry a user payload.
+func (v messageVerb) hasPayload() bool {
+	return v == verbUserMessage ||
+		v == verbRequest ||
+		v == verbResponse ||
+		v == verbQueryResponse
+}
+
 func (v messageVerb) String() string {
 	switch v {
 	case verbPing:
@@ -47,6 +71,14 @@ func (v messageVerb) String() string {
 		return "PINGREQ"
 	case verbNonForwardingPing:
 		return "NFPING"
+	case verbUserMessage:
+		return "USER"
+	case verbRequest:
+		return "REQUEST"
+	case verbResponse:
+		return "RESPONSE"
+	case verbQueryResponse:
+		return "QRESPONSE"
 	default:
 		return "UNDEFINED"
 	}
@@ -17,16 +17,19 @@ limitations under the License.
 package smudge
 
 import (
+	"errors"
+	"hash/adler32"
 	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // Identical but distinct instance from node1b
 var node1a = Node{
 	ip:          net.IP([]byte{127, 0, 0, 1}),
 	port:        1234,
-	timestamp:   87878787,
+	timestamp:   time.Unix(87878, 787000000),
 	status:      StatusAlive,
 	emitCounter: 42,
 	pingMillis:  PingNoData}
@@ -35,7 +38,7 @@ var node1a = Node{
 var node1b = Node{
 	ip:          net.IP([]byte{127, 0, 0, 1}),
 	port:        1234,
-	timestamp:   87878787,
+	timestamp:   time.Unix(87878, 787000000),
 	status:      StatusAlive,
 	emitCounter: 42,
 	pingMillis:  PingNoData}
@@ -44,7 +47,7 @@ var node1b = Node{
 var node2 = Node{
 	ip:          net.IP([]byte{127, 0, 0, 1}),
 	port:        10001,
-	timestamp:   GetNowInMillis(),
+	timestamp:   time.Now(),
 	status:      StatusAlive,
 	emitCounter: 42,
 	pingMillis:  PingNoData}
@@ -81,7 +84,7 @@ func TestDeepEqualityFalse(t *testing.T) {
 // Endode and decode a simple message without any members, and see if
 // the input/output match.
 func TestEncodeDecodeBasic(t *testing.T) {
-	timestamp := uint32(87878787)
+	timestamp := time.Unix(87878, 787000000)
 
 	sender := Node{
 		ip:         net.IP([]byte{127, 0, 0, 1}),
@@ -118,7 +121,7 @@ func TestEncodeDecodeBasic(t *testing.T) {
 // Endode and decode a simple IPv6 message without any members, and see if
 // the input/output match.
 func TestEncodeDecodeBasicIPv6(t *testing.T) {
-	timestamp := uint32(87878787)
+	timestamp := time.Unix(87878, 787000000)
 
 	sender := Node{
 		ip:         net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50},
@@ -157,7 +160,7 @@ func TestEncodeDecodeBasicIPv6(t *testing.T) {
 // Endode and decode a simple message with one member, and see if
 // the input/output match.
 func TestEncodeDecode1Member(t *testing.T) {
-	timestamp := uint32(87878787)
+	timestamp := time.Unix(87878, 787000000)
 
 	sender := Node{
 		ip:         net.IP([]byte{127, 0, 0, 1}),
@@ -185,9 +188,9 @@ func TestEncodeDecode1Member(t *testing.T) {
 
 	ip := net.IP([]byte{127, 0, 0, 1})
 	bytes := message.encode()
-	if len(bytes) != 28 {
+	if len(bytes) != 33 {
 		t.Error("Encoded message length is invalid.")
-		t.Log("Should be 28 but found: ", len(bytes))
+		t.Log("Should be 33 but found: ", len(bytes))
 	}
 
 	decoded, err := decodeMessage(ip, bytes)
@@ -221,7 +224,7 @@ func TestEncodeDecode1Member(t *testing.T) {
 // Endode and decode a simple message with one ipv6 member, and see if
 // the input/output match.
 func TestEncodeDecode1MemberIPv6(t *testing.T) {
-	timestamp := uint32(87878787)
+	timestamp := time.Unix(87878, 787000000)
 
 	sender := Node{
 		ip:         net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50},
@@ -250,9 +253,9 @@ func TestEncodeDecode1MemberIPv6(t *testing.T) {
 	ipLen = net.IPv6len // encode for IPv6
 	ip := net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50}
 	bytes := message.encode()
-	if len(bytes) != 52 {
+	if len(bytes) != 57 {
 		t.Error("Encoded message length is invalid.")
-		t.Log("Should be 52 but found: ", len(bytes))
+		t.Log("Should be 57 but found: ", len(bytes))
 	}
 
 	decoded, err := decodeMessage(ip, bytes)
@@ -285,7 +288,7 @@ func TestEncodeDecode1MemberIPv6(t *testing.T) {
 // Endode and decode a simple message with one member and message, and see if
 // the input/output match.
 func TestEncodeDecode1MemberBroadcast(t *testing.T) {
-	timestamp := uint32(87878787)
+	timestamp := time.Unix(87878, 787000000)
 
 	sender := Node{
 		ip:         net.IP([]byte{127, 0, 0, 1}),
@@ -317,9 +320,9 @@ func TestEncodeDecode1MemberBroadcast(t *testing.T) {
 
 	ip := net.IP([]byte{127, 0, 0, 1})
 	bytes := message.encode()
-	if len(bytes) != 57 {
+	if len(bytes) != 63 {
 		t.Error("Encoded message length is invalid.")
-		t.Log("Should be 57 but found: ", len(bytes))
+		t.Log("Should be 63 but found: ", len(bytes))
 	}
 
 	decoded, err := decodeMessage(ip, bytes)
@@ -348,7 +351,7 @@ func TestEncodeDecode1MemberBroadcast(t *testing.T) {
 // Endode and decode a simple message with one ipv6 member and message, and see if
 // the input/output match.
 func TestEncodeDecode1MemberBroadcastIPv6(t *testing.T) {
-	timestamp := uint32(87878787)
+	timestamp := time.Unix(87878, 787000000)
 
 	sender := Node{
 		ip:         net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50},
@@ -381,9 +384,9 @@ func TestEncodeDecode1MemberBroadcastIPv6(t *testing.T) {
 	ipLen = net.IPv6len // encode for IPv6
 	ip := net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50}
 	bytes := message.encode()
-	if len(bytes) != 93 {
+	if len(bytes) != 99 {
 		t.Error("Encoded message length is invalid.")
-		t.Log("Should be 93 but found: ", len(bytes))
+		t.Log("Should be 99 but found: ", len(bytes))
 	}
 
 	decoded, err := decodeMessage(ip, bytes)
@@ -410,3 +413,170 @@ func TestEncodeDecode1MemberBroadcastIPv6(t *testing.T) {
 
 	ipLen = net.IPv4len
 }
+
+// Endode and decode a request message with one member and a user payload,
+// and see if the input/output match.
+func TestEncodeDecodeRequestPayload(t *testing.T) {
+	timestamp := time.Unix(87878, 787000000)
+
+	sender := Node{
+		ip:         net.IP([]byte{127, 0, 0, 1}),
+		port:       1234,
+		timestamp:  timestamp,
+		pingMillis: PingNoData}
+
+	member := Node{
+		ip:         net.IP([]byte{127, 0, 0, 2}).To16(),
+		port:       9000,
+		timestamp:  timestamp,
+		pingMillis: PingNoData}
+
+	message := message{
+		sender:          &sender,
+		senderHeartbeat: 255,
+		verb:            verbRequest}
+	message.addMember(&member, StatusAlive, 38, &member)
+	message.addPayload(42, payloadOK, []byte("This is a request")) //len=17
+
+	ip := net.IP([]byte{127, 0, 0, 1})
+	bytes := message.encode()
+	if len(bytes) != 57 {
+		t.Error("Encoded message length is invalid.")
+		t.Log("Should be 57 but found: ", len(bytes))
+	}
+
+	decoded, err := decodeMessage(ip, bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded.sender.timestamp = timestamp
+	decoded.members[0].node.timestamp = timestamp
+	decoded.members[0].source.timestamp = timestamp
+
+	if !reflect.DeepEqual(message, decoded) {
+		t.Error("Messages do not match")
+
+		t.Log(" Input payload:", message.payload)
+		t.Log("Output payload:", decoded.payload)
+	}
+}
+
+// Decoding members that are already known should cost the same two
+// allocations however many members there are.
+func TestDecodeMembersKnownAllocs(t *testing.T) {
+	ipLen = net.IPv4len
+
+	sender := Node{ip: net.IP([]byte{127, 0, 0, 1}), port: 1234}
+
+	msg := newMessage(verbPing, &sender, 1)
+
+	for i := 0; i < 10; i++ {
+		member := &Node{ip: net.IPv4(10, 0, 0, byte(i)), port: 9000}
+		knownNodes.add(member)
+		defer knownNodes.delete(member)
+
+		msg.addMember(member, StatusAlive, 1, member)
+	}
+
+	bytes := msg.encode()
+	memberBytes := bytes[messageHeaderLength:]
+
+	allocs := testing.AllocsPerRun(100, func() {
+		decodeMembers(10, memberBytes)
+	})
+
+	if allocs != 2 {
+		t.Errorf("Expected 2 allocations, found %v", allocs)
+	}
+}
+
+// Malformed messages must be rejected with a DecodeError rather than panic.
+func TestDecodeMalformed(t *testing.T) {
+	ipLen = net.IPv4len
+
+	sender := Node{ip: net.IP([]byte{127, 0, 0, 1}), port: 1234}
+	member := Node{ip: net.IP([]byte{127, 0, 0, 2}), port: 9000}
+
+	msg := newMessage(verbPing, &sender, 255)
+	msg.addMember(&member, StatusAlive, 38, &member)
+	msg.addBroadcast(&Broadcast{
+		bytes:  []byte("This is a message"),
+		origin: &sender,
+		index:  42})
+
+	// Returns a copy of the encoded message with its checksum corrected
+	// after the modification.
+	modified := func(modify func(bytes []byte) []byte) []byte {
+		bytes := msg.encode()
+		bytes = modify(bytes)
+		encodeUint32(adler32.Checksum(bytes[4:]), bytes, 0)
+		return bytes
+	}
+
+	cases := map[string][]byte{
+		"empty":     {},
+		"short":     {1, 2, 3, 4, 5},
+		"checksum":  append([]byte{0, 0, 0, 0}, msg.encode()[4:]...),
+		"members":   modified(func(b []byte) []byte { b[9] = 3<<3 | byte(verbPing); return b }),
+		"broadcast": modified(func(b []byte) []byte { return b[:len(b)-1] }),
+		"cluster":   modified(func(b []byte) []byte { b[6]++; return b }),
+		"version":   modified(func(b []byte) []byte { b[4]++; return b }),
+	}
+
+	for name, bytes := range cases {
+		_, err := decodeMessage(sender.ip, bytes)
+
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Errorf("%s: expected a DecodeError, found %v", name, err)
+		}
+	}
+
+	_, err := decodeMessage(sender.ip, cases["version"])
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("version: expected ErrVersionMismatch, found %v", err)
+	}
+
+	_, _, err = decodeMulticastAnnounceBytes([]byte{})
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("empty multicast: expected ErrTruncated, found %v", err)
+	}
+}
+
+// A message sent by a member of a differently-named cluster must be rejected,
+// even though it's otherwise intact.
+func TestDecodeClusterMismatch(t *testing.T) {
+	ipLen = net.IPv4len
+
+	defer SetClusterName(GetClusterName())
+
+	sender := Node{ip: net.IP([]byte{127, 0, 0, 1}), port: 1234}
+
+	SetClusterName("alpha")
+	msg := newMessage(verbPing, &sender, 255)
+	bytes := msg.encode()
+
+	_, err := decodeMessage(sender.ip, bytes)
+	if err != nil {
+		t.Fatalf("Same cluster: unexpected error %v", err)
+	}
+
+	SetClusterName("beta")
+
+	_, err = decodeMessage(sender.ip, bytes)
+	if !errors.Is(err, ErrClusterMismatch) {
+		t.Errorf("Other cluster: expected ErrClusterMismatch, found %v", err)
+	}
+}
+
+// A PINGREQ that doesn't name a node to forward to is rejected rather than
+// indexing into its empty member list.
+func TestReceiveEmptyPingRequest(t *testing.T) {
+	sender := Node{ip: net.IP([]byte{127, 0, 0, 1}), port: 1234}
+	msg := newMessage(verbPingRequest, &sender, 1)
+
+	if err := receiveVerbForwardUDP(msg); err == nil {
+		t.Error("Expected an error for a PINGREQ without members")
+	}
+}
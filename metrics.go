@@ -0,0 +1,83 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import "sync/atomic"
+
+// The live counters. These are only ever accessed atomically; being at the
+// start of a global variable keeps them 64-bit aligned on 32-bit platforms.
+var metrics struct {
+	packetsReceived     uint64
+	packetsDropped      uint64
+	clusterMismatches   uint64
+	versionMismatches   uint64
+	packetsForbidden    uint64
+	packetsLimited      uint64
+	membersRejected     uint64
+	handlerCallsDropped uint64
+}
+
+// Metrics is a snapshot of the counters that Smudge maintains about its own
+// operation, as returned by GetMetrics().
+type Metrics struct {
+	// PacketsReceived is the number of UDP packets read from the sockets.
+	PacketsReceived uint64
+
+	// PacketsDropped is the number of received packets discarded without
+	// being processed because the receive queue was full.
+	PacketsDropped uint64
+
+	// ClusterMismatches is the number of received packets rejected because
+	// they were sent by a member of a differently-named cluster.
+	ClusterMismatches uint64
+
+	// VersionMismatches is the number of received packets rejected because
+	// they were sent using a different version of the wire protocol.
+	VersionMismatches uint64
+
+	// PacketsForbidden is the number of received packets dropped because
+	// their sources are banned, blocked, or outside the allowed networks.
+	PacketsForbidden uint64
+
+	// PacketsRateLimited is the number of received packets dropped because
+	// their sources exceeded the source rate limit.
+	PacketsRateLimited uint64
+
+	// MembersRejected is the number of times a member learned of from
+	// another member was ignored, because the member limit or the new member
+	// limit had been reached.
+	MembersRejected uint64
+
+	// HandlerCallsDropped is the number of messages, requests, queries and
+	// broadcasts not passed to the user's handlers and listeners, because
+	// too many calls to them were already waiting.
+	HandlerCallsDropped uint64
+}
+
+// GetMetrics returns a snapshot of the current values of Smudge's counters.
+func GetMetrics() Metrics {
+	return Metrics{
+		PacketsReceived:     atomic.LoadUint64(&metrics.packetsReceived),
+		PacketsDropped:      atomic.LoadUint64(&metrics.packetsDropped),
+		ClusterMismatches:   atomic.LoadUint64(&metrics.clusterMismatches),
+		VersionMismatches:   atomic.LoadUint64(&metrics.versionMismatches),
+		PacketsForbidden:    atomic.LoadUint64(&metrics.packetsForbidden),
+		PacketsRateLimited:  atomic.LoadUint64(&metrics.packetsLimited),
+		MembersRejected:     atomic.LoadUint64(&metrics.membersRejected),
+		HandlerCallsDropped: atomic.LoadUint64(&metrics.handlerCallsDropped),
+	}
+}
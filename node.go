@@ -19,6 +19,7 @@ package smudge
 import (
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -32,41 +33,132 @@ const (
 	PingTimedOut int = -2
 )
 
-// Node represents a single node in the cluster and its status
+// Node represents a single node in the cluster and its status. Its state is
+// updated by the protocol as it runs, so it's guarded by a lock; use Info()
+// to take a consistent snapshot of it.
 type Node struct {
-	ip           net.IP
-	port         uint16
-	timestamp    uint32
-	address      string
+	ip      net.IP
+	port    uint16
+	address string
+
+	addressOnce sync.Once
+
+	lock         sync.RWMutex
+	timestamp    time.Time
 	pingMillis   int
 	status       NodeStatus
 	emitCounter  int8
 	heartbeat    uint32
 	statusSource *Node
+	statusCause  StatusCause
+	rtt          rttEstimator
+}
+
+// NodeInfo is an immutable snapshot of a node's state, as returned by
+// AllNodes(), HealthyNodes() and Node.Info(), and delivered in events.
+type NodeInfo struct {
+	// Address is the node's address, as returned by Node.Address(). The
+	// node itself can be looked up with LookupNode().
+	Address string
+
+	// IP is the node's IP.
+	IP net.IP
+
+	// Port is the node's listen port.
+	Port uint16
+
+	// Status is the node's status.
+	Status NodeStatus
+
+	// StatusSource is the address of the node that originally stated the
+	// status; the source of the gossip. Empty if unknown.
+	StatusSource string
+
+	// StatusCause records why the status last changed.
+	StatusCause StatusCause
+
+	// Heartbeat is the heartbeat associated with the status.
+	Heartbeat uint32
+
+	// PingMillis is the node's last ping time, as returned by
+	// Node.PingMillis().
+	PingMillis int
+
+	// EmitCounter is the number of times remaining that the status will be
+	// emitted to other nodes.
+	EmitCounter int8
+
+	// RTT describes the round-trip times of the direct pings to the node.
+	RTT RTTStats
+
+	// Timestamp is the local time of the node's last ping or status update.
+	Timestamp time.Time
 }
 
 // Address rReturns the address for this node in string format, which is simply
 // the node's local IP and listen port. This is used as a unique identifier
 // throughout the code base.
 func (n *Node) Address() string {
-	if n.address == "" {
-		n.address = nodeAddressString(n.ip, n.port)
-	}
+	n.addressOnce.Do(func() {
+		if n.address == "" {
+			n.address = nodeAddressString(n.ip, n.port)
+		}
+	})
 
 	return n.address
 }
 
-// Age returns the time since we last heard from this node, in milliseconds.
-func (n *Node) Age() uint32 {
-	return GetNowInMillis() - n.timestamp
+// Age returns the time since we last heard from this node.
+func (n *Node) Age() time.Duration {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return time.Since(n.timestamp)
 }
 
 // EmitCounter returns the number of times remaining that current status
 // will be emitted by this node to other nodes.
 func (n *Node) EmitCounter() int8 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.emitCounter
 }
 
+// Heartbeat returns the heartbeat associated with this node's current
+// status.
+func (n *Node) Heartbeat() uint32 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.heartbeat
+}
+
+// Info returns a snapshot of this node's current state.
+func (n *Node) Info() NodeInfo {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	info := NodeInfo{
+		Address:     n.Address(),
+		IP:          n.ip,
+		Port:        n.port,
+		Status:      n.status,
+		StatusCause: n.statusCause,
+		Heartbeat:   n.heartbeat,
+		PingMillis:  n.pingMillis,
+		EmitCounter: n.emitCounter,
+		RTT:         n.rtt.stats(),
+		Timestamp:   n.timestamp,
+	}
+
+	if n.statusSource != nil {
+		info.StatusSource = n.statusSource.Address()
+	}
+
+	return info
+}
+
 // IP returns the IP associated with this node.
 func (n *Node) IP() net.IP {
 	return n.ip
@@ -77,6 +169,9 @@ func (n *Node) IP() net.IP {
 // pinged, this vaue will be PingNoData (-1). If this node's last PING timed
 // out, this value will be PingTimedOut (-2).
 func (n *Node) PingMillis() int {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.pingMillis
 }
 
@@ -85,26 +180,109 @@ func (n *Node) Port() uint16 {
 	return n.port
 }
 
+// RTTStats returns the statistics of the round-trip times of the direct
+// pings to this node, from which its probe timeouts are derived.
+func (n *Node) RTTStats() RTTStats {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.rtt.stats()
+}
+
 // Status returns this node's current status.
 func (n *Node) Status() NodeStatus {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.status
 }
 
+// StatusCause returns the record of why this node's status last changed, and
+// the evidence behind the change.
+func (n *Node) StatusCause() StatusCause {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.statusCause
+}
+
 // StatusSource returns a pointer to the node that originally stated this
 // node's Status; the source of the gossip.
 func (n *Node) StatusSource() *Node {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.statusSource
 }
 
-// Timestamp returns the timestamp of this node's last ping or status update,
-// in milliseconds from the epoch
-func (n *Node) Timestamp() uint32 {
+// Timestamp returns the local time of this node's last ping or status update.
+// It carries a monotonic clock reading, so durations measured from it aren't
+// affected by changes to the wall clock.
+func (n *Node) Timestamp() time.Time {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.timestamp
 }
 
-// Touch updates the timestamp to the local time in milliseconds.
+// Touch updates the timestamp to the current local time.
 func (n *Node) Touch() {
-	n.timestamp = GetNowInMillis()
+	n.lock.Lock()
+	n.timestamp = time.Now()
+	n.lock.Unlock()
+}
+
+// Returns the status, heartbeat and status source to be gossiped about this
+// node, consistent with one another.
+func (n *Node) gossip() (NodeStatus, uint32, *Node) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.status, n.heartbeat, n.statusSource
+}
+
+// Decrements the number of times remaining that the current status will be
+// emitted.
+func (n *Node) decrementEmitCounter() {
+	n.lock.Lock()
+	n.emitCounter--
+	n.lock.Unlock()
+}
+
+// Sets the number of times remaining that the current status will be
+// emitted.
+func (n *Node) setEmitCounter(count int8) {
+	n.lock.Lock()
+	n.emitCounter = count
+	n.lock.Unlock()
+}
+
+func (n *Node) addRTTSample(millis uint32) {
+	n.lock.Lock()
+	n.rtt.add(float64(millis))
+	n.lock.Unlock()
+}
+
+func (n *Node) rttNSigma(sigmas float64) (float64, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.rtt.nSigma(sigmas)
+}
+
+func (n *Node) setPingMillis(millis int) {
+	n.lock.Lock()
+	n.pingMillis = millis
+	n.lock.Unlock()
+}
+
+// Returns a snapshot of the node, or an empty NodeInfo if it's nil.
+func infoOf(n *Node) NodeInfo {
+	if n == nil {
+		return NodeInfo{}
+	}
+
+	return n.Info()
 }
 
 func nodeAddressString(ip net.IP, port uint16) string {
@@ -115,7 +293,10 @@ func nodeAddressString(ip net.IP, port uint16) string {
 }
 
 // GetNowInMillis returns the current local time in milliseconds since the
-// epoch.
+// epoch, truncated to 32 bits.
+//
+// Deprecated: the value wraps about every 49.7 days, so differences between
+// values can't be relied upon. Use time.Now() and time.Since() instead.
 func GetNowInMillis() uint32 {
 	return uint32(time.Now().UnixNano() / int64(time.Millisecond))
 }
@@ -26,10 +26,51 @@ type nodeMap struct {
 	sync.RWMutex
 
 	nodes map[string]*Node
+
+	// A secondary index on the raw IP and port, so that nodes can be found
+	// while decoding messages without building an address string.
+	byIP map[nodeKey]*Node
+
+	// The nodes in no particular order, so that they can be sampled at
+	// random, and each node's position in the list.
+	list      []*Node
+	positions map[string]int
+
+	// The number of nodes with each status, and the status that each node
+	// is counted under.
+	counts  map[NodeStatus]int
+	counted map[string]NodeStatus
+}
+
+// nodeKey is a node's IP, in 16-byte form, followed by its port.
+type nodeKey [net.IPv6len + 2]byte
+
+// Builds the key for an IP and port. This doesn't allocate, so ip can be a
+// slice of a receive buffer.
+func makeNodeKey(ip net.IP, port uint16) nodeKey {
+	var key nodeKey
+
+	if len(ip) == net.IPv4len {
+		// The IPv4-mapped form used by net.IPv4()
+		key[10] = 0xff
+		key[11] = 0xff
+		copy(key[12:16], ip)
+	} else {
+		copy(key[0:16], ip)
+	}
+
+	key[16] = byte(port)
+	key[17] = byte(port >> 8)
+
+	return key
 }
 
 func (m *nodeMap) init() {
 	m.nodes = make(map[string]*Node)
+	m.byIP = make(map[nodeKey]*Node)
+	m.positions = make(map[string]int)
+	m.counts = make(map[NodeStatus]int)
+	m.counted = make(map[string]NodeStatus)
 }
 
 // Adds a node. Returns key, value.
@@ -39,22 +80,101 @@ func (m *nodeMap) add(node *Node) (string, *Node, error) {
 	key := node.Address()
 
 	m.Lock()
-	m.nodes[node.Address()] = node
+	m.addLocked(node)
 	m.Unlock()
 
 	return key, node, nil
 }
 
-func (m *nodeMap) delete(node *Node) (string, *Node, error) {
+// Adds a node, unless a node with the same address is already present.
+// Returns true if the node was added.
+func (m *nodeMap) addIfAbsent(node *Node) bool {
 	m.Lock()
+	defer m.Unlock()
 
-	delete(m.nodes, node.Address())
+	if _, ok := m.nodes[node.Address()]; ok {
+		return false
+	}
 
-	m.Unlock()
+	m.addLocked(node)
+
+	return true
+}
+
+func (m *nodeMap) addLocked(node *Node) {
+	key := node.Address()
+
+	if _, ok := m.nodes[key]; ok {
+		m.counts[m.counted[key]]--
+		m.list[m.positions[key]] = node
+	} else {
+		m.positions[key] = len(m.list)
+		m.list = append(m.list, node)
+	}
+
+	status := node.Status()
+
+	m.nodes[key] = node
+	m.byIP[makeNodeKey(node.ip, node.port)] = node
+	m.counts[status]++
+	m.counted[key] = status
+}
+
+func (m *nodeMap) delete(node *Node) (string, *Node, error) {
+	m.deleteIfPresent(node)
 
 	return node.Address(), node, nil
 }
 
+// Deletes a node, if a node with the same address is present. Returns true
+// if a node was deleted.
+func (m *nodeMap) deleteIfPresent(node *Node) bool {
+	key := node.Address()
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.nodes[key]; !ok {
+		return false
+	}
+
+	// Move the last node in the list into the gap.
+	i := m.positions[key]
+	last := m.list[len(m.list)-1]
+	m.list[i] = last
+	m.positions[last.Address()] = i
+	m.list[len(m.list)-1] = nil
+	m.list = m.list[:len(m.list)-1]
+
+	m.counts[m.counted[key]]--
+
+	delete(m.positions, key)
+	delete(m.nodes, key)
+	delete(m.byIP, makeNodeKey(node.ip, node.port))
+	delete(m.counted, key)
+
+	return true
+}
+
+// Called when the status of a node changes, to keep the status counts
+// current. This has no effect if the node isn't in the map.
+func (m *nodeMap) statusChanged(node *Node) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := node.Address()
+
+	if m.nodes[key] != node {
+		return
+	}
+
+	status := node.Status()
+
+	m.counts[m.counted[key]]--
+	m.counts[status]++
+	m.counted[key] = status
+}
+
 func (m *nodeMap) contains(node *Node) bool {
 	return m.containsByAddress(node.Address())
 }
@@ -79,77 +199,96 @@ func (m *nodeMap) getByAddress(address string) *Node {
 }
 
 // Returns a pointer to the requested Node. If port is 0, is uses the value
-// of GetListenPort(). If the Node cannot be found, this returns nil.
+// of GetListenPort(). If the Node cannot be found, this returns nil. This
+// doesn't allocate, and doesn't retain ip.
 func (m *nodeMap) getByIP(ip net.IP, port uint16) *Node {
 	if port == 0 {
 		port = uint16(GetListenPort())
 	}
 
-	address := nodeAddressString(ip, port)
+	key := makeNodeKey(ip, port)
 
-	return m.getByAddress(address)
+	m.RLock()
+	node := m.byIP[key]
+	m.RUnlock()
+
+	return node
 }
 
 // Returns a slice of Node[] of from 0 to len(nodes) nodes.
 // If size is < len(nodes), that many nodes are randomly chosen and
 // returned.
 func (m *nodeMap) getRandomNodes(size int, exclude ...*Node) []*Node {
-	allNodes := m.values()
+	return m.sample(size, func(n *Node) bool {
+		return !isExcluded(n, exclude)
+	})
+}
 
-	if size == 0 {
-		size = len(allNodes)
+// Returns up to size randomly chosen nodes for which accept returns true, or
+// all such nodes (in random order) if size is 0. This is a Fisher-Yates
+// shuffle that stops once enough nodes have been accepted, and that records
+// its swaps in a map rather than copying the list, so its cost depends on
+// the number of nodes drawn rather than the number in the map.
+func (m *nodeMap) sample(size int, accept func(*Node) bool) []*Node {
+	m.RLock()
+	defer m.RUnlock()
+
+	n := len(m.list)
+
+	if size <= 0 || size > n {
+		size = n
 	}
 
-	// First, shuffle the allNodes slice
-	for i := range allNodes {
-		j := rand.Intn(i + 1)
-		allNodes[i], allNodes[j] = allNodes[j], allNodes[i]
+	sampled := make([]*Node, 0, size)
+
+	// The index that each swapped position now holds.
+	swapped := make(map[int]int)
+
+	lookup := func(i int) int {
+		if j, ok := swapped[i]; ok {
+			return j
+		}
+		return i
 	}
 
-	// Copy the first size nodes that are not otherwise excluded
-	filtered := make([]*Node, 0, len(allNodes))
+	for i := 0; i < n && len(sampled) < size; i++ {
+		j := i + rand.Intn(n-i)
 
-	// Horribly inefficient. Fix this later.
+		chosen := lookup(j)
+		swapped[j] = lookup(i)
 
-	var c int
-Outer:
-	for _, n := range allNodes {
-		// Is the node in the excluded list?
-		for _, e := range exclude {
-			if n.Address() == e.Address() {
-				continue Outer
-			}
+		node := m.list[chosen]
+		if accept(node) {
+			sampled = append(sampled, node)
 		}
+	}
 
-		// Now we can append it
-		filtered = append(filtered, n)
-		c++
+	return sampled
+}
 
-		if c >= size {
-			break Outer
+// Returns true if the node has the same address as any of the exclusions.
+func isExcluded(node *Node, exclude []*Node) bool {
+	for _, e := range exclude {
+		if node.Address() == e.Address() {
+			return true
 		}
 	}
 
-	return filtered
+	return false
 }
 
 func (m *nodeMap) length() int {
+	m.RLock()
+	defer m.RUnlock()
+
 	return len(m.nodes)
 }
 
 func (m *nodeMap) lengthWithStatus(status NodeStatus) int {
 	m.RLock()
+	defer m.RUnlock()
 
-	i := 0
-	for _, v := range m.nodes {
-		if v.status == status {
-			i++
-		}
-	}
-
-	m.RUnlock()
-
-	return i
+	return m.counts[status]
 }
 
 func (m *nodeMap) keys() []string {
@@ -171,13 +310,8 @@ func (m *nodeMap) keys() []string {
 func (m *nodeMap) values() []*Node {
 	m.RLock()
 
-	values := make([]*Node, len(m.nodes))
-
-	i := 0
-	for _, v := range m.nodes {
-		values[i] = v
-		i++
-	}
+	values := make([]*Node, len(m.list))
+	copy(values, m.list)
 
 	m.RUnlock()
 
@@ -0,0 +1,244 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"sync"
+	"time"
+)
+
+// How often this member checks whether it's time to redial the members lost
+// to a suspected partition.
+const partitionCheckInterval = time.Second
+
+// The fewest deaths within the partition window that can suggest a
+// partition. A single death never does.
+const partitionMinDeaths = 2
+
+// The state of partition detection. When enough of the members die within
+// the partition window, they're taken to have been split from this member
+// rather than to have failed independently. Each is redialed with
+// exponential backoff until it's heard from again or the redial timeout
+// passes, as are any others that die in the meantime. The first to return
+// shows that the partition has healed, and emits an EventMerged. For a
+// window after a merge, while each side refutes the deaths that the other
+// reports, deaths aren't counted.
+var partition = struct {
+	sync.Mutex
+
+	// The members that have died within the partition window, in the order
+	// in which they died.
+	deaths []partitionDeath
+
+	suspected bool
+	started   time.Time
+	merged    time.Time
+
+	// Whether a lost member has returned since the partition was suspected.
+	healed bool
+
+	// The members lost to the suspected partition, keyed on their addresses.
+	lost map[string]*Node
+
+	attempts   int
+	nextRedial time.Time
+}{}
+
+type partitionDeath struct {
+	node *Node
+	time time.Time
+}
+
+// Redials the members lost to a suspected partition, once per partition
+// check interval, when it's due.
+func startPartitionRedialLoop() {
+	for {
+		time.Sleep(partitionCheckInterval)
+
+		for _, node := range checkPartition(time.Now()) {
+			redial(node)
+		}
+	}
+}
+
+// Called by updateNodeStatus() when a member's status changes. A death may
+// complete the evidence of a partition, in which case an
+// EventPartitionSuspected is emitted; the return of a member that was lost
+// to one stops it being redialed, and the first such return emits an
+// EventMerged.
+func notePartitionStatus(node *Node, previous, status NodeStatus) {
+	if thisHost == nil || node.Address() == thisHostAddress {
+		return
+	}
+
+	threshold := GetPartitionThreshold()
+	window := time.Duration(GetPartitionWindowSeconds()) * time.Second
+	now := time.Now()
+
+	switch {
+	case status == StatusDead && previous != StatusDead:
+		if threshold == 0 {
+			return
+		}
+
+		// The members, other than this one, that are still alive. Counted
+		// from the registry's totals, as deaths can come all at once.
+		live := knownNodes.length() - knownNodes.lengthWithStatus(StatusDead)
+		if knownNodes.contains(thisHost) {
+			live--
+		}
+
+		partition.Lock()
+
+		if partition.suspected {
+			partition.lost[node.Address()] = node
+			partition.Unlock()
+			return
+		}
+
+		if now.Sub(partition.merged) < window {
+			partition.Unlock()
+			return
+		}
+
+		deaths := partition.deaths[:0]
+		for _, d := range partition.deaths {
+			if now.Sub(d.time) < window && d.node.Address() != node.Address() {
+				deaths = append(deaths, d)
+			}
+		}
+
+		partition.deaths = append(deaths, partitionDeath{node: node, time: now})
+
+		count := len(partition.deaths)
+		if count < partitionMinDeaths || float64(count) < threshold*float64(live+count) {
+			partition.Unlock()
+			return
+		}
+
+		partition.suspected = true
+		partition.healed = false
+		partition.started = now
+		partition.attempts = 0
+		partition.nextRedial = now.Add(reseedBackoff(1))
+		partition.lost = make(map[string]*Node, count)
+
+		for _, d := range partition.deaths {
+			partition.lost[d.node.Address()] = d.node
+		}
+
+		partition.deaths = nil
+
+		partition.Unlock()
+
+		logfWarn("Partition suspected: %d of %d members died within %v", count, live+count, window)
+
+		emitEvent(EventPartitionSuspected, thisHost, thisHost.Status(), thisHost)
+
+	case status == StatusAlive:
+		partition.Lock()
+
+		if !partition.suspected && len(partition.deaths) == 0 {
+			partition.Unlock()
+			return
+		}
+
+		for i, d := range partition.deaths {
+			if d.node.Address() == node.Address() {
+				partition.deaths = append(partition.deaths[:i], partition.deaths[i+1:]...)
+				break
+			}
+		}
+
+		lost := partition.suspected && partition.lost[node.Address()] != nil
+		if !lost {
+			partition.Unlock()
+			return
+		}
+
+		delete(partition.lost, node.Address())
+		remaining := len(partition.lost)
+
+		merged := !partition.healed
+		if merged {
+			partition.healed = true
+			partition.merged = now
+		}
+
+		if remaining == 0 {
+			partition.suspected = false
+			partition.lost = nil
+		}
+
+		partition.Unlock()
+
+		if merged {
+			logfInfo("Partition healed: %s is reachable again (%d still lost)", node.Address(), remaining)
+
+			emitEvent(EventMerged, node, previous, thisHost)
+		} else {
+			logfDebug("%s is reachable again (%d still lost)", node.Address(), remaining)
+		}
+	}
+}
+
+// Returns the members lost to a suspected partition if it's time to redial
+// them, or nil. Once the redial timeout has passed since the partition was
+// suspected, they're given up on.
+func checkPartition(now time.Time) []*Node {
+	timeout := time.Duration(GetPartitionRedialTimeoutSeconds()) * time.Second
+
+	partition.Lock()
+	defer partition.Unlock()
+
+	if !partition.suspected {
+		return nil
+	}
+
+	if now.Sub(partition.started) >= timeout {
+		logfInfo("Giving up on redialing %d members lost to a partition", len(partition.lost))
+
+		partition.suspected = false
+		partition.lost = nil
+
+		return nil
+	}
+
+	if now.Before(partition.nextRedial) {
+		return nil
+	}
+
+	partition.attempts++
+	partition.nextRedial = now.Add(reseedBackoff(partition.attempts + 1))
+
+	nodes := make([]*Node, 0, len(partition.lost))
+	for _, n := range partition.lost {
+		nodes = append(nodes, n)
+	}
+
+	return nodes
+}
+
+// Pings a member lost to a partition, whether or not it's still known. No
+// ack is expected: if it's reachable, its reply adds it back to the known
+// nodes, and its ping adds this member back to its own.
+func redial(node *Node) {
+	err := transmitVerbGenericUDP(node, nil, verbPing, currentHeartbeat())
+	if err != nil {
+		logDebug("Failure to redial", node.Address(), "->", err)
+	}
+}
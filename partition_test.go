@@ -0,0 +1,100 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"testing"
+	"time"
+)
+
+// Enough members dying at once must be taken as a partition, and the return
+// of any of them as its healing. The rest must be redialed until they return
+// too.
+func TestPartitionDetection(t *testing.T) {
+	defer SetPartitionThreshold(GetPartitionThreshold())
+	SetPartitionThreshold(0.3)
+
+	nodes, cleanup := populateRegistry(10)
+	defer cleanup()
+
+	reset := func() {
+		partition.Lock()
+		partition.deaths, partition.suspected, partition.lost = nil, false, nil
+		partition.merged = time.Time{}
+		partition.Unlock()
+	}
+
+	reset()
+	defer reset()
+
+	sub := Events()
+	defer sub.Unsubscribe()
+
+	cause := newStatusCause(ReasonPingTimeout)
+
+	// A member that dies and recovers isn't evidence of a partition.
+	updateNodeStatus(nodes[9], StatusDead, nodes[9].Heartbeat(), thisHost, cause)
+	updateNodeStatus(nodes[9], StatusAlive, nodes[9].Heartbeat(), thisHost, cause)
+
+	for _, n := range nodes[:2] {
+		updateNodeStatus(n, StatusDead, n.Heartbeat(), thisHost, cause)
+	}
+
+	if checkPartition(time.Now().Add(time.Hour)) != nil {
+		t.Fatal("Expected 2 deaths of 10 members not to suggest a partition")
+	}
+
+	updateNodeStatus(nodes[2], StatusDead, nodes[2].Heartbeat(), thisHost, cause)
+
+	waitForEvent(t, sub, EventPartitionSuspected)
+
+	if lost := checkPartition(time.Now()); lost != nil {
+		t.Errorf("Expected the lost members not to be redialed at once, found %d", len(lost))
+	}
+
+	if lost := checkPartition(time.Now().Add(time.Minute)); len(lost) != 3 {
+		t.Errorf("Expected 3 lost members to be redialed, found %d", len(lost))
+	}
+
+	updateNodeStatus(nodes[1], StatusAlive, nodes[1].Heartbeat()+1, thisHost, cause)
+
+	e := waitForEvent(t, sub, EventMerged)
+	if e.Node.Address != nodes[1].Address() {
+		t.Errorf("Expected the merge to be reported by %s, found %s", nodes[1].Address(), e.Node.Address)
+	}
+
+	if lost := checkPartition(time.Now().Add(2 * time.Minute)); len(lost) != 2 {
+		t.Errorf("Expected the 2 members still lost to be redialed, found %d", len(lost))
+	}
+
+	for _, n := range []*Node{nodes[0], nodes[2]} {
+		updateNodeStatus(n, StatusAlive, n.Heartbeat()+1, thisHost, cause)
+	}
+
+	if checkPartition(time.Now().Add(3*time.Minute)) != nil {
+		t.Error("Expected no redialing once every lost member has returned")
+	}
+
+	// Deaths reported as the sides reconcile mustn't suggest another.
+	for _, n := range nodes[3:6] {
+		updateNodeStatus(n, StatusDead, n.Heartbeat(), thisHost, cause)
+	}
+
+	if checkPartition(time.Now().Add(time.Hour)) != nil {
+		t.Error("Expected deaths just after a merge not to suggest a partition")
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"container/heap"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pending acknowledgements, keyed on node address and heartbeat code, and
+// ordered by deadline in a min-heap so that each times out exactly when it's
+// due. Acknowledged probes are removed from the map and flagged as
+// cancelled, but are left in the heap until they reach its top; that way
+// cancellation is O(1).
+var pendingAcks = struct {
+	sync.Mutex
+	m     map[string]*pendingAck
+	queue ackQueue
+}{m: make(map[string]*pendingAck)}
+
+// Signalled when a pending ack is scheduled ahead of all of the others, so
+// that the timeout loop can bring its wake-up forward.
+var pendingAcksRescheduled = make(chan struct{}, 1)
+
+// pendingAck represents an expectation of a response to a previously
+// emitted PING, PINGREQ, or NFP.
+type pendingAck struct {
+	startTime    time.Time
+	node         *Node
+	callback     *Node
+	callbackCode uint32
+	packType     pendingAckType
+	relays       []string
+
+	key           string
+	deadline      time.Time
+	timeoutMillis uint32
+	cancelled     bool
+}
+
+func (a *pendingAck) elapsed() time.Duration {
+	return time.Since(a.startTime)
+}
+
+// pendingAckType represents the type of PING that a pendingAckType is waiting
+// for a response for: PING, PINGREQ, or NFP.
+type pendingAckType byte
+
+const (
+	packPing pendingAckType = iota
+	packPingReq
+	packNFP
+)
+
+func (p pendingAckType) String() string {
+	switch p {
+	case packPing:
+		return "PING"
+	case packPingReq:
+		return "PINGREQ"
+	case packNFP:
+		return "NFP"
+	default:
+		return "UNDEFINED"
+	}
+}
+
+// ackQueue implements heap.Interface for []*pendingAck based on the
+// deadline field.
+type ackQueue []*pendingAck
+
+func (q ackQueue) Len() int {
+	return len(q)
+}
+
+func (q ackQueue) Less(i, j int) bool {
+	return q[i].deadline.Before(q[j].deadline)
+}
+
+func (q ackQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *ackQueue) Push(x interface{}) {
+	*q = append(*q, x.(*pendingAck))
+}
+
+func (q *ackQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	pack := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+
+	return pack
+}
+
+// Returns the key under which an ack from the node with the heartbeat code
+// is expected.
+func pendingAckKey(node *Node, code uint32) string {
+	return node.Address() + ":" + strconv.FormatInt(int64(code), 10)
+}
+
+// Returns how long to wait for an ack, as decided by the failure detector
+// for the nodes involved.
+func ackTimeoutMillis(pack *pendingAck) uint32 {
+	detector := getFailureDetector()
+
+	timeout := detector.AckTimeout(pack.node)
+
+	// Ping requests are expected to take quite a bit longer: the round trip
+	// to the relay, plus the relay's round trip to the target. Call the
+	// latter the same as ours, and scale the average of the two by the
+	// configured multiplier.
+	if pack.packType == packPingReq {
+		average := (timeout + detector.AckTimeout(pack.callback)) / 2
+		timeout = time.Duration(float64(average) * GetPingRequestTimeoutMultiplier())
+	}
+
+	return uint32(timeout / time.Millisecond)
+}
+
+// Records that an ack is expected from the node with the heartbeat code, and
+// schedules its timeout from the ack's start time. Any ack already expected
+// under the same key is replaced.
+func addPendingAck(pack *pendingAck, code uint32) {
+	timeoutMillis := ackTimeoutMillis(pack)
+
+	if pack.startTime.IsZero() {
+		pack.startTime = time.Now()
+	}
+
+	schedulePendingAck(pack, pendingAckKey(pack.node, code),
+		pack.startTime, timeoutMillis)
+}
+
+func schedulePendingAck(pack *pendingAck, key string, now time.Time, timeoutMillis uint32) {
+	pack.key = key
+	pack.timeoutMillis = timeoutMillis
+	pack.deadline = now.Add(time.Duration(timeoutMillis) * time.Millisecond)
+
+	pendingAcks.Lock()
+
+	if old, ok := pendingAcks.m[key]; ok && old != pack {
+		old.cancelled = true
+	}
+
+	pendingAcks.m[key] = pack
+	heap.Push(&pendingAcks.queue, pack)
+
+	earliest := pendingAcks.queue[0] == pack
+
+	pendingAcks.Unlock()
+
+	if earliest {
+		select {
+		case pendingAcksRescheduled <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Removes and returns the ack expected under the key, cancelling its
+// timeout, or returns nil if there is none.
+func cancelPendingAck(key string) *pendingAck {
+	pendingAcks.Lock()
+	defer pendingAcks.Unlock()
+
+	pack, ok := pendingAcks.m[key]
+	if !ok {
+		return nil
+	}
+
+	delete(pendingAcks.m, key)
+	pack.cancelled = true
+
+	return pack
+}
+
+// Removes and returns the pending acks whose deadlines have passed, along with
+// the deadline of the next one due (which is zero if there are none).
+func expirePendingAcks(now time.Time) ([]*pendingAck, time.Time) {
+	var expired []*pendingAck
+
+	pendingAcks.Lock()
+	defer pendingAcks.Unlock()
+
+	for len(pendingAcks.queue) > 0 {
+		pack := pendingAcks.queue[0]
+
+		if !pack.cancelled && pack.deadline.After(now) {
+			return expired, pack.deadline
+		}
+
+		heap.Pop(&pendingAcks.queue)
+
+		if !pack.cancelled {
+			delete(pendingAcks.m, pack.key)
+			expired = append(expired, pack)
+		}
+	}
+
+	return expired, time.Time{}
+}
+
+// Times out each pending ack as its deadline passes.
+func startTimeoutCheckLoop() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		expired, next := expirePendingAcks(time.Now())
+
+		for _, pack := range expired {
+			timeoutPendingAck(pack)
+		}
+
+		if next.IsZero() {
+			<-pendingAcksRescheduled
+			continue
+		}
+
+		timer.Reset(time.Until(next))
+
+		select {
+		case <-timer.C:
+		case <-pendingAcksRescheduled:
+			// A stale expiry left in the channel would only cause an early
+			// (and harmless) pass through the loop.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Called when a pending ack has taken longer than expected.
+func timeoutPendingAck(pack *pendingAck) {
+	if stillAccruing(pack) {
+		return
+	}
+
+	timeoutMillis := pack.timeoutMillis
+
+	switch pack.packType {
+	case packPing:
+		go doForwardOnTimeout(pack, timeoutMillis)
+	case packPingReq:
+		logDebug(pack.key, "timed out after", timeoutMillis, "milliseconds (dropped PINGREQ)")
+
+		if knownNodes.contains(pack.callback) {
+			cause := newTimeoutCause(ReasonPingRequestTimeout, pack.packType, timeoutMillis)
+			cause.Relays = pack.relays
+
+			switch pack.callback.Status() {
+			case StatusDead:
+				break
+			case StatusSuspected:
+				updateNodeStatus(pack.callback, StatusDead, currentHeartbeat(), thisHost, cause)
+				pack.callback.setPingMillis(PingTimedOut)
+			default:
+				updateNodeStatus(pack.callback, StatusSuspected, currentHeartbeat(), thisHost, cause)
+				pack.callback.setPingMillis(PingTimedOut)
+			}
+		}
+	case packNFP:
+		logDebug(pack.key, "timed out after", timeoutMillis, "milliseconds (dropped NFP)")
+
+		if knownNodes.contains(pack.node) {
+			cause := newTimeoutCause(ReasonNFPTimeout, pack.packType, timeoutMillis)
+			cause.Requester = pack.callback.Address()
+
+			switch pack.node.Status() {
+			case StatusDead:
+				break
+			case StatusSuspected:
+				updateNodeStatus(pack.node, StatusDead, currentHeartbeat(), thisHost, cause)
+				pack.node.setPingMillis(PingTimedOut)
+			default:
+				updateNodeStatus(pack.node, StatusSuspected, currentHeartbeat(), thisHost, cause)
+				pack.node.setPingMillis(PingTimedOut)
+			}
+		}
+	}
+}
+
+// Returns whether an accrual failure detector has yet to fail the node of a
+// direct ping whose timeout has passed, in which case the ack's timeout is
+// rescheduled for when the node is next to be checked. Ping requests are
+// always timed out, since their timeouts span the relays' pings too.
+func stillAccruing(pack *pendingAck) bool {
+	if pack.packType == packPingReq {
+		return false
+	}
+
+	detector, ok := getFailureDetector().(AccrualFailureDetector)
+	if !ok {
+		return false
+	}
+
+	elapsed := pack.elapsed()
+	if detector.Failed(pack.node, elapsed) {
+		return false
+	}
+
+	// Round up, so that a check that's due is never scheduled in the past.
+	timeoutMillis := ackTimeoutMillis(pack) + 1
+	if time.Duration(timeoutMillis)*time.Millisecond <= elapsed {
+		return false
+	}
+
+	logfTrace("%s not yet failed after %v: checking again in %v",
+		pack.key, elapsed, time.Duration(timeoutMillis)*time.Millisecond-elapsed)
+
+	schedulePendingAck(pack, pack.key, pack.startTime, timeoutMillis)
+
+	return true
+}
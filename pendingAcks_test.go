@@ -0,0 +1,98 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pending acks must expire in deadline order, each only once its deadline
+// has passed, and cancelled acks must never expire.
+func TestPendingAckExpiry(t *testing.T) {
+	now := time.Now()
+
+	a := &pendingAck{packType: packPing}
+	b := &pendingAck{packType: packPing}
+	c := &pendingAck{packType: packPing}
+
+	schedulePendingAck(c, "c", now, 300)
+	schedulePendingAck(a, "a", now, 100)
+	schedulePendingAck(b, "b", now, 200)
+
+	if cancelPendingAck("b") != b {
+		t.Error("Expected to cancel b")
+	}
+
+	if cancelPendingAck("b") != nil {
+		t.Error("Expected b to be cancelled only once")
+	}
+
+	expired, next := expirePendingAcks(now.Add(50 * time.Millisecond))
+	if len(expired) != 0 {
+		t.Errorf("Expected nothing to expire, found %d", len(expired))
+	}
+	if !next.Equal(now.Add(100 * time.Millisecond)) {
+		t.Errorf("Expected next deadline of a, found %v", next)
+	}
+
+	expired, next = expirePendingAcks(now.Add(250 * time.Millisecond))
+	if len(expired) != 1 || expired[0] != a {
+		t.Errorf("Expected only a to expire, found %v", expired)
+	}
+	if !next.Equal(now.Add(300 * time.Millisecond)) {
+		t.Errorf("Expected next deadline of c, found %v", next)
+	}
+
+	expired, next = expirePendingAcks(now.Add(time.Second))
+	if len(expired) != 1 || expired[0] != c {
+		t.Errorf("Expected only c to expire, found %v", expired)
+	}
+	if !next.IsZero() {
+		t.Errorf("Expected no next deadline, found %v", next)
+	}
+}
+
+// Ack deadlines and node ages must be measured on the monotonic clock, so
+// that a change to the wall clock can't expire an ack early or make a node
+// seem to have been silent for longer than it has.
+func TestPendingAckDeadlineIsMonotonic(t *testing.T) {
+	node := &Node{}
+	node.Touch()
+
+	pack := &pendingAck{packType: packPing, node: node, startTime: time.Now()}
+	schedulePendingAck(pack, "monotonic", pack.startTime, 100)
+	defer cancelPendingAck("monotonic")
+
+	// The String() of a time includes its monotonic clock reading, if it has
+	// one.
+	for name, tm := range map[string]time.Time{
+		"deadline":  pack.deadline,
+		"timestamp": node.Timestamp(),
+	} {
+		if !strings.Contains(tm.String(), " m=") {
+			t.Errorf("Expected the %s to have a monotonic clock reading: %v", name, tm)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if age := node.Age(); age < 20*time.Millisecond || age > time.Second {
+		t.Errorf("Expected an age of about 20ms, found %v", age)
+	}
+}
@@ -50,6 +50,21 @@ func newPingData(initialAverage int, historyCount int) pingData {
 	return pingData{pings: newPings, updated: true}
 }
 
+// Discards the collected datapoints, replacing them with historyCount
+// datapoints of initialAverage.
+func (pd *pingData) reset(initialAverage int, historyCount int) {
+	pd.Lock()
+	defer pd.Unlock()
+
+	pd.pings = make([]uint32, historyCount, historyCount)
+	for i := range pd.pings {
+		pd.pings[i] = uint32(initialAverage)
+	}
+
+	pd.pointer = 0
+	pd.updated = true
+}
+
 func (pd *pingData) add(datapoint uint32) {
 	pd.Lock()
 
@@ -66,9 +81,9 @@ func (pd *pingData) add(datapoint uint32) {
 
 // mean returns the simple mean (average) of the collected datapoints.
 func (pd *pingData) mean() float64 {
-	pd.data()
+	mean, _ := pd.data()
 
-	return pd.lastMean
+	return mean
 }
 
 // Returns the mean modified by the requested number of sigmas
@@ -80,15 +95,17 @@ func (pd *pingData) nSigma(sigmas float64) float64 {
 
 // stddev returns the standard deviation of the collected datapoints
 func (pd *pingData) stddev() float64 {
-	pd.data()
+	_, stddev := pd.data()
 
-	return pd.lastStddev
+	return stddev
 }
 
 // Returns both mean and standard deviation
 func (pd *pingData) data() (float64, float64) {
+	pd.Lock()
+	defer pd.Unlock()
+
 	if pd.updated {
-		pd.Lock()
 
 		// Calculate the mean
 		var accumulator float64
@@ -109,8 +126,6 @@ func (pd *pingData) data() (float64, float64) {
 		pd.lastStddev = math.Sqrt(squareDiffMean)
 
 		pd.updated = false
-
-		pd.Unlock()
 	}
 
 	return pd.lastMean, pd.lastStddev
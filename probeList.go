@@ -0,0 +1,138 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// The order in which known nodes (other than this one) are probed.
+var probes = newProbeList()
+
+// probeList implements the randomized round-robin probe schedule described
+// in the SWIM paper. The list is walked in order, and shuffled each time the
+// walk completes. Nodes before the cursor have been probed in the current
+// pass; those at or after it have not. Joining nodes are inserted, and
+// departing nodes removed, in O(1) without moving any node between the two
+// regions, so every node is probed exactly once per pass.
+type probeList struct {
+	sync.Mutex
+
+	nodes []*Node
+
+	// Each node's position in nodes, keyed on address.
+	positions map[string]int
+
+	// The position of the next node to probe.
+	next int
+}
+
+func newProbeList() *probeList {
+	return &probeList{positions: make(map[string]int)}
+}
+
+// Inserts a node at a random position, if it isn't already present.
+func (l *probeList) add(node *Node) {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.positions[node.Address()]; ok {
+		return
+	}
+
+	l.nodes = append(l.nodes, node)
+	l.positions[node.Address()] = len(l.nodes) - 1
+
+	j := rand.Intn(len(l.nodes))
+
+	if j >= l.next {
+		// Among the nodes still to be probed this pass.
+		l.swap(len(l.nodes)-1, j)
+	} else {
+		// Among the nodes already probed this pass: the new node takes the
+		// place of the unprobed node at the cursor, which moves to the end,
+		// and the cursor advances past it.
+		l.swap(len(l.nodes)-1, l.next)
+		l.next++
+		l.swap(l.next-1, j)
+	}
+}
+
+// Removes a node, if it's present.
+func (l *probeList) remove(node *Node) {
+	l.Lock()
+	defer l.Unlock()
+
+	i, ok := l.positions[node.Address()]
+	if !ok {
+		return
+	}
+
+	if i < l.next {
+		// Fill the gap with the last probed node, and that node's place
+		// with the last node.
+		l.next--
+		l.swap(i, l.next)
+		i = l.next
+	}
+
+	l.swap(i, len(l.nodes)-1)
+
+	delete(l.positions, node.Address())
+	l.nodes[len(l.nodes)-1] = nil
+	l.nodes = l.nodes[:len(l.nodes)-1]
+}
+
+// Returns the next node to probe, or nil if there are none. When a pass
+// completes the list is reshuffled, so its O(N) cost is spread over N probes.
+func (l *probeList) nextNode() *Node {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.nodes) == 0 {
+		return nil
+	}
+
+	if l.next >= len(l.nodes) {
+		for i := len(l.nodes) - 1; i > 0; i-- {
+			l.swap(i, rand.Intn(i+1))
+		}
+
+		l.next = 0
+	}
+
+	node := l.nodes[l.next]
+	l.next++
+
+	return node
+}
+
+func (l *probeList) length() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return len(l.nodes)
+}
+
+// Swaps the nodes at two positions, keeping their recorded positions
+// current.
+func (l *probeList) swap(i, j int) {
+	l.nodes[i], l.nodes[j] = l.nodes[j], l.nodes[i]
+	l.positions[l.nodes[i].Address()] = i
+	l.positions[l.nodes[j].Address()] = j
+}
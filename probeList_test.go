@@ -0,0 +1,77 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+)
+
+// Under constant churn, every node that is present for a whole pass must be
+// probed exactly once in it.
+func TestProbeListChurn(t *testing.T) {
+	l := newProbeList()
+
+	nodes := make([]*Node, 64)
+	for i := range nodes {
+		nodes[i] = &Node{ip: net.IPv4(10, 0, byte(i/256), byte(i)), port: 9999}
+	}
+
+	// Half of the nodes stay for the whole test; the rest come and go.
+	for _, n := range nodes {
+		l.add(n)
+	}
+
+	for pass := 0; pass < 20; pass++ {
+		probed := make(map[string]int)
+
+		for i := 0; i < 32; i++ {
+			probed[l.nextNode().Address()]++
+
+			churned := nodes[32+(pass*7+i)%32]
+			if i%2 == 0 {
+				l.remove(churned)
+			} else {
+				l.add(churned)
+			}
+		}
+
+		// Finish the pass.
+		for l.next < len(l.nodes) {
+			probed[l.nextNode().Address()]++
+		}
+
+		for _, n := range nodes[:32] {
+			if probed[n.Address()] != 1 {
+				t.Fatalf("Pass %d: %s probed %d times", pass, n.Address(), probed[n.Address()])
+			}
+		}
+
+		for a, count := range probed {
+			if count > 1 {
+				t.Fatalf("Pass %d: %s probed %d times", pass, a, count)
+			}
+		}
+
+		for i, n := range l.nodes {
+			if l.positions[n.Address()] != i {
+				t.Fatalf("Pass %d: %s recorded at %d, found at %d",
+					pass, n.Address(), l.positions[n.Address()], i)
+			}
+		}
+	}
+}
@@ -17,17 +17,19 @@ limitations under the License.
 package smudge
 
 import (
-	"fmt"
 	"net"
 	"os"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Provides a series of methods and constants that revolve around the getting
 // (or programmatically setting/overriding) environmental properties, returning
 // default values if not set.
+//
+// Each setting is documented on its field of Config.
 
 const (
 	// EnvVarClusterName is the name of the environment variable the defines
@@ -81,6 +83,12 @@ const (
 	// message overhead.
 	DefaultMaxBroadcastBytes int = 256
 
+	// The largest broadcast payload that fits in the receive buffer, along
+	// with the message header and as many members as a message can carry,
+	// when using IPv6.
+	maxBroadcastBytes = udpBufferSize - messageHeaderLength -
+		maxMessageMembers*(9+2*net.IPv6len) - (9 + net.IPv6len)
+
 	// EnvVarMulticastAddress is the name of the environment variable that
 	// defines the multicast address that will be used.
 	EnvVarMulticastAddress = "SMUDGE_MULTICAST_ADDRESS"
@@ -137,243 +145,586 @@ const (
 	// times (in milliseconds). This prevents the system instability and
 	// flapping that can come from consistently small values.
 	DefaultMinPingTime = 150
-)
 
-var clusterName string
+	// EnvVarLogLevel is the name of the environment variable that sets
+	// Config.LogLevel.
+	EnvVarLogLevel = "SMUDGE_LOG_LEVEL"
+
+	// DefaultLogLevel is the default logging threshold.
+	DefaultLogLevel = "info"
+
+	// EnvVarProfile is the name of the environment variable that names the
+	// protocol profile ("lan", "wan" or "local") whose values are used for
+	// the protocol properties that aren't otherwise set.
+	EnvVarProfile = "SMUDGE_PROFILE"
+
+	// DefaultProfile is the default protocol profile.
+	DefaultProfile = "lan"
+
+	// EnvVarLambda is the name of the environment variable that sets
+	// Config.Lambda.
+	EnvVarLambda = "SMUDGE_LAMBDA"
+
+	// DefaultLambda is the default retransmit multiplier.
+	DefaultLambda = 2.5
+
+	// EnvVarIndirectProbeCount is the name of the environment variable that
+	// sets Config.IndirectProbeCount.
+	EnvVarIndirectProbeCount = "SMUDGE_INDIRECT_PROBE_COUNT"
+
+	// DefaultIndirectProbeCount is the default indirect probe count, which
+	// derives it from lambda and the cluster size.
+	DefaultIndirectProbeCount = 0
+
+	// EnvVarTimeoutToleranceSigmas is the name of the environment variable
+	// that sets Config.TimeoutToleranceSigmas.
+	EnvVarTimeoutToleranceSigmas = "SMUDGE_TIMEOUT_TOLERANCE_SIGMAS"
+
+	// DefaultTimeoutToleranceSigmas is the default timeout tolerance.
+	DefaultTimeoutToleranceSigmas = 3.0
+
+	// EnvVarPingRequestTimeoutMultiplier is the name of the environment
+	// variable that sets Config.PingRequestTimeoutMultiplier.
+	EnvVarPingRequestTimeoutMultiplier = "SMUDGE_PING_REQUEST_TIMEOUT_MULTIPLIER"
+
+	// DefaultPingRequestTimeoutMultiplier is the default ping request
+	// timeout multiplier.
+	DefaultPingRequestTimeoutMultiplier = 2.0
+
+	// EnvVarPingHistorySize is the name of the environment variable that
+	// sets Config.PingHistorySize.
+	EnvVarPingHistorySize = "SMUDGE_PING_HISTORY_SIZE"
+
+	// DefaultPingHistorySize is the default ping history size.
+	DefaultPingHistorySize = 50
+
+	// EnvVarMaxDeadNodeRetries is the name of the environment variable that
+	// sets Config.MaxDeadNodeRetries.
+	EnvVarMaxDeadNodeRetries = "SMUDGE_MAX_DEAD_NODE_RETRIES"
+
+	// DefaultMaxDeadNodeRetries is the default number of dead node retries.
+	DefaultMaxDeadNodeRetries = 10
+
+	// EnvVarReapTimeoutSeconds is the name of the environment variable that
+	// sets Config.ReapTimeoutSeconds.
+	EnvVarReapTimeoutSeconds = "SMUDGE_REAP_TIMEOUT_SECONDS"
+
+	// DefaultReapTimeoutSeconds is the default reap timeout.
+	DefaultReapTimeoutSeconds = 300
+
+	// EnvVarBroadcastRetention is the name of the environment variable that
+	// sets Config.BroadcastRetention.
+	EnvVarBroadcastRetention = "SMUDGE_BROADCAST_RETENTION"
+
+	// DefaultBroadcastRetention is the default broadcast retention.
+	DefaultBroadcastRetention = 100
+
+	// The largest broadcast retention that an emit counter can count down.
+	maxBroadcastRetention = 128
+
+	// EnvVarAllowedNetworks is the name of the environment variable that
+	// sets Config.AllowedNetworks.
+	EnvVarAllowedNetworks = "SMUDGE_ALLOWED_NETWORKS"
+
+	// DefaultAllowedNetworks is the default list of allowed networks, which
+	// is empty: any address is allowed.
+	DefaultAllowedNetworks string = ""
+
+	// EnvVarBlockedNetworks is the name of the environment variable that
+	// sets Config.BlockedNetworks.
+	EnvVarBlockedNetworks = "SMUDGE_BLOCKED_NETWORKS"
+
+	// DefaultBlockedNetworks is the default list of blocked networks.
+	DefaultBlockedNetworks string = ""
+
+	// EnvVarSourceRateLimit is the name of the environment variable that
+	// sets Config.SourceRateLimit.
+	EnvVarSourceRateLimit = "SMUDGE_SOURCE_RATE_LIMIT"
+
+	// DefaultSourceRateLimit is the default source rate limit.
+	DefaultSourceRateLimit = 200.0
+
+	// EnvVarSourceRateBurst is the name of the environment variable that
+	// sets Config.SourceRateBurst.
+	EnvVarSourceRateBurst = "SMUDGE_SOURCE_RATE_BURST"
+
+	// DefaultSourceRateBurst is the default source rate burst.
+	DefaultSourceRateBurst = 400
+
+	// EnvVarMaxMembers is the name of the environment variable that sets
+	// Config.MaxMembers.
+	EnvVarMaxMembers = "SMUDGE_MAX_MEMBERS"
 
-var heartbeatMillis int
+	// DefaultMaxMembers is the default maximum number of known members.
+	DefaultMaxMembers = 10000
 
-var listenPort int
+	// EnvVarMaxNewMembers is the name of the environment variable that sets
+	// Config.MaxNewMembers.
+	EnvVarMaxNewMembers = "SMUDGE_MAX_NEW_MEMBERS"
 
-var listenIP net.IP
+	// DefaultMaxNewMembers is the default maximum number of members learned
+	// of in each new member interval.
+	DefaultMaxNewMembers = 100
 
-var initialHosts []string
+	// EnvVarNewMembersIntervalMillis is the name of the environment variable
+	// that sets Config.NewMembersIntervalMillis.
+	EnvVarNewMembersIntervalMillis = "SMUDGE_NEW_MEMBERS_INTERVAL_MILLIS"
 
-var maxBroadcastBytes int
+	// DefaultNewMembersIntervalMillis is the default new member interval.
+	DefaultNewMembersIntervalMillis = 1000
 
-var minPingTime int
+	// EnvVarSnapshotPath is the name of the environment variable that sets
+	// Config.SnapshotPath.
+	EnvVarSnapshotPath = "SMUDGE_SNAPSHOT_PATH"
 
-var multicastEnabledString string
+	// DefaultSnapshotPath is the default snapshot file path, which is empty:
+	// no snapshot is kept.
+	DefaultSnapshotPath string = ""
 
-var multicastEnabled = true
+	// EnvVarIsolationThreshold is the name of the environment variable that
+	// sets Config.IsolationThreshold.
+	EnvVarIsolationThreshold = "SMUDGE_ISOLATION_THRESHOLD"
 
-var multicastAnnounceIntervalSeconds = 10
+	// DefaultIsolationThreshold is the default isolation threshold.
+	DefaultIsolationThreshold = 0.5
 
-var multicastPort int
+	// EnvVarReseedIntervalMillis is the name of the environment variable
+	// that sets Config.ReseedIntervalMillis.
+	EnvVarReseedIntervalMillis = "SMUDGE_RESEED_INTERVAL_MILLIS"
 
-var multicastAddress string
+	// DefaultReseedIntervalMillis is the default delay after the first
+	// re-seed.
+	DefaultReseedIntervalMillis = 1000
 
-var pingHistoryFrontload int
+	// EnvVarReseedMaxIntervalMillis is the name of the environment variable
+	// that sets Config.ReseedMaxIntervalMillis.
+	EnvVarReseedMaxIntervalMillis = "SMUDGE_RESEED_MAX_INTERVAL_MILLIS"
+
+	// DefaultReseedMaxIntervalMillis is the default longest delay between
+	// re-seeds.
+	DefaultReseedMaxIntervalMillis = 60000
+
+	// EnvVarPartitionThreshold is the name of the environment variable that
+	// sets Config.PartitionThreshold.
+	EnvVarPartitionThreshold = "SMUDGE_PARTITION_THRESHOLD"
+
+	// DefaultPartitionThreshold is the default partition threshold.
+	DefaultPartitionThreshold = 0.3
+
+	// EnvVarPartitionWindowSeconds is the name of the environment variable
+	// that sets Config.PartitionWindowSeconds.
+	EnvVarPartitionWindowSeconds = "SMUDGE_PARTITION_WINDOW_SECONDS"
+
+	// DefaultPartitionWindowSeconds is the default partition window.
+	DefaultPartitionWindowSeconds = 30
+
+	// EnvVarPartitionRedialTimeoutSeconds is the name of the environment
+	// variable that sets Config.PartitionRedialTimeoutSeconds.
+	EnvVarPartitionRedialTimeoutSeconds = "SMUDGE_PARTITION_REDIAL_TIMEOUT_SECONDS"
+
+	// DefaultPartitionRedialTimeoutSeconds is the default partition redial
+	// timeout.
+	DefaultPartitionRedialTimeoutSeconds = 3600
+)
+
+// Guards changes to properties. The configuration in effect is never
+// modified once it's stored, but replaced with a changed copy, so it may be
+// read from any goroutine without the lock.
+var propertiesLock sync.Mutex
+
+// Holds the *Config in effect, or nil until it has been loaded from the
+// environment, which happens when it's first used unless it has been set
+// with ApplyConfig() first.
+var properties atomic.Value
 
 const stringListDelimitRegex = "\\s*((,\\s*)|(\\s+))"
 
+// Returns the configuration in effect, which mustn't be modified, loading it
+// if it hasn't been yet.
+func loadedProperties() *Config {
+	if c, _ := properties.Load().(*Config); c != nil {
+		return c
+	}
+
+	propertiesLock.Lock()
+	defer propertiesLock.Unlock()
+
+	return currentProperties()
+}
+
+// Returns the configuration in effect, which mustn't be modified, loading it
+// from the environment if it hasn't been yet. Values in the environment that
+// can't be parsed are left at their defaults. The caller must hold
+// propertiesLock.
+func currentProperties() *Config {
+	if c, _ := properties.Load().(*Config); c != nil {
+		return c
+	}
+
+	config, err := LoadConfig("")
+	if err != nil {
+		logfWarn("Invalid environment properties: %v", err)
+	}
+
+	if config.BroadcastRetention > maxBroadcastRetention {
+		config.BroadcastRetention = maxBroadcastRetention
+	}
+
+	if config.MaxBroadcastBytes > maxBroadcastBytes {
+		config.MaxBroadcastBytes = maxBroadcastBytes
+	}
+
+	storeProperties(&config)
+
+	return &config
+}
+
+// Puts the configuration into effect. The caller must hold propertiesLock.
+func storeProperties(c *Config) {
+	properties.Store(c)
+	cacheClusterID(c.ClusterName)
+}
+
+// Puts a copy of the configuration in effect into effect, once the change
+// has been made to it.
+func updateProperties(change func(c *Config)) {
+	propertiesLock.Lock()
+	defer propertiesLock.Unlock()
+
+	c := currentProperties().clone()
+	change(&c)
+
+	storeProperties(&c)
+}
+
+// Replaces the configuration in effect, including the log threshold, in a
+// single critical section.
+func setProperties(c Config) {
+	propertiesLock.Lock()
+	defer propertiesLock.Unlock()
+
+	c = c.clone()
+	storeProperties(&c)
+
+	SetLogThreshold(c.LogLevel)
+}
+
+// Returns a copy of the configuration that shares no slices with it.
+func (c Config) clone() Config {
+	c.ListenIP = append(net.IP{}, c.ListenIP...)
+	c.InitialHosts = append([]string{}, c.InitialHosts...)
+	c.AllowedNetworks = append([]*net.IPNet{}, c.AllowedNetworks...)
+	c.BlockedNetworks = append([]*net.IPNet{}, c.BlockedNetworks...)
+
+	return c
+}
+
 // GetClusterName gets the name of the cluster for the purposes of
 // multicast announcements: multicast messages from differently-named
 // instances are ignored.
 func GetClusterName() string {
-	if clusterName == "" {
-		clusterName = getStringVar(EnvVarClusterName, DefaultClusterName)
-	}
-
-	return clusterName
+	return loadedProperties().ClusterName
 }
 
 // GetHeartbeatMillis gets this host's heartbeat frequency in milliseconds.
 func GetHeartbeatMillis() int {
-	if heartbeatMillis == 0 {
-		heartbeatMillis = getIntVar(EnvVarHeartbeatMillis, DefaultHeartbeatMillis)
-	}
-
-	return heartbeatMillis
+	return loadedProperties().HeartbeatMillis
 }
 
-// GetInitialHosts returns the list of initially known hosts.
+// GetInitialHosts returns a copy of the list of initially known hosts.
 func GetInitialHosts() []string {
-	if initialHosts == nil {
-		initialHosts = getStringArrayVar(EnvVarInitialHosts, DefaultInitialHosts)
-	}
-
-	return initialHosts
+	return append([]string(nil), loadedProperties().InitialHosts...)
 }
 
 // GetListenPort returns the port that this host will listen on.
 func GetListenPort() int {
-	if listenPort == 0 {
-		listenPort = getIntVar(EnvVarListenPort, DefaultListenPort)
-	}
-
-	return listenPort
+	return loadedProperties().ListenPort
 }
 
-// GetListenIP returns the IP that this host will listen on.
+// GetListenIP returns a copy of the IP that this host will listen on.
 func GetListenIP() net.IP {
-	if listenIP == nil {
-		listenIP = net.ParseIP(getStringVar(EnvVarListenIP, DefaultListenIP))
-	}
-
-	return listenIP
+	return append(net.IP(nil), loadedProperties().ListenIP...)
 }
 
 // GetMaxBroadcastBytes returns the maximum byte length for broadcast payloads.
 func GetMaxBroadcastBytes() int {
-	if maxBroadcastBytes == 0 {
-		maxBroadcastBytes = getIntVar(EnvVarMaxBroadcastBytes, DefaultMaxBroadcastBytes)
-	}
-
-	return maxBroadcastBytes
+	return loadedProperties().MaxBroadcastBytes
 }
 
 // GetMinPingTime returns the minimum ping response time in milliseconds. Ping
 // response times below this value are recorded as this minimum.
 func GetMinPingTime() int {
-	if minPingTime == 0 {
-		minPingTime = getIntVar(EnvVarMinPingTime, DefaultMinPingTime)
-	}
-
-	return minPingTime
+	return loadedProperties().MinPingTime
 }
 
 // GetMulticastEnabled returns whether multicast announcements are enabled.
 func GetMulticastEnabled() bool {
-	if multicastEnabledString == "" {
-		multicastEnabledString = strings.ToLower(getStringVar(EnvVarMulticastEnabled, DefaultMulticastEnabled))
-	}
-
-	multicastEnabled = len(multicastEnabledString) > 0 && []rune(multicastEnabledString)[0] == 't'
-	return multicastEnabled
+	return loadedProperties().MulticastEnabled
 }
 
 // GetMulticastAnnounceIntervalSeconds returns the amount of seconds to wait between
 // multicast announcements.
 func GetMulticastAnnounceIntervalSeconds() int {
-	multicastAnnounceIntervalSeconds = getIntVar(EnvVarMulticastAnnounceIntervalSeconds, DefaultMulticastAnnounceIntervalSeconds)
-	return multicastAnnounceIntervalSeconds
+	return loadedProperties().MulticastAnnounceIntervalSeconds
 }
 
 // GetMulticastAddress returns the address the will be used for multicast
 // announcements.
 func GetMulticastAddress() string {
-	if multicastAddress == "" {
-		multicastAddress = getStringVar(EnvVarMulticastAddress, DefaultMulticastAddress)
-	}
-
-	return multicastAddress
+	return loadedProperties().MulticastAddress
 }
 
 // GetMulticastPort returns the defined multicast announcement listening port.
 func GetMulticastPort() int {
-	if multicastPort == 0 {
-		multicastPort = getIntVar(EnvVarMulticastPort, DefaultMulticastPort)
-	}
-
-	return multicastPort
+	return loadedProperties().MulticastPort
 }
 
 // GetPingHistoryFrontload returns the value (in milliseconds) used to
 // pre-populate the ping history buffer, which is used to dynamically calculate
 // ping timeouts and is gradually overwritten with real data over time.
 func GetPingHistoryFrontload() int {
-	if pingHistoryFrontload == 0 {
-		pingHistoryFrontload = getIntVar(EnvVarPingHistoryFrontload, DefaultPingHistoryFrontload)
-	}
+	return loadedProperties().PingHistoryFrontload
+}
 
-	return pingHistoryFrontload
+// GetLambda returns Config.Lambda.
+func GetLambda() float64 {
+	return loadedProperties().Lambda
+}
+
+// GetIndirectProbeCount returns Config.IndirectProbeCount.
+func GetIndirectProbeCount() int {
+	return loadedProperties().IndirectProbeCount
+}
+
+// GetTimeoutToleranceSigmas returns Config.TimeoutToleranceSigmas.
+func GetTimeoutToleranceSigmas() float64 {
+	return loadedProperties().TimeoutToleranceSigmas
+}
+
+// GetPingRequestTimeoutMultiplier returns
+// Config.PingRequestTimeoutMultiplier.
+func GetPingRequestTimeoutMultiplier() float64 {
+	return loadedProperties().PingRequestTimeoutMultiplier
+}
+
+// GetPingHistorySize returns Config.PingHistorySize.
+func GetPingHistorySize() int {
+	return loadedProperties().PingHistorySize
+}
+
+// GetMaxDeadNodeRetries returns Config.MaxDeadNodeRetries.
+func GetMaxDeadNodeRetries() int {
+	return loadedProperties().MaxDeadNodeRetries
+}
+
+// GetReapTimeoutSeconds returns Config.ReapTimeoutSeconds.
+func GetReapTimeoutSeconds() int {
+	return loadedProperties().ReapTimeoutSeconds
+}
+
+// GetBroadcastRetention returns Config.BroadcastRetention.
+func GetBroadcastRetention() int {
+	return loadedProperties().BroadcastRetention
+}
+
+// GetAllowedNetworks returns a copy of Config.AllowedNetworks.
+func GetAllowedNetworks() []*net.IPNet {
+	return append([]*net.IPNet(nil), loadedProperties().AllowedNetworks...)
+}
+
+// GetBlockedNetworks returns a copy of Config.BlockedNetworks.
+func GetBlockedNetworks() []*net.IPNet {
+	return append([]*net.IPNet(nil), loadedProperties().BlockedNetworks...)
+}
+
+// GetSourceRateLimit returns Config.SourceRateLimit.
+func GetSourceRateLimit() float64 {
+	return loadedProperties().SourceRateLimit
+}
+
+// GetSourceRateBurst returns Config.SourceRateBurst.
+func GetSourceRateBurst() int {
+	return loadedProperties().SourceRateBurst
+}
+
+// GetMaxMembers returns Config.MaxMembers.
+func GetMaxMembers() int {
+	return loadedProperties().MaxMembers
+}
+
+// GetMaxNewMembers returns Config.MaxNewMembers.
+func GetMaxNewMembers() int {
+	return loadedProperties().MaxNewMembers
+}
+
+// GetNewMembersIntervalMillis returns Config.NewMembersIntervalMillis.
+func GetNewMembersIntervalMillis() int {
+	return loadedProperties().NewMembersIntervalMillis
+}
+
+// GetSnapshotPath returns Config.SnapshotPath.
+func GetSnapshotPath() string {
+	return loadedProperties().SnapshotPath
+}
+
+// GetIsolationThreshold returns Config.IsolationThreshold.
+func GetIsolationThreshold() float64 {
+	return loadedProperties().IsolationThreshold
+}
+
+// GetReseedIntervalMillis returns Config.ReseedIntervalMillis.
+func GetReseedIntervalMillis() int {
+	return loadedProperties().ReseedIntervalMillis
+}
+
+// GetReseedMaxIntervalMillis returns Config.ReseedMaxIntervalMillis.
+func GetReseedMaxIntervalMillis() int {
+	return loadedProperties().ReseedMaxIntervalMillis
+}
+
+// GetPartitionThreshold returns Config.PartitionThreshold.
+func GetPartitionThreshold() float64 {
+	return loadedProperties().PartitionThreshold
+}
+
+// GetPartitionWindowSeconds returns Config.PartitionWindowSeconds.
+func GetPartitionWindowSeconds() int {
+	return loadedProperties().PartitionWindowSeconds
+}
+
+// GetPartitionRedialTimeoutSeconds returns
+// Config.PartitionRedialTimeoutSeconds.
+func GetPartitionRedialTimeoutSeconds() int {
+	return loadedProperties().PartitionRedialTimeoutSeconds
 }
 
 // SetClusterName sets the name of the cluster for the purposes of multicast
 // announcements: multicast messages from differently-named instances are
 // ignored.
 func SetClusterName(val string) {
-	if val == "" {
-		clusterName = DefaultClusterName
-	} else {
-		clusterName = val
-	}
+	updateProperties(func(c *Config) {
+		if val == "" {
+			c.ClusterName = DefaultClusterName
+		} else {
+			c.ClusterName = val
+		}
+	})
 }
 
 // SetHeartbeatMillis sets this nodes heartbeat frequency. Unlike
 // SetListenPort(), calling this function after Begin() has been called will
 // have an effect.
 func SetHeartbeatMillis(val int) {
-	if val == 0 {
-		heartbeatMillis = DefaultHeartbeatMillis
-	} else {
-		heartbeatMillis = val
-	}
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.HeartbeatMillis = DefaultHeartbeatMillis
+		} else {
+			c.HeartbeatMillis = val
+		}
+	})
+}
+
+// SetInitialHosts sets the addresses, as IP or IP:PORT, of the members that
+// Begin() adds to the known nodes. It has no effect once Begin() has been
+// called.
+func SetInitialHosts(val []string) {
+	updateProperties(func(c *Config) {
+		c.InitialHosts = append([]string{}, val...)
+	})
 }
 
 // SetListenPort sets the UDP port to listen on. It has no effect once
 // Begin() has been called.
 func SetListenPort(val int) {
-	if val == 0 {
-		listenPort = DefaultListenPort
-	} else {
-		listenPort = val
-	}
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.ListenPort = DefaultListenPort
+		} else {
+			c.ListenPort = val
+		}
+	})
 }
 
 // SetListenIP sets the IP to listen on. It has no effect once
 // Begin() has been called.
 func SetListenIP(val net.IP) {
-	if len(AllNodes()) > 0 {
-		logWarn("Do not call SetListenIP() after nodes have been added, it may cause unexpected behavior.")
-	}
+	updateProperties(func(c *Config) {
+		if len(AllNodes()) > 0 {
+			logWarn("Do not call SetListenIP() after nodes have been added, it may cause unexpected behavior.")
+		}
 
-	if val == nil {
-		listenIP = net.ParseIP(DefaultListenIP)
-	} else {
-		listenIP = val
-	}
+		if val == nil {
+			c.ListenIP = net.ParseIP(DefaultListenIP)
+		} else {
+			c.ListenIP = append(net.IP(nil), val...)
+		}
+	})
 }
 
 // SetMaxBroadcastBytes sets the maximum byte length for broadcast payloads.
 // Note that increasing this beyond the default of 256 runs the risk of packet
-// fragmentation and dropped messages.
+// fragmentation and dropped messages. Values beyond what fits in the receive
+// buffer are reduced to fit.
 func SetMaxBroadcastBytes(val int) {
-	if val == 0 {
-		maxBroadcastBytes = DefaultMaxBroadcastBytes
-	} else {
-		maxBroadcastBytes = val
-	}
+	updateProperties(func(c *Config) {
+		switch {
+		case val == 0:
+			c.MaxBroadcastBytes = DefaultMaxBroadcastBytes
+		case val > maxBroadcastBytes:
+			c.MaxBroadcastBytes = maxBroadcastBytes
+		default:
+			c.MaxBroadcastBytes = val
+		}
+	})
 }
 
 // SetMinPingTime sets the minimum ping response time in milliseconds. Ping
 // response times below this value are recorded as this minimum.
 func SetMinPingTime(val int) {
-	if val == 0 {
-		minPingTime = DefaultMinPingTime
-	} else {
-		minPingTime = val
-	}
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.MinPingTime = DefaultMinPingTime
+		} else {
+			c.MinPingTime = val
+		}
+	})
 }
 
 // SetMulticastAddress sets the address that will be used for multicast
 // announcements.
 func SetMulticastAddress(val string) {
-	if val == "" {
-		multicastAddress = DefaultMulticastAddress
-	} else {
-		multicastAddress = val
-	}
+	updateProperties(func(c *Config) {
+		c.MulticastAddress = val
+	})
 }
 
 // SetMulticastEnabled sets whether multicast announcements are enabled.
 func SetMulticastEnabled(val bool) {
-	multicastEnabledString = fmt.Sprintf("%v", val)
+	updateProperties(func(c *Config) {
+		c.MulticastEnabled = val
+	})
 }
 
 // SetMulticastAnnounceIntervalSeconds sets the number of seconds between multicast announcements
 func SetMulticastAnnounceIntervalSeconds(val int) {
-	multicastAnnounceIntervalSeconds = val
+	updateProperties(func(c *Config) {
+		if val < 0 {
+			c.MulticastAnnounceIntervalSeconds = 0
+		} else {
+			c.MulticastAnnounceIntervalSeconds = val
+		}
+	})
 }
 
 // SetMulticastPort sets multicast announcement listening port.
 func SetMulticastPort(val int) {
-	if val == 0 {
-		multicastPort = DefaultMulticastPort
-	} else {
-		multicastPort = val
-	}
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.MulticastPort = DefaultMulticastPort
+		} else {
+			c.MulticastPort = val
+		}
+	})
 }
 
 // SetPingHistoryFrontload sets the value (in milliseconds) used to
@@ -381,47 +732,265 @@ func SetMulticastPort(val int) {
 // ping timeouts and is gradually overwritten with real data over time.
 // Setting this to 0 will restore the default value.
 func SetPingHistoryFrontload(val int) {
-	if val == 0 {
-		pingHistoryFrontload = DefaultPingHistoryFrontload
-	} else {
-		pingHistoryFrontload = val
-	}
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.PingHistoryFrontload = DefaultPingHistoryFrontload
+		} else {
+			c.PingHistoryFrontload = val
+		}
+	})
 }
 
-// Gets an environmental variable "key". If it does not exist, "defaultVal" is
-// returned; if it does, it attempts to convert to an integer, returning
-// "defaultVal" if it fails.
-func getIntVar(key string, defaultVal int) int {
-	valueString := os.Getenv(key)
-	valueInt := defaultVal
+// SetLambda sets Config.Lambda. Setting this to 0 will restore the default
+// value.
+func SetLambda(val float64) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.Lambda = DefaultLambda
+		} else {
+			c.Lambda = val
+		}
+	})
+}
 
-	if valueString != "" {
-		i, err := strconv.Atoi(key)
+// SetIndirectProbeCount sets Config.IndirectProbeCount. Negative values are
+// treated as 0.
+func SetIndirectProbeCount(val int) {
+	updateProperties(func(c *Config) {
+		if val < 0 {
+			c.IndirectProbeCount = 0
+		} else {
+			c.IndirectProbeCount = val
+		}
+	})
+}
 
-		if err != nil {
-			logfWarn("Failed to parse env property %s: %s is not "+
-				"an integer. Using default.", key, valueString)
+// SetTimeoutToleranceSigmas sets Config.TimeoutToleranceSigmas. Setting this
+// to 0 will restore the default value.
+func SetTimeoutToleranceSigmas(val float64) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.TimeoutToleranceSigmas = DefaultTimeoutToleranceSigmas
 		} else {
-			valueInt = i
+			c.TimeoutToleranceSigmas = val
 		}
-	}
+	})
+}
 
-	return valueInt
+// SetPingRequestTimeoutMultiplier sets Config.PingRequestTimeoutMultiplier.
+// Setting this to 0 will restore the default value.
+func SetPingRequestTimeoutMultiplier(val float64) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.PingRequestTimeoutMultiplier = DefaultPingRequestTimeoutMultiplier
+		} else {
+			c.PingRequestTimeoutMultiplier = val
+		}
+	})
 }
 
-// Gets an environmental variable "key". If it does not exist, "defaultVal" is
-// returned; if it does, it attempts to convert to a string slice, returning
-// "defaultVal" if it fails.
-func getStringArrayVar(key string, defaultVal string) []string {
-	valueString := os.Getenv(key)
+// SetPingHistorySize sets Config.PingHistorySize. It has no effect once
+// Begin() has been called. Setting this to 0 will restore the default value.
+func SetPingHistorySize(val int) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.PingHistorySize = DefaultPingHistorySize
+		} else {
+			c.PingHistorySize = val
+		}
+	})
+}
 
-	if valueString == "" {
-		valueString = defaultVal
-	}
+// SetMaxDeadNodeRetries sets Config.MaxDeadNodeRetries. Setting this to 0
+// will restore the default value.
+func SetMaxDeadNodeRetries(val int) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.MaxDeadNodeRetries = DefaultMaxDeadNodeRetries
+		} else {
+			c.MaxDeadNodeRetries = val
+		}
+	})
+}
+
+// SetReapTimeoutSeconds sets Config.ReapTimeoutSeconds. Setting this to 0
+// will restore the default value.
+func SetReapTimeoutSeconds(val int) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.ReapTimeoutSeconds = DefaultReapTimeoutSeconds
+		} else {
+			c.ReapTimeoutSeconds = val
+		}
+	})
+}
+
+// SetBroadcastRetention sets Config.BroadcastRetention. Values above 128 are
+// reduced to 128. Setting this to 0 will restore the default value.
+func SetBroadcastRetention(val int) {
+	updateProperties(func(c *Config) {
+		switch {
+		case val == 0:
+			c.BroadcastRetention = DefaultBroadcastRetention
+		case val > maxBroadcastRetention:
+			c.BroadcastRetention = maxBroadcastRetention
+		default:
+			c.BroadcastRetention = val
+		}
+	})
+}
+
+// SetAllowedNetworks sets Config.AllowedNetworks.
+func SetAllowedNetworks(val []*net.IPNet) {
+	updateProperties(func(c *Config) {
+		c.AllowedNetworks = append([]*net.IPNet{}, val...)
+	})
+}
 
-	valueSlice := splitDelimmitedString(valueString, stringListDelimitRegex)
+// SetBlockedNetworks sets Config.BlockedNetworks.
+func SetBlockedNetworks(val []*net.IPNet) {
+	updateProperties(func(c *Config) {
+		c.BlockedNetworks = append([]*net.IPNet{}, val...)
+	})
+}
 
-	return valueSlice
+// SetSourceRateLimit sets Config.SourceRateLimit. Negative values are treated
+// as 0.
+func SetSourceRateLimit(val float64) {
+	updateProperties(func(c *Config) {
+		if val < 0 {
+			c.SourceRateLimit = 0
+		} else {
+			c.SourceRateLimit = val
+		}
+	})
+}
+
+// SetSourceRateBurst sets Config.SourceRateBurst. Setting this to 0 will
+// restore the default value.
+func SetSourceRateBurst(val int) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.SourceRateBurst = DefaultSourceRateBurst
+		} else {
+			c.SourceRateBurst = val
+		}
+	})
+}
+
+// SetMaxMembers sets Config.MaxMembers. Negative values are treated as 0.
+func SetMaxMembers(val int) {
+	updateProperties(func(c *Config) {
+		if val < 0 {
+			c.MaxMembers = 0
+		} else {
+			c.MaxMembers = val
+		}
+	})
+}
+
+// SetMaxNewMembers sets Config.MaxNewMembers. Negative values are treated as
+// 0.
+func SetMaxNewMembers(val int) {
+	updateProperties(func(c *Config) {
+		if val < 0 {
+			c.MaxNewMembers = 0
+		} else {
+			c.MaxNewMembers = val
+		}
+	})
+}
+
+// SetNewMembersIntervalMillis sets Config.NewMembersIntervalMillis. Setting
+// this to 0 will restore the default value.
+func SetNewMembersIntervalMillis(val int) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.NewMembersIntervalMillis = DefaultNewMembersIntervalMillis
+		} else {
+			c.NewMembersIntervalMillis = val
+		}
+	})
+}
+
+// SetSnapshotPath sets Config.SnapshotPath. It has no effect once Begin() has
+// been called.
+func SetSnapshotPath(val string) {
+	updateProperties(func(c *Config) {
+		c.SnapshotPath = val
+	})
+}
+
+// SetIsolationThreshold sets Config.IsolationThreshold. Negative values are
+// treated as 0.
+func SetIsolationThreshold(val float64) {
+	updateProperties(func(c *Config) {
+		if val < 0 {
+			c.IsolationThreshold = 0
+		} else {
+			c.IsolationThreshold = val
+		}
+	})
+}
+
+// SetReseedIntervalMillis sets Config.ReseedIntervalMillis. Setting this to 0
+// will restore the default value.
+func SetReseedIntervalMillis(val int) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.ReseedIntervalMillis = DefaultReseedIntervalMillis
+		} else {
+			c.ReseedIntervalMillis = val
+		}
+	})
+}
+
+// SetReseedMaxIntervalMillis sets Config.ReseedMaxIntervalMillis. Setting
+// this to 0 will restore the default value.
+func SetReseedMaxIntervalMillis(val int) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.ReseedMaxIntervalMillis = DefaultReseedMaxIntervalMillis
+		} else {
+			c.ReseedMaxIntervalMillis = val
+		}
+	})
+}
+
+// SetPartitionThreshold sets Config.PartitionThreshold. Negative values are
+// treated as 0.
+func SetPartitionThreshold(val float64) {
+	updateProperties(func(c *Config) {
+		if val < 0 {
+			c.PartitionThreshold = 0
+		} else {
+			c.PartitionThreshold = val
+		}
+	})
+}
+
+// SetPartitionWindowSeconds sets Config.PartitionWindowSeconds. Setting this
+// to 0 will restore the default value.
+func SetPartitionWindowSeconds(val int) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.PartitionWindowSeconds = DefaultPartitionWindowSeconds
+		} else {
+			c.PartitionWindowSeconds = val
+		}
+	})
+}
+
+// SetPartitionRedialTimeoutSeconds sets Config.PartitionRedialTimeoutSeconds.
+// Setting this to 0 will restore the default value.
+func SetPartitionRedialTimeoutSeconds(val int) {
+	updateProperties(func(c *Config) {
+		if val == 0 {
+			c.PartitionRedialTimeoutSeconds = DefaultPartitionRedialTimeoutSeconds
+		} else {
+			c.PartitionRedialTimeoutSeconds = val
+		}
+	})
 }
 
 // Gets an environmental variable "key". If it does not exist, "defaultVal" is
@@ -17,6 +17,7 @@ limitations under the License.
 package smudge
 
 import (
+	"net"
 	"testing"
 )
 
@@ -109,3 +110,24 @@ func TestSplitString3c(t *testing.T) {
 		t.Errorf("len=%d contents=%v\n", len(split), split)
 	}
 }
+
+// Changing the slices returned by the getters mustn't change the
+// configuration in effect.
+func TestGettersReturnCopies(t *testing.T) {
+	defer SetInitialHosts(GetInitialHosts())
+	defer SetListenIP(GetListenIP())
+
+	SetInitialHosts([]string{"10.0.0.1:9999"})
+	SetListenIP(net.IPv4(10, 0, 0, 2).To4())
+
+	GetInitialHosts()[0] = "10.0.0.3:9999"
+	GetListenIP()[3] = 4
+
+	if hosts := GetInitialHosts(); hosts[0] != "10.0.0.1:9999" {
+		t.Errorf("Expected the initial host to be unchanged, found %v", hosts)
+	}
+
+	if ip := GetListenIP(); !ip.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Expected the listen IP to be unchanged, found %v", ip)
+	}
+}
@@ -0,0 +1,510 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Queries emitted by this node that are still collecting responses, keyed
+// on broadcast index.
+var pendingQueries = struct {
+	sync.RWMutex
+	m map[uint32]*QueryResponse
+}{m: make(map[uint32]*QueryResponse)}
+
+var queryHandlers = struct {
+	sync.RWMutex
+	m map[string]QueryHandler
+}{m: make(map[string]QueryHandler)}
+
+// This node's metadata, consulted when evaluating query filters.
+var metadata = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// QueryHandler is the interface that must be implemented to respond to
+// queries emitted by other nodes via the Query() function.
+type QueryHandler interface {
+	// The OnQuery() function is called whenever the node receives a query
+	// with the name the handler was registered for. A nil response with a
+	// nil error means that the node only acknowledges the query; a non-nil
+	// error is returned to the querying node as the response error.
+	OnQuery(from *Node, name string, payload []byte) ([]byte, error)
+}
+
+// QueryFilter restricts the set of nodes that respond to a query.
+type QueryFilter struct {
+	// Statuses restricts responses to nodes that the querying node
+	// currently believes to have one of these statuses. Empty allows any.
+	// Unlike the metadata filter, it isn't sent with the query: it only
+	// hides the acknowledgements and responses of other nodes from the
+	// querying node, whose handlers still run and reply.
+	Statuses []NodeStatus
+
+	// Metadata restricts responses to nodes whose metadata contains each of
+	// these key/value pairs. This is evaluated by the receiving nodes.
+	Metadata map[string]string
+}
+
+// NodeResponse is a single node's response to a query.
+type NodeResponse struct {
+	// From is the responding node.
+	From *Node
+
+	// Payload is the response returned by the node's QueryHandler.
+	Payload []byte
+
+	// Err is non-nil if the node's QueryHandler returned an error.
+	Err error
+}
+
+// QueryResponse collects the acknowledgements and responses to a query
+// emitted by Query(). Each responding node is reported at most once on each
+// channel. Both channels are closed when the query's deadline passes or
+// Close() is called.
+type QueryResponse struct {
+	lock sync.Mutex
+
+	name      string
+	index     uint32
+	deadline  time.Time
+	statuses  []NodeStatus
+	acks      map[string]bool
+	responses map[string]bool
+	ackCh     chan *Node
+	respCh    chan NodeResponse
+	closed    bool
+}
+
+// Acks returns a channel on which each node that received the query is
+// reported.
+func (r *QueryResponse) Acks() <-chan *Node {
+	return r.ackCh
+}
+
+// Close stops collecting responses and closes the ack and response channels.
+// It is called automatically once the query's deadline passes.
+func (r *QueryResponse) Close() {
+	pendingQueries.Lock()
+	delete(pendingQueries.m, r.index)
+	pendingQueries.Unlock()
+
+	r.lock.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.ackCh)
+		close(r.respCh)
+	}
+	r.lock.Unlock()
+}
+
+// Deadline returns the time at which the query stops collecting responses.
+func (r *QueryResponse) Deadline() time.Time {
+	return r.deadline
+}
+
+// Finished returns true once the query has stopped collecting responses.
+func (r *QueryResponse) Finished() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.closed
+}
+
+// Name returns the name of the query.
+func (r *QueryResponse) Name() string {
+	return r.name
+}
+
+// Responses returns a channel on which each node's response is reported.
+func (r *QueryResponse) Responses() <-chan NodeResponse {
+	return r.respCh
+}
+
+// GetMetadata returns the value of this node's metadata entry for key, or an
+// empty string if there is none.
+func GetMetadata(key string) string {
+	metadata.RLock()
+	defer metadata.RUnlock()
+
+	return metadata.m[key]
+}
+
+// SetMetadata sets a metadata entry on this node. Metadata is local to the
+// node and is consulted when deciding whether to respond to a query.
+// Setting an empty value removes the entry.
+func SetMetadata(key, value string) {
+	metadata.Lock()
+	if value == "" {
+		delete(metadata.m, key)
+	} else {
+		metadata.m[key] = value
+	}
+	metadata.Unlock()
+}
+
+// SetQueryHandler sets the QueryHandler whose OnQuery() function will be
+// called whenever this node receives a query with the specified name.
+// Setting a nil handler removes it. Nodes without a handler for a query still
+// acknowledge it, but send no response.
+func SetQueryHandler(name string, handler QueryHandler) {
+	queryHandlers.Lock()
+	if handler == nil {
+		delete(queryHandlers.m, name)
+	} else {
+		queryHandlers.m[name] = handler
+	}
+	queryHandlers.Unlock()
+}
+
+// Query emits a named query to the cluster using the broadcast machinery,
+// and collects the acknowledgements and responses that the receiving nodes
+// send back directly. The filter, which may be nil, restricts which nodes
+// respond. Responses are collected until timeout has elapsed. As with
+// broadcasts, the querying node does not receive its own query, and the
+// encoded name, filter and payload are limited to the maximum broadcast
+// length.
+func Query(name string, payload []byte, filter *QueryFilter, timeout time.Duration) (*QueryResponse, error) {
+	if timeout <= 0 {
+		return nil, errors.New("query timeout must be positive")
+	}
+
+	if filter == nil {
+		filter = &QueryFilter{}
+	}
+
+	bytes, err := encodeQuery(name, filter.Metadata, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the lock until the response is registered, so that an early
+	// answer can't arrive before we know to expect it.
+	pendingQueries.Lock()
+
+	index, err := emitBroadcast(broadcastQuery, bytes)
+	if err != nil {
+		pendingQueries.Unlock()
+		return nil, err
+	}
+
+	// Leave some headroom for nodes that join while the query is running.
+	buffer := 2*knownNodes.length() + 16
+
+	response := &QueryResponse{
+		name:      name,
+		index:     index,
+		deadline:  time.Now().Add(timeout),
+		statuses:  filter.Statuses,
+		acks:      make(map[string]bool),
+		responses: make(map[string]bool),
+		ackCh:     make(chan *Node, buffer),
+		respCh:    make(chan NodeResponse, buffer),
+	}
+
+	pendingQueries.m[index] = response
+	pendingQueries.Unlock()
+
+	time.AfterFunc(timeout, response.Close)
+
+	return response, nil
+}
+
+// Query contents
+// Bytes       Content
+// ------------------------
+// Bytes 00    Name length N
+// Bytes 01-N  Name
+// Byte  N+1   Metadata filter entry count
+// (Per metadata filter entry)
+//
+//	Byte  00    Key length K
+//	Bytes 01-K  Key
+//	Byte  K+1   Value length V
+//	Bytes K+2.. Value
+//
+// Bytes NN-MM Payload
+func encodeQuery(name string, filter map[string]string, payload []byte) ([]byte, error) {
+	if len(name) > 0xFF {
+		return nil, errors.New("query name too long")
+	}
+
+	if len(filter) > 0xFF {
+		return nil, errors.New("too many query metadata filters")
+	}
+
+	size := 2 + len(name) + len(payload)
+	for k, v := range filter {
+		if len(k) > 0xFF || len(v) > 0xFF {
+			return nil, errors.New("query metadata filter too long")
+		}
+
+		size += 2 + len(k) + len(v)
+	}
+
+	bytes := make([]byte, 0, size)
+
+	bytes = append(bytes, byte(len(name)))
+	bytes = append(bytes, name...)
+
+	bytes = append(bytes, byte(len(filter)))
+	for k, v := range filter {
+		bytes = append(bytes, byte(len(k)))
+		bytes = append(bytes, k...)
+		bytes = append(bytes, byte(len(v)))
+		bytes = append(bytes, v...)
+	}
+
+	bytes = append(bytes, payload...)
+
+	return bytes, nil
+}
+
+func decodeQuery(bytes []byte) (string, map[string]string, []byte, error) {
+	// An index pointer
+	p := 0
+
+	readString := func() (string, error) {
+		err := checkLength("query", bytes, p, 1)
+		if err != nil {
+			return "", err
+		}
+
+		length := int(bytes[p])
+		p++
+
+		err = checkLength("query", bytes, p, length)
+		if err != nil {
+			return "", err
+		}
+
+		str := string(bytes[p : p+length])
+		p += length
+
+		return str, nil
+	}
+
+	name, err := readString()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	err = checkLength("query", bytes, p, 1)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	count := int(bytes[p])
+	p++
+
+	filter := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		k, err := readString()
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		v, err := readString()
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		filter[k] = v
+	}
+
+	payload := make([]byte, len(bytes)-p)
+	copy(payload, bytes[p:])
+
+	return name, filter, payload, nil
+}
+
+// matchesMetadata returns true if this node's metadata contains all of the
+// filter's key/value pairs.
+func matchesMetadata(filter map[string]string) bool {
+	metadata.RLock()
+	defer metadata.RUnlock()
+
+	for k, v := range filter {
+		if metadata.m[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// receiveQuery is called by receiveBroadcast when a previously unseen query
+// broadcast is received. If this node passes the query's filter it
+// acknowledges the query and, if it has a handler, queues a call to it that
+// sends the response directly to the query's origin.
+func receiveQuery(broadcast *Broadcast) {
+	name, filter, payload, err := decodeQuery(broadcast.bytes)
+	if err != nil {
+		logWarn(err)
+		return
+	}
+
+	if !matchesMetadata(filter) {
+		return
+	}
+
+	origin := broadcast.Origin()
+
+	ack := newMessage(verbQueryResponse, thisHost, currentHeartbeat())
+	ack.addPayload(broadcast.Index(), payloadAck, nil)
+
+	err = transmitMessageUDP(origin, ack)
+	if err != nil {
+		logError(err)
+	}
+
+	queryHandlers.RLock()
+	handler := queryHandlers.m[name]
+	queryHandlers.RUnlock()
+
+	if handler == nil {
+		return
+	}
+
+	queueHandlerCall(func() {
+		respondToQuery(handler, broadcast, name, payload)
+	})
+}
+
+// Calls the query handler, and sends its response, if any, to the query's
+// origin.
+func respondToQuery(handler QueryHandler, broadcast *Broadcast, name string, payload []byte) {
+	origin := broadcast.Origin()
+
+	response := newMessage(verbQueryResponse, thisHost, currentHeartbeat())
+
+	bytes, err := handler.OnQuery(origin, name, payload)
+	if err == nil {
+		if bytes == nil {
+			return
+		}
+
+		err = checkPayloadLength(bytes)
+	}
+
+	if err != nil {
+		text := []byte(err.Error())
+		if len(text) > GetMaxBroadcastBytes() {
+			text = text[:GetMaxBroadcastBytes()]
+		}
+
+		response.addPayload(broadcast.Index(), payloadError, text)
+	} else {
+		response.addPayload(broadcast.Index(), payloadOK, bytes)
+	}
+
+	err = transmitMessageUDP(origin, response)
+	if err != nil {
+		logError(err)
+	}
+}
+
+func receiveVerbQueryResponseUDP(msg message) error {
+	if msg.payload == nil {
+		return errors.New("QRESPONSE message without payload from " +
+			msg.sender.Address())
+	}
+
+	pendingQueries.RLock()
+	response, ok := pendingQueries.m[msg.payload.id]
+	pendingQueries.RUnlock()
+
+	if !ok {
+		logfDebug("Dropping late or unexpected query response %d from %s",
+			msg.payload.id,
+			msg.sender.Address())
+
+		return nil
+	}
+
+	response.deliver(msg.sender, msg.payload)
+
+	return nil
+}
+
+// deliver reports an acknowledgement or response from the specified node,
+// unless it has already been reported or the node fails the status filter.
+func (r *QueryResponse) deliver(from *Node, payload *messagePayload) {
+	if len(r.statuses) > 0 {
+		match := false
+		for _, s := range r.statuses {
+			if from.Status() == s {
+				match = true
+				break
+			}
+		}
+
+		if !match {
+			return
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	address := from.Address()
+
+	if payload.flags == payloadAck {
+		if r.acks[address] {
+			return
+		}
+		r.acks[address] = true
+
+		select {
+		case r.ackCh <- from:
+		default:
+			logfWarn("Query %s ack buffer full: dropping ack from %s",
+				r.name, address)
+		}
+
+		return
+	}
+
+	if r.responses[address] {
+		return
+	}
+	r.responses[address] = true
+
+	response := NodeResponse{From: from}
+	if payload.flags == payloadError {
+		response.Err = fmt.Errorf("remote error from %s: %s",
+			address, string(payload.bytes))
+	} else {
+		response.Payload = payload.bytes
+	}
+
+	select {
+	case r.respCh <- response:
+	default:
+		logfWarn("Query %s response buffer full: dropping response from %s",
+			r.name, address)
+	}
+}
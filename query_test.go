@@ -0,0 +1,183 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Encode and decode a query with a metadata filter, and see if the
+// input/output match.
+func TestEncodeDecodeQuery(t *testing.T) {
+	filter := map[string]string{"role": "storage", "dc": "east"}
+	payload := []byte("file-x")
+
+	bytes, err := encodeQuery("has-file", filter, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, decodedFilter, decodedPayload, err := decodeQuery(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "has-file" {
+		t.Errorf("Expected name has-file but found %s", name)
+	}
+
+	if !reflect.DeepEqual(filter, decodedFilter) {
+		t.Errorf("Filters do not match: %v vs %v", filter, decodedFilter)
+	}
+
+	if !reflect.DeepEqual(payload, decodedPayload) {
+		t.Errorf("Payloads do not match: %v vs %v", payload, decodedPayload)
+	}
+}
+
+// A truncated query must be rejected rather than decoded.
+func TestDecodeQueryTruncated(t *testing.T) {
+	bytes, _ := encodeQuery("has-file", map[string]string{"role": "storage"}, nil)
+
+	for i := 0; i < len(bytes)-1; i++ {
+		if _, _, _, err := decodeQuery(bytes[:i]); err == nil {
+			t.Errorf("Expected an error decoding %d of %d bytes", i, len(bytes))
+		}
+	}
+}
+
+type echoQueryHandler struct{}
+
+func (echoQueryHandler) OnQuery(from *Node, name string, payload []byte) ([]byte, error) {
+	return append([]byte(name+" "), payload...), nil
+}
+
+// A member that receives a query must acknowledge it and send its handler's
+// response directly to the querying member.
+func TestQueryHandlerLoopback(t *testing.T) {
+	me, cleanup := startLoopbackMember(t)
+	defer cleanup()
+
+	querier, querierNode, closeQuerier := openLoopbackPeer(t)
+	defer closeQuerier()
+
+	SetQueryHandler("echo", echoQueryHandler{})
+	defer SetQueryHandler("echo", nil)
+
+	bytes, err := encodeQuery("echo", nil, []byte("x.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := newMessage(verbPing, querierNode, 1)
+	msg.addBroadcast(&Broadcast{
+		origin: querierNode,
+		index:  1,
+		bytes:  bytes,
+		kind:   broadcastQuery,
+	})
+
+	_, err = querier.WriteToUDP(msg.encode(), udpAddrOf(me))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	querier.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var acked, responded bool
+
+	for !acked || !responded {
+		n, _, err := querier.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Expected an ack and a response (acked=%v, responded=%v): %v",
+				acked, responded, err)
+		}
+
+		reply, err := decodeMessage(me.IP(), buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reply.verb != verbQueryResponse {
+			continue
+		}
+
+		if reply.payload.id != 1 {
+			t.Errorf("Expected query index 1 but found %d", reply.payload.id)
+		}
+
+		switch reply.payload.flags {
+		case payloadAck:
+			acked = true
+		case payloadOK:
+			responded = true
+
+			if string(reply.payload.bytes) != "echo x.dat" {
+				t.Errorf("Expected \"echo x.dat\" but found %q", reply.payload.bytes)
+			}
+		default:
+			t.Errorf("Unexpected query response flags %v", reply.payload.flags)
+		}
+	}
+}
+
+// The acknowledgements and responses sent back to a querying member must be
+// reported on the query's channels.
+func TestQueryResponsesLoopback(t *testing.T) {
+	me, cleanup := startLoopbackMember(t)
+	defer cleanup()
+
+	responder, responderNode, closeResponder := openLoopbackPeer(t)
+	defer closeResponder()
+
+	response, err := Query("echo", []byte("x.dat"), nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Close()
+
+	for _, flags := range []payloadFlags{payloadAck, payloadOK} {
+		msg := newMessage(verbQueryResponse, responderNode, 1)
+		msg.addPayload(response.index, flags, []byte("echo x.dat"))
+
+		_, err = responder.WriteToUDP(msg.encode(), udpAddrOf(me))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case n := <-response.Acks():
+		if n.Address() != responderNode.Address() {
+			t.Errorf("Expected an ack from %s but found %s", responderNode.Address(), n.Address())
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected an ack")
+	}
+
+	select {
+	case r := <-response.Responses():
+		if r.Err != nil || string(r.Payload) != "echo x.dat" {
+			t.Errorf("Expected \"echo x.dat\" but found %q (%v)", r.Payload, r.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected a response")
+	}
+}
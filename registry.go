@@ -19,9 +19,9 @@ package smudge
 import (
 	"fmt"
 	"net"
-	"sort"
 	"strconv"
 	"sync"
+	"time"
 )
 
 // All known nodes, living and dead. Dead nodes are pinged (far) less often,
@@ -29,18 +29,15 @@ import (
 var knownNodes = nodeMap{}
 
 // All nodes that have been updated "recently", living and dead
-var updatedNodes = nodeMap{}
+var updatedNodes = newUpdateQueue()
 
 var deadNodeRetries = struct {
 	sync.RWMutex
 	m map[string]*deadNodeCounter
 }{m: make(map[string]*deadNodeCounter)}
 
-const maxDeadNodeRetries = 10
-
 func init() {
 	knownNodes.init()
-	updatedNodes.init()
 }
 
 /******************************************************************************
@@ -51,33 +48,52 @@ func init() {
 // nodes. Updates the node timestamp but DOES NOT implicitly update the node's
 // status; you need to do this explicitly.
 func AddNode(node *Node) (*Node, error) {
-	if !knownNodes.contains(node) {
-		if node.status == StatusUnknown {
-			logWarn(node.Address(),
-				"does not have a status! Setting to",
-				StatusAlive)
-
-			UpdateNodeStatus(node, StatusAlive, thisHost)
-		} else if node.status == StatusForwardTo {
-			panic("invalid status: " + StatusForwardTo.String())
-		}
+	addNode(node)
 
-		node.Touch()
+	return node, nil
+}
+
+// Adds the node if it isn't already known, returning whether it was added.
+func addNode(node *Node) bool {
+	if knownNodes.contains(node) {
+		return false
+	}
 
-		_, n, err := knownNodes.add(node)
+	if node.Status() == StatusUnknown {
+		logWarn(node.Address(),
+			"does not have a status! Setting to",
+			StatusAlive)
 
-		logfInfo("Adding host: %s (total=%d live=%d dead=%d)",
-			node.Address(),
-			knownNodes.length(),
-			knownNodes.lengthWithStatus(StatusAlive),
-			knownNodes.lengthWithStatus(StatusDead))
+		updateNodeStatus(node, StatusAlive, node.Heartbeat(), thisHost,
+			newStatusCause(ReasonExplicit))
+	} else if node.Status() == StatusForwardTo {
+		panic("invalid status: " + StatusForwardTo.String())
+	}
+
+	node.Touch()
 
-		knownNodesModifiedFlag = true
+	// Another goroutine may have added it in the meantime.
+	added := emitEventOnChange(func() bool {
+		return knownNodes.addIfAbsent(node)
+	}, EventJoin, node, StatusUnknown, node.StatusSource())
 
-		return n, err
+	if !added {
+		return false
 	}
 
-	return node, nil
+	removeTombstone(node)
+
+	logfInfo("Adding host: %s (total=%d live=%d dead=%d)",
+		node.Address(),
+		knownNodes.length(),
+		knownNodes.lengthWithStatus(StatusAlive),
+		knownNodes.lengthWithStatus(StatusDead))
+
+	if node.Address() != thisHostAddress {
+		probes.add(node)
+	}
+
+	return true
 }
 
 // CreateNodeByAddress will create and return a new node when supplied with a
@@ -100,7 +116,7 @@ func CreateNodeByIP(ip net.IP, port uint16) (*Node, error) {
 	node := Node{
 		ip:         ip,
 		port:       port,
-		timestamp:  GetNowInMillis(),
+		timestamp:  time.Now(),
 		pingMillis: PingNoData,
 	}
 
@@ -136,91 +152,67 @@ func GetLocalIP() (net.IP, error) {
 // AllNodes will return a list of all nodes known at the time of the request,
 // including nodes that have been marked as "dead" but haven't yet been
 // removed from the registry.
-func AllNodes() []*Node {
-	return knownNodes.values()
+func AllNodes() []NodeInfo {
+	values := knownNodes.values()
+	infos := make([]NodeInfo, len(values))
+
+	for i, v := range values {
+		infos[i] = v.Info()
+	}
+
+	return infos
 }
 
 // HealthyNodes will return a list of all nodes known at the time of the
 // request with a healthy status.
-func HealthyNodes() []*Node {
+func HealthyNodes() []NodeInfo {
 	values := knownNodes.values()
-	filtered := make([]*Node, 0, len(values))
+	filtered := make([]NodeInfo, 0, len(values))
 
 	for _, v := range values {
-		if v.Status() == StatusAlive {
-			filtered = append(filtered, v)
+		info := v.Info()
+
+		if info.Status == StatusAlive {
+			filtered = append(filtered, info)
 		}
 	}
 
 	return filtered
 }
 
+// LookupNode returns the known node at the specified address ("ip:port"),
+// such as the Address of a NodeInfo returned by AllNodes() or
+// HealthyNodes(), or nil if there is none. The node can be passed to the
+// functions that act on a single node, such as SendTo() and Request(). An
+// error is returned if the address can't be parsed.
+func LookupNode(address string) (*Node, error) {
+	ip, port, err := parseNodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return knownNodes.getByIP(ip, port), nil
+}
+
 // RemoveNode can be used to explicitly remove a node from the list of known
 // live nodes. Updates the node timestamp but DOES NOT implicitly update the
 // node's status; you need to do this explicitly.
 func RemoveNode(node *Node) (*Node, error) {
-	if knownNodes.contains(node) {
-		node.Touch()
-
-		_, n, err := knownNodes.delete(node)
-
-		logfInfo("Removing host: %s (total=%d live=%d dead=%d)",
-			node.Address(),
-			knownNodes.length(),
-			knownNodes.lengthWithStatus(StatusAlive),
-			knownNodes.lengthWithStatus(StatusDead))
-
-		knownNodesModifiedFlag = true
-
-		return n, err
-	}
-
-	return node, nil
+	return removeNode(node, EventLeft)
 }
 
 // UpdateNodeStatus assigns a new status for the specified node and adds it to
 // the list of recently updated nodes. If the status is StatusDead, then the
 // node will be moved from the live nodes list to the dead nodes list.
 func UpdateNodeStatus(node *Node, status NodeStatus, statusSource *Node) {
-	updateNodeStatus(node, status, node.heartbeat, statusSource)
+	updateNodeStatus(node, status, node.Heartbeat(), statusSource,
+		newStatusCause(ReasonExplicit))
 }
 
 /******************************************************************************
  * Private functions (for internal use only)
  *****************************************************************************/
 
-func getRandomUpdatedNodes(size int, exclude ...*Node) []*Node {
-	updatedNodesCopy := nodeMap{}
-	updatedNodesCopy.init()
-
-	// Prune nodes with emit counters of 0 (or less) from the map. Any
-	// others we copy into a secondary nodemap.
-	for _, n := range updatedNodes.values() {
-		if n.emitCounter <= 0 {
-			logDebug("Removing", n.Address(), "from recently updated list")
-			updatedNodes.delete(n)
-		} else {
-			updatedNodesCopy.add(n)
-		}
-	}
-
-	// Exclude the exclusions
-	for _, ex := range exclude {
-		updatedNodesCopy.delete(ex)
-	}
-
-	// Put the newest nodes on top.
-	updatedNodesSlice := updatedNodesCopy.values()
-	sort.Sort(byNodeEmitCounter(updatedNodesSlice))
-
-	// Grab and return the top N
-	if size > len(updatedNodesSlice) {
-		size = len(updatedNodesSlice)
-	}
-
-	return updatedNodesSlice[:size]
-}
-
 func parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
 	var host string
 	var ip net.IP
@@ -276,62 +268,108 @@ func parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
 	return ip, port, err
 }
 
-// UpdateNodeStatus assigns a new status for the specified node and adds it to
-// the list of recently updated nodes. If the status is StatusDead, then the
-// node will be moved from the live nodes list to the dead nodes list.
-func updateNodeStatus(node *Node, status NodeStatus, heartbeat uint32, statusSource *Node) {
-	if node.status != status {
-		if heartbeat < node.heartbeat {
-			logfWarn("Decreasing known node heartbeat value from %d to %d",
-				node.heartbeat,
-				heartbeat)
-		}
+// removeNode removes a node from the list of known nodes, and emits an event
+// of the specified type describing the removal.
+func removeNode(node *Node, eventType EventType) (*Node, error) {
+	if knownNodes.contains(node) {
+		node.Touch()
 
-		node.timestamp = GetNowInMillis()
-		node.status = status
-		node.statusSource = statusSource
-		node.emitCounter = int8(emitCount())
-		node.heartbeat = heartbeat
+		// Another goroutine may have removed it in the meantime.
+		removed := emitEventOnChange(func() bool {
+			return knownNodes.deleteIfPresent(node)
+		}, eventType, node, node.Status(), thisHost)
 
-		// If this isn't in the recently updated list, add it.
-		if !updatedNodes.contains(node) {
-			updatedNodes.add(node)
+		if !removed {
+			return node, nil
 		}
 
-		if status != StatusDead {
-			deadNodeRetries.Lock()
-			delete(deadNodeRetries.m, node.Address())
-			deadNodeRetries.Unlock()
-		}
+		addTombstone(node, node.Heartbeat())
 
-		logfInfo("Updating host: %s to %s (total=%d live=%d dead=%d)",
+		logfInfo("Removing host: %s (total=%d live=%d dead=%d)",
 			node.Address(),
-			status,
 			knownNodes.length(),
 			knownNodes.lengthWithStatus(StatusAlive),
 			knownNodes.lengthWithStatus(StatusDead))
 
-		doStatusUpdate(node, status)
+		probes.remove(node)
+
+		if node.Address() != thisHostAddress {
+			noteIsolationDeparture()
+		}
+
+		return node, nil
 	}
-}
 
-type deadNodeCounter struct {
-	retry          int
-	retryCountdown int
+	return node, nil
 }
 
-// byNodeEmitCounter implements sort.Interface for []*Node based on
-// the emitCounter field.
-type byNodeEmitCounter []*Node
+// UpdateNodeStatus assigns a new status for the specified node and adds it to
+// the list of recently updated nodes. If the status is StatusDead, then the
+// node will be moved from the live nodes list to the dead nodes list. The
+// cause records why the status changed.
+func updateNodeStatus(node *Node, status NodeStatus, heartbeat uint32, statusSource *Node, cause StatusCause) {
+	if cause.Timestamp.IsZero() {
+		cause.Timestamp = time.Now()
+	}
 
-func (a byNodeEmitCounter) Len() int {
-	return len(a)
-}
+	// Calculated before taking the node's lock, as it needs the registry's.
+	emitCounter := int8(emitCount())
+
+	node.lock.Lock()
+
+	if node.status == status {
+		node.lock.Unlock()
+		return
+	}
+
+	previous := node.status
+	previousHeartbeat := node.heartbeat
+
+	node.timestamp = time.Now()
+	node.status = status
+	node.statusSource = statusSource
+	node.statusCause = cause
+	node.emitCounter = emitCounter
+	node.heartbeat = heartbeat
+
+	node.lock.Unlock()
+
+	if heartbeat < previousHeartbeat {
+		logfWarn("Decreasing known node heartbeat value from %d to %d",
+			previousHeartbeat,
+			heartbeat)
+	}
+
+	knownNodes.statusChanged(node)
 
-func (a byNodeEmitCounter) Swap(i, j int) {
-	a[i], a[j] = a[j], a[i]
+	// Queue the update to be piggybacked on outgoing messages.
+	updatedNodes.push(node)
+
+	if status != StatusDead {
+		deadNodeRetries.Lock()
+		delete(deadNodeRetries.m, node.Address())
+		deadNodeRetries.Unlock()
+	}
+
+	logfInfo("Updating host: %s to %s [%v] (total=%d live=%d dead=%d)",
+		node.Address(),
+		status,
+		cause,
+		knownNodes.length(),
+		knownNodes.lengthWithStatus(StatusAlive),
+		knownNodes.lengthWithStatus(StatusDead))
+
+	queueHandlerCall(func() { doStatusUpdate(node, status) })
+
+	// Nodes that aren't yet known are reported by AddNode() instead.
+	if knownNodes.contains(node) {
+		emitEvent(statusEventType(status), node, previous, statusSource)
+	}
+
+	notePartitionStatus(node, previous, status)
 }
 
-func (a byNodeEmitCounter) Less(i, j int) bool {
-	return a[i].emitCounter > a[j].emitCounter
+type deadNodeCounter struct {
+	retry          int
+	retryCountdown int
 }
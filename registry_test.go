@@ -18,6 +18,7 @@ package smudge
 
 import (
 	"testing"
+	"time"
 )
 
 func TestIPv4(t *testing.T) {
@@ -134,3 +135,86 @@ func TestIPv6WithPort(t *testing.T) {
 //
 //	SetListenIP(net.ParseIP("127.0.0.1"))
 //}
+
+// A known node must be found by the address in its NodeInfo, and an unknown
+// one must not.
+func TestLookupNode(t *testing.T) {
+	nodes, cleanup := populateRegistry(2)
+	defer cleanup()
+
+	for _, info := range AllNodes() {
+		if info.Address != nodes[1].Address() {
+			continue
+		}
+
+		node, err := LookupNode(info.Address)
+		if err != nil {
+			t.Fatal(err)
+		} else if node != nodes[1] {
+			t.Errorf("Expected %s to be found", info.Address)
+		}
+	}
+
+	node, err := LookupNode("192.0.2.1:9999")
+	if err != nil || node != nil {
+		t.Errorf("Expected an unknown node not to be found: %v %v", node, err)
+	}
+
+	_, err = LookupNode("not an address")
+	if err == nil {
+		t.Error("Expected an error for a malformed address")
+	}
+}
+
+type blockingStatusListener chan NodeStatus
+
+func (l blockingStatusListener) OnChange(node *Node, status NodeStatus) {
+	l <- status
+}
+
+// A status listener that blocks mustn't stall the status update that it's
+// told of, but must still be told of it.
+func TestBlockedStatusListener(t *testing.T) {
+	_, cleanup := startLoopbackMember(t)
+	defer cleanup()
+
+	nodes, cleanupRegistry := populateRegistry(1)
+	defer cleanupRegistry()
+
+	statusListeners.RLock()
+	listeners := statusListeners.s
+	statusListeners.RUnlock()
+
+	listener := make(blockingStatusListener)
+
+	defer func() {
+		statusListeners.Lock()
+		statusListeners.s = listeners
+		statusListeners.Unlock()
+	}()
+
+	AddStatusListener(listener)
+
+	done := make(chan struct{})
+
+	go func() {
+		updateNodeStatus(nodes[0], StatusSuspected, nodes[0].Heartbeat(), thisHost,
+			newStatusCause(ReasonExplicit))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the status update not to wait for the listener")
+	}
+
+	select {
+	case status := <-listener:
+		if status != StatusSuspected {
+			t.Errorf("Expected the listener to be told of %v, found %v", StatusSuspected, status)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the listener to be called")
+	}
+}
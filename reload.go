@@ -0,0 +1,173 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Set to 1 once Begin() has been called. Only ever accessed atomically.
+var begun uint32
+
+// Held for the whole of a reload, so that concurrent reloads can't compare
+// against, or add the seeds of, each other's configurations.
+var reloadLock sync.Mutex
+
+// Signalled when the properties are reloaded, so that loops that wait on
+// them can pick up the changes straight away.
+var propertiesReloaded = make(chan struct{}, 1)
+
+// RestartRequiredError is returned by Reload() when the new configuration
+// changes fields that only take effect when a member starts. Every other
+// field has been applied.
+type RestartRequiredError struct {
+	// Fields are the configuration file keys of the fields that weren't
+	// applied.
+	Fields []string
+}
+
+func (e *RestartRequiredError) Error() string {
+	return fmt.Sprintf("changes to %s require a restart, and weren't applied",
+		strings.Join(e.Fields, ", "))
+}
+
+// CurrentConfig returns the configuration in effect.
+func CurrentConfig() Config {
+	c := loadedProperties().clone()
+
+	c.LogLevel = GetLogThreshold()
+
+	return c
+}
+
+// Reload applies a new configuration to a running member. All of the fields
+// that can change while it runs are changed together, so the protocol never
+// sees a mixture of the old and new values. Hosts added to InitialHosts are
+// added to the known nodes; hosts removed from it are not forgotten.
+//
+// The fields that can only change when the member starts are ClusterName,
+// ListenIP, ListenPort, MulticastEnabled, MulticastAddress, MulticastPort,
+// PingHistoryFrontload, PingHistorySize and SnapshotPath. If the new
+// configuration changes any of them, they're left as they are, and once the
+// other fields have been applied a *RestartRequiredError naming them is
+// returned.
+//
+// If the configuration is invalid, a *ConfigError is returned and nothing is
+// changed. Before Begin() has been called, Reload() is the same as
+// ApplyConfig().
+func Reload(c Config) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if atomic.LoadUint32(&begun) == 0 {
+		return ApplyConfig(c)
+	}
+
+	current := CurrentConfig()
+
+	if c.ClusterName == "" {
+		c.ClusterName = DefaultClusterName
+	}
+
+	var restart []string
+
+	if c.ClusterName != current.ClusterName {
+		restart = append(restart, "cluster_name")
+	}
+	if !c.ListenIP.Equal(current.ListenIP) {
+		restart = append(restart, "listen_ip")
+	}
+	if c.ListenPort != current.ListenPort {
+		restart = append(restart, "listen_port")
+	}
+	if c.MulticastEnabled != current.MulticastEnabled {
+		restart = append(restart, "multicast_enabled")
+	}
+	if c.MulticastAddress != current.MulticastAddress {
+		restart = append(restart, "multicast_address")
+	}
+	if c.MulticastPort != current.MulticastPort {
+		restart = append(restart, "multicast_port")
+	}
+	if c.PingHistoryFrontload != current.PingHistoryFrontload {
+		restart = append(restart, "ping_history_frontload")
+	}
+	if c.PingHistorySize != current.PingHistorySize {
+		restart = append(restart, "ping_history_size")
+	}
+	if c.SnapshotPath != current.SnapshotPath {
+		restart = append(restart, "snapshot_path")
+	}
+
+	// Leave the fields that need a restart as they are.
+	c.ClusterName = current.ClusterName
+	c.ListenIP = current.ListenIP
+	c.ListenPort = current.ListenPort
+	c.MulticastEnabled = current.MulticastEnabled
+	c.MulticastAddress = current.MulticastAddress
+	c.MulticastPort = current.MulticastPort
+	c.PingHistoryFrontload = current.PingHistoryFrontload
+	c.PingHistorySize = current.PingHistorySize
+	c.SnapshotPath = current.SnapshotPath
+
+	setProperties(c)
+
+	select {
+	case propertiesReloaded <- struct{}{}:
+	default:
+	}
+
+	logInfo("Reloaded configuration")
+
+	// Forget any members that the new networks exclude.
+	evictForbiddenNodes()
+
+	// Add any new seeds.
+	known := make(map[string]bool, len(current.InitialHosts))
+	for _, address := range current.InitialHosts {
+		known[address] = true
+	}
+
+	for _, address := range c.InitialHosts {
+		if known[address] {
+			continue
+		}
+
+		n, err := CreateNodeByAddress(address)
+		if err != nil {
+			logfError("Could not create node %s: %v", address, err)
+		} else if !nodePermitted(n) {
+			logfWarn("Not adding seed %s, whose address isn't permitted", address)
+		} else {
+			AddNode(n)
+		}
+	}
+
+	if len(restart) > 0 {
+		return &RestartRequiredError{Fields: restart}
+	}
+
+	return nil
+}
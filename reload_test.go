@@ -0,0 +1,112 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// Once running, a reload must apply the fields that can change, leave those
+// that can't, and name them in its error.
+func TestReloadRunning(t *testing.T) {
+	ApplyConfig(DefaultLANConfig())
+	defer ApplyConfig(DefaultLANConfig())
+
+	atomic.StoreUint32(&begun, 1)
+	defer atomic.StoreUint32(&begun, 0)
+
+	threshold := GetLogThreshold()
+	defer SetLogThreshold(threshold)
+
+	config := CurrentConfig()
+	config.HeartbeatMillis = 123
+	config.MaxBroadcastBytes = 400
+	config.LogLevel = LogOff
+	config.ClusterName += "-other"
+	config.ListenPort++
+	config.PingHistorySize++
+
+	err := Reload(config)
+
+	rerr, ok := err.(*RestartRequiredError)
+	if !ok {
+		t.Fatalf("Expected a *RestartRequiredError, found %v", err)
+	}
+
+	expected := []string{"cluster_name", "listen_port", "ping_history_size"}
+	if !reflect.DeepEqual(rerr.Fields, expected) {
+		t.Errorf("Expected %v to require a restart, found %v", expected, rerr.Fields)
+	}
+
+	if GetHeartbeatMillis() != 123 || GetMaxBroadcastBytes() != 400 || GetLogThreshold() != LogOff {
+		t.Errorf("Expected the reloadable fields to be applied, found %+v", CurrentConfig())
+	}
+
+	if GetListenPort() == config.ListenPort {
+		t.Errorf("Expected the listen port to be left as it was")
+	}
+
+	if GetClusterName() == config.ClusterName {
+		t.Errorf("Expected the cluster name to be left as it was")
+	}
+
+	config = CurrentConfig()
+	config.HeartbeatMillis = 0
+
+	if _, ok := Reload(config).(*ConfigError); !ok {
+		t.Errorf("Expected an invalid configuration to be rejected")
+	}
+
+	if GetHeartbeatMillis() != 123 {
+		t.Errorf("Expected nothing to be applied from an invalid configuration")
+	}
+}
+
+// Seeds added by a reload must be subject to the reloaded network filters.
+func TestReloadSeedsPermitted(t *testing.T) {
+	ApplyConfig(DefaultLANConfig())
+	defer ApplyConfig(DefaultLANConfig())
+
+	atomic.StoreUint32(&begun, 1)
+	defer atomic.StoreUint32(&begun, 0)
+
+	threshold := GetLogThreshold()
+	defer SetLogThreshold(threshold)
+
+	config := CurrentConfig()
+	config.LogLevel = LogOff
+	config.BlockedNetworks = mustParseNetworks("10.9.0.0/16")
+	config.InitialHosts = []string{"10.9.0.1:9999", "10.8.0.1:9999"}
+
+	err := Reload(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for address, expected := range map[string]bool{"10.9.0.1:9999": false, "10.8.0.1:9999": true} {
+		node, _ := LookupNode(address)
+		if (node != nil) != expected {
+			t.Errorf("Expected %s to be known: %v", address, expected)
+		}
+
+		if node != nil {
+			RemoveNode(node)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// The weight given to each new round-trip time sample in a node's moving
+	// averages. This is the same gain that TCP uses for its RTT estimates.
+	rttSmoothing = 0.125
+
+	// The number of samples a node needs before its own statistics are used
+	// to derive its probe timeouts. Until then, the global estimate is used.
+	minRTTSamples = 3
+)
+
+// RTTStats describes the round-trip times of the direct pings to a node, as
+// returned by Node.RTTStats().
+type RTTStats struct {
+	// Samples is the number of round-trip times recorded for the node.
+	Samples int
+
+	// Last is the most recently recorded round-trip time.
+	Last time.Duration
+
+	// Mean is the exponentially weighted moving average of the round-trip
+	// times.
+	Mean time.Duration
+
+	// StdDev is the exponentially weighted moving standard deviation of the
+	// round-trip times.
+	StdDev time.Duration
+}
+
+// rttEstimator keeps exponentially weighted moving averages of the mean and
+// variance of a node's round-trip times, in milliseconds.
+type rttEstimator struct {
+	samples  int
+	last     float64
+	mean     float64
+	variance float64
+}
+
+func (e *rttEstimator) add(millis float64) {
+	e.samples++
+	e.last = millis
+
+	if e.samples == 1 {
+		// Like TCP, assume a deviation of half the first sample until there
+		// are more.
+		e.mean = millis
+		e.variance = (millis / 2) * (millis / 2)
+		return
+	}
+
+	diff := millis - e.mean
+	incr := rttSmoothing * diff
+
+	e.mean += incr
+	e.variance = (1 - rttSmoothing) * (e.variance + diff*incr)
+}
+
+// Returns the mean modified by the requested number of standard deviations,
+// and whether there are enough samples for it to be used.
+func (e *rttEstimator) nSigma(sigmas float64) (float64, bool) {
+	if e.samples < minRTTSamples {
+		return 0, false
+	}
+
+	return e.mean + sigmas*math.Sqrt(e.variance), true
+}
+
+func (e *rttEstimator) stats() RTTStats {
+	millis := func(m float64) time.Duration {
+		return time.Duration(m * float64(time.Millisecond))
+	}
+
+	return RTTStats{
+		Samples: e.samples,
+		Last:    millis(e.last),
+		Mean:    millis(e.mean),
+		StdDev:  millis(math.Sqrt(e.variance)),
+	}
+}
+
+// Returns how long to wait for a direct ping of the node to be acknowledged:
+// derived from the node's own round-trip times if it has enough of them, or
+// from those of all nodes otherwise.
+func probeTimeoutMillis(node *Node) uint32 {
+	if node != nil {
+		if millis, ok := node.rttNSigma(GetTimeoutToleranceSigmas()); ok {
+			return uint32(millis)
+		}
+	}
+
+	return uint32(pingdata.nSigma(GetTimeoutToleranceSigmas()))
+}
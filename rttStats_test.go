@@ -0,0 +1,82 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Each node's probe timeout must follow its own round-trip times once it has
+// enough of them, so that a slow node doesn't inflate the timeouts of fast
+// ones, and nodes without enough samples must fall back to the global
+// estimate.
+func TestProbeTimeoutPerNode(t *testing.T) {
+	fast := &Node{ip: net.IPv4(10, 0, 0, 1), port: 9999}
+	slow := &Node{ip: net.IPv4(10, 0, 0, 2), port: 9999}
+	unseen := &Node{ip: net.IPv4(10, 0, 0, 3), port: 9999}
+
+	global := probeTimeoutMillis(unseen)
+
+	for i := 0; i < 50; i++ {
+		fast.addRTTSample(150)
+		slow.addRTTSample(2000)
+	}
+
+	if timeout := probeTimeoutMillis(fast); timeout >= global {
+		t.Errorf("Expected fast node's timeout under %dms, found %dms", global, timeout)
+	}
+
+	if timeout := probeTimeoutMillis(slow); timeout <= 2000 {
+		t.Errorf("Expected slow node's timeout over 2000ms, found %dms", timeout)
+	}
+
+	if timeout := probeTimeoutMillis(unseen); timeout != global {
+		t.Errorf("Expected unseen node's timeout of %dms, found %dms", global, timeout)
+	}
+
+	stats := fast.RTTStats()
+	if stats.Samples != 50 || stats.Last != 150*time.Millisecond {
+		t.Errorf("Unexpected fast node stats: %+v", stats)
+	}
+	if stats.Mean < 149*time.Millisecond || stats.Mean > 151*time.Millisecond {
+		t.Errorf("Expected fast node's mean of about 150ms, found %v", stats.Mean)
+	}
+}
+
+// The moving averages must track a change in a node's round-trip times.
+func TestRTTEstimatorConverges(t *testing.T) {
+	var e rttEstimator
+
+	for i := 0; i < 2; i++ {
+		e.add(100)
+	}
+
+	if _, ok := e.nSigma(3); ok {
+		t.Errorf("Expected too few samples after %d", e.samples)
+	}
+
+	for i := 0; i < 100; i++ {
+		e.add(300)
+	}
+
+	mean, ok := e.nSigma(0)
+	if !ok || mean < 299 || mean > 301 {
+		t.Errorf("Expected a mean of about 300ms, found %v", mean)
+	}
+}
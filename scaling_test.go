@@ -0,0 +1,90 @@
+//go:build scaling
+// +build scaling
+
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// The most that the cost of an operation may grow while the cluster grows
+// from the smallest benchmark size to the largest, a hundredfold. The cost
+// of an operation that's linear in the cluster size would grow about as much
+// as the cluster. The registry's heaps and maps only grow twice as deep, so
+// these are allowed four times that, since caches are also less effective.
+const maxScalingFactor = 8
+
+// Returns the cost per operation in a registry of the specified size: the
+// least of several timed runs, to reduce the noise from other goroutines.
+func operationCost(size int, op func(nodes []*Node, i int)) time.Duration {
+	const runs, iterations = 5, 5000
+
+	nodes, cleanup := populateRegistry(size)
+	defer cleanup()
+
+	// Don't charge the collection of the registry's garbage to the
+	// operation.
+	runtime.GC()
+
+	var least time.Duration
+
+	for r := 0; r < runs; r++ {
+		start := time.Now()
+
+		for i := 0; i < iterations; i++ {
+			op(nodes, i)
+		}
+
+		if elapsed := time.Since(start); r == 0 || elapsed < least {
+			least = elapsed
+		}
+	}
+
+	return least / iterations
+}
+
+// The cost of each benchmarked operation must stay within the scaling
+// factor as the cluster grows from the smallest benchmark size to the
+// largest. Since the timings depend on the machine and its load, this is
+// only built with the scaling tag: go test -tags scaling.
+func TestOperationsScaleFlat(t *testing.T) {
+	// The loopback member's transport is shared with the other tests, so
+	// its socket is used rather than swapped out.
+	_, cleanup := startLoopbackMember(t)
+	defer cleanup()
+
+	defer discardOutboundPackets()()
+
+	smallest := benchmarkSizes[0]
+	largest := benchmarkSizes[len(benchmarkSizes)-1]
+
+	for _, o := range scalingOperations {
+		small := operationCost(smallest, o.op)
+		large := operationCost(largest, o.op)
+
+		t.Logf("%s: %.1fx", o.name, float64(large)/float64(small))
+
+		if large > maxScalingFactor*small {
+			t.Errorf("%s: %v per operation with %d members, but %v with %d",
+				o.name, small, smallest, large, largest)
+		}
+	}
+}
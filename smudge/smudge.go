@@ -21,14 +21,24 @@ import (
 	"fmt"
 	"github.com/clockworksoul/smudge"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
+	var configPath string
 	var nodeAddress string
 	var heartbeatMillis int
 	var listenPort int
+	var phiThreshold float64
+	var forceRemoveAddress string
 	var err error
 
+	flag.StringVar(&configPath, "config", "",
+		"A JSON, YAML or TOML configuration file")
+
 	flag.StringVar(&nodeAddress, "node", "", "Initial node")
 
 	flag.IntVar(&listenPort, "port",
@@ -39,20 +49,80 @@ func main() {
 		int(smudge.GetHeartbeatMillis()),
 		"The heartbeat frequency in milliseconds")
 
+	flag.Float64Var(&phiThreshold, "phi", 0,
+		"Use a phi-accrual failure detector with this threshold (0 to use the default detector)")
+
+	flag.StringVar(&forceRemoveAddress, "force-remove", "",
+		"Once joined, remove the member at this address from the whole cluster")
+
 	flag.Parse()
 
-	ip, err := smudge.GetLocalIP()
-	if err != nil {
-		log.Fatal("Could not get local ip:", err)
+	// Loads the configuration file. Flags given explicitly override it.
+	loadConfig := func() (smudge.Config, error) {
+		config, err := smudge.LoadConfigOver(defaultConfig(), configPath)
+		if err != nil {
+			return config, err
+		}
+
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "port":
+				config.ListenPort = listenPort
+			case "hbf":
+				config.HeartbeatMillis = heartbeatMillis
+			}
+		})
+
+		return config, nil
 	}
 
-	smudge.SetLogThreshold(smudge.LogInfo)
-	smudge.SetListenPort(listenPort)
-	smudge.SetHeartbeatMillis(heartbeatMillis)
-	smudge.SetListenIP(ip)
+	if configPath != "" {
+		config, err := loadConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = smudge.ApplyConfig(config)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	if ip.To4() == nil {
-		smudge.SetMaxBroadcastBytes(512) // 512 for IPv6
+		// Reload the configuration file on SIGHUP.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		go func() {
+			for range hup {
+				config, err := loadConfig()
+				if err == nil {
+					err = smudge.Reload(config)
+				}
+
+				if err != nil {
+					log.Println("Reloading", configPath+":", err)
+				} else {
+					log.Println("Reloaded", configPath)
+				}
+			}
+		}()
+	} else {
+		ip, err := smudge.GetLocalIP()
+		if err != nil {
+			log.Fatal("Could not get local ip:", err)
+		}
+
+		smudge.SetLogThreshold(smudge.LogInfo)
+		smudge.SetListenPort(listenPort)
+		smudge.SetHeartbeatMillis(heartbeatMillis)
+		smudge.SetListenIP(ip)
+
+		if ip.To4() == nil {
+			smudge.SetMaxBroadcastBytes(512) // 512 for IPv6
+		}
+	}
+
+	if phiThreshold > 0 {
+		smudge.SetFailureDetector(smudge.NewPhiAccrualFailureDetector(phiThreshold))
 	}
 
 	if nodeAddress != "" {
@@ -65,9 +135,70 @@ func main() {
 		}
 	}
 
+	if forceRemoveAddress != "" {
+		go forceRemove(forceRemoveAddress)
+	}
+
 	if err == nil {
 		smudge.Begin()
 	} else {
 		fmt.Println(err)
 	}
 }
+
+// Returns the configuration that the configuration file is layered over:
+// the preset named by SMUDGE_PROFILE, listening on this host's IP rather
+// than on the loopback address.
+func defaultConfig() smudge.Config {
+	// Any problems with the environment are reported when it's layered
+	// over the file.
+	config, _ := smudge.LoadConfig("")
+
+	ip, err := smudge.GetLocalIP()
+	if err != nil {
+		log.Println("Could not get local ip:", err)
+		return config
+	}
+
+	config.ListenIP = ip
+
+	if ip.To4() == nil {
+		config.MaxBroadcastBytes = 512 // 512 for IPv6
+	}
+
+	return config
+}
+
+// Waits until this member has joined the cluster, so that the removal can be
+// broadcast, and then force-removes the member at the address.
+func forceRemove(address string) {
+	node, err := smudge.CreateNodeByAddress(address)
+	if err != nil {
+		log.Println("Force-removing", address+":", err)
+		return
+	}
+
+	for !joined() {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	err = smudge.ForceRemove(node)
+	if err != nil {
+		log.Println("Force-removing", address+":", err)
+	} else {
+		log.Println("Force-removed", address)
+	}
+}
+
+// Returns whether this member has heard from the cluster: whether it knows of
+// any member, other than itself and its seeds, from another member.
+func joined() bool {
+	for _, n := range smudge.AllNodes() {
+		switch n.StatusCause.Reason {
+		case smudge.ReasonGossip, smudge.ReasonDirectContact:
+			return true
+		}
+	}
+
+	return false
+}
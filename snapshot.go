@@ -0,0 +1,282 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The snapshot file is a log of membership changes, one per line, each a
+// keyword and a value:
+//
+//	self ADDRESS     The address of the member that wrote the file
+//	heartbeat N      The member's heartbeat, recorded periodically
+//	alive ADDRESS    A member has joined
+//	remove ADDRESS   A member has left or been removed
+//
+// Replaying the file gives the members that were known when it was last
+// written. Members that had died are included, as they'd have been retried
+// before being removed; and when a whole cluster loses power, the members
+// that go last will have seen the others die. The file is compacted, by
+// rewriting it with only the known members, once the log has grown well
+// beyond the size of the membership.
+
+// How often this member's heartbeat is recorded.
+const snapshotHeartbeatInterval = 10 * time.Second
+
+// The fewest lines the snapshot file can have before it's compacted.
+const snapshotCompactMinLines = 1024
+
+// snapshot appends membership changes to the snapshot file.
+type snapshot struct {
+	path  string
+	file  *os.File
+	w     *bufio.Writer
+	lines int
+}
+
+// Restores the members recorded in the snapshot file at the path, along with
+// this member's heartbeat, and starts recording membership changes to it
+// until the returned function is called. The restored members are assumed
+// to be alive until probed, so that after a restart this member rejoins its
+// previous peers even if its initial hosts are gone. Those that don't
+// respond are removed as usual.
+func startSnapshot(path string) func() {
+	peers, heartbeat, err := readSnapshot(path)
+	if err != nil {
+		logfError("Could not read snapshot %s: %v", path, err)
+	}
+
+	// The heartbeat is only recorded every snapshotHeartbeatInterval, so it
+	// may have gone on for up to an interval's worth of beats before the
+	// member stopped. Skip past them, so that the statuses this member
+	// announces aren't taken for stale ones.
+	if heartbeat > 0 {
+		beat := time.Duration(GetHeartbeatMillis()) * time.Millisecond
+		advanceHeartbeat(heartbeat + uint32(snapshotHeartbeatInterval/beat) + 1)
+	}
+
+	for _, address := range peers {
+		if address == thisHostAddress {
+			continue
+		}
+
+		node, err := CreateNodeByAddress(address)
+		if err != nil {
+			logfWarn("Could not restore %s from snapshot: %v", address, err)
+			continue
+		}
+
+		if knownNodes.getByIP(node.IP(), node.Port()) != nil {
+			continue
+		}
+
+		updateNodeStatus(node, StatusAlive, 0, thisHost, newStatusCause(ReasonSnapshot))
+		AddNode(node)
+	}
+
+	if len(peers) > 0 {
+		logfInfo("Restored %d members from snapshot %s", len(peers), path)
+	}
+
+	// Subscribe before compacting, so that no change is missed.
+	sub := Events()
+
+	s := &snapshot{path: path}
+
+	err = s.compact()
+	if err != nil {
+		logfError("Could not write snapshot %s: %v", path, err)
+		sub.Unsubscribe()
+		return func() {}
+	}
+
+	go s.run(sub)
+
+	return sub.Unsubscribe
+}
+
+// Records membership changes until the subscription is closed.
+func (s *snapshot) run(sub *EventSubscription) {
+	ticker := time.NewTicker(snapshotHeartbeatInterval)
+	defer ticker.Stop()
+
+	defer func() {
+		if s.file != nil {
+			s.file.Close()
+		}
+	}()
+
+	for {
+		var err error
+
+		select {
+		case e, ok := <-sub.C():
+			if !ok {
+				return
+			}
+
+			// The members known when subscribing were written by compact().
+			if e.Snapshot || e.Node.Address == thisHostAddress {
+				continue
+			}
+
+			switch e.Type {
+			case EventJoin:
+				err = s.append("alive", e.Node.Address)
+			case EventLeft, EventRemoved:
+				err = s.append("remove", e.Node.Address)
+			}
+		case <-ticker.C:
+			err = s.append("heartbeat", strconv.FormatUint(uint64(currentHeartbeat()), 10))
+		}
+
+		if err == nil && s.lines > snapshotCompactMinLines && s.lines > 4*knownNodes.length() {
+			err = s.compact()
+		}
+
+		if err != nil {
+			logfError("Could not write snapshot %s: %v", s.path, err)
+		}
+	}
+}
+
+// Appends a line to the snapshot file.
+func (s *snapshot) append(keyword, value string) error {
+	fmt.Fprintf(s.w, "%s %s\n", keyword, value)
+	s.lines++
+
+	return s.w.Flush()
+}
+
+// Rewrites the snapshot file with only this member and the members that are
+// currently known, replacing it atomically, and reopens it for appending.
+func (s *snapshot) compact() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	tmp := s.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+
+	fmt.Fprintf(w, "self %s\n", thisHostAddress)
+	fmt.Fprintf(w, "heartbeat %d\n", currentHeartbeat())
+	lines := 2
+
+	for _, n := range knownNodes.values() {
+		if n.Address() != thisHostAddress {
+			fmt.Fprintf(w, "alive %s\n", n.Address())
+			lines++
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+
+	f.Close()
+
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.w = bufio.NewWriter(s.file)
+	s.lines = lines
+
+	logfDebug("Compacted snapshot %s to %d lines", s.path, lines)
+
+	return nil
+}
+
+// Replays the snapshot file at the path, returning the addresses of the
+// members that were known when it was last written, sorted, and the
+// highest heartbeat recorded. A missing file is empty; malformed lines, such
+// as one cut short by a crash, are skipped.
+func readSnapshot(path string) ([]string, uint32, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	alive := make(map[string]bool)
+	var heartbeat uint32
+
+	scanner := bufio.NewScanner(f)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			logfWarn("Skipping malformed line %d of snapshot %s", line, path)
+			continue
+		}
+
+		switch fields[0] {
+		case "self":
+			if fields[1] != thisHostAddress {
+				logfInfo("Snapshot %s was written by %s", path, fields[1])
+			}
+		case "heartbeat":
+			h, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				logfWarn("Skipping malformed line %d of snapshot %s", line, path)
+			} else if uint32(h) > heartbeat {
+				heartbeat = uint32(h)
+			}
+		case "alive":
+			alive[fields[1]] = true
+		case "remove":
+			delete(alive, fields[1])
+		default:
+			logfWarn("Skipping malformed line %d of snapshot %s", line, path)
+		}
+	}
+
+	peers := make([]string, 0, len(alive))
+	for address := range alive {
+		peers = append(peers, address)
+	}
+	sort.Strings(peers)
+
+	return peers, heartbeat, scanner.Err()
+}
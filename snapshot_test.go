@@ -0,0 +1,151 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+
+	peers, heartbeat, err := readSnapshot(path)
+	if err != nil || len(peers) != 0 || heartbeat != 0 {
+		t.Errorf("Expected a missing snapshot to be empty, found %v %d %v", peers, heartbeat, err)
+	}
+
+	err = ioutil.WriteFile(path, []byte(`self 10.0.0.1:9999
+heartbeat 40
+alive 10.0.0.3:9999
+alive 10.0.0.2:9999
+alive 10.0.0.4:9999
+remove 10.0.0.4:9999
+heartbeat 52
+heartbeat 7
+alive`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers, heartbeat, err = readSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"10.0.0.2:9999", "10.0.0.3:9999"}
+	if !reflect.DeepEqual(peers, expected) {
+		t.Errorf("Expected peers %v, found %v", expected, peers)
+	}
+
+	if heartbeat != 52 {
+		t.Errorf("Expected heartbeat 52, found %d", heartbeat)
+	}
+}
+
+// A compacted snapshot must replay to the known members, and changes
+// appended to it must be replayed after them.
+func TestSnapshotCompact(t *testing.T) {
+	nodes, cleanup := populateRegistry(3)
+	defer cleanup()
+
+	s := &snapshot{path: filepath.Join(t.TempDir(), "snapshot")}
+
+	err := s.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A member that has since been forgotten without a trace.
+	s.append("alive", "10.1.0.1:9999")
+
+	err = s.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.lines != 2+len(nodes) {
+		t.Errorf("Expected %d lines after compaction, found %d", 2+len(nodes), s.lines)
+	}
+
+	s.append("remove", nodes[0].Address())
+	s.file.Close()
+
+	peers, _, err := readSnapshot(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{nodes[1].Address(), nodes[2].Address()}
+	if !reflect.DeepEqual(peers, expected) {
+		t.Errorf("Expected peers %v, found %v", expected, peers)
+	}
+}
+
+// Starting from a snapshot must rejoin the members it recorded, as alive and
+// restored from it, and skip this member's heartbeat past any that it may
+// have reached after the one recorded.
+func TestStartSnapshotRejoins(t *testing.T) {
+	startLoopbackMember(t)
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	recorded := currentHeartbeat() + 1000
+
+	err := ioutil.WriteFile(path, []byte(fmt.Sprintf(`self %s
+heartbeat %d
+alive 10.2.0.1:9999
+alive 10.2.0.2:9999
+remove 10.2.0.2:9999
+alive 10.2.0.3:9999
+alive %s
+`, thisHostAddress, recorded, thisHostAddress)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := startSnapshot(path)
+	defer stop()
+
+	expected := map[string]bool{"10.2.0.1:9999": true, "10.2.0.2:9999": false, "10.2.0.3:9999": true}
+
+	for address, rejoined := range expected {
+		node, _ := LookupNode(address)
+		if (node != nil) != rejoined {
+			t.Errorf("Expected %s to be rejoined: %v", address, rejoined)
+		}
+
+		if node == nil {
+			continue
+		}
+
+		defer RemoveNode(node)
+
+		if node.Status() != StatusAlive || node.StatusCause().Reason != ReasonSnapshot {
+			t.Errorf("Expected %s to be alive from the snapshot, found %v %v",
+				address, node.Status(), node.StatusCause().Reason)
+		}
+	}
+
+	beat := time.Duration(GetHeartbeatMillis()) * time.Millisecond
+	if min := recorded + uint32(snapshotHeartbeatInterval/beat); currentHeartbeat() <= min {
+		t.Errorf("Expected the heartbeat to be advanced beyond %d, found %d", min, currentHeartbeat())
+	}
+}
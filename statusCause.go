@@ -0,0 +1,157 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StatusReason is a code describing why a node's status last changed.
+type StatusReason byte
+
+const (
+	// ReasonUnknown is the reason of nodes whose status has never changed.
+	ReasonUnknown StatusReason = iota
+
+	// ReasonLocal indicates that this node set its own status.
+	ReasonLocal
+
+	// ReasonExplicit indicates that the status was set through the API; for
+	// example, by UpdateNodeStatus() or by adding a node without a status.
+	ReasonExplicit
+
+	// ReasonDirectContact indicates that a message was received directly
+	// from the node, which is therefore alive.
+	ReasonDirectContact
+
+	// ReasonGossip indicates that the status was reported by another member.
+	ReasonGossip
+
+	// ReasonPingTimeout indicates that a direct PING to the node timed out,
+	// and there were no other nodes available to relay a ping request.
+	ReasonPingTimeout
+
+	// ReasonPingRequestTimeout indicates that a PINGREQ asking a relay node
+	// to ping the node indirectly timed out.
+	ReasonPingRequestTimeout
+
+	// ReasonNFPTimeout indicates that a non-forwarding ping, sent to the
+	// node on behalf of another member's ping request, timed out.
+	ReasonNFPTimeout
+
+	// ReasonSnapshot indicates that the node was restored from the snapshot
+	// file when this member started.
+	ReasonSnapshot
+)
+
+func (r StatusReason) String() string {
+	switch r {
+	case ReasonUnknown:
+		return "UNKNOWN"
+	case ReasonLocal:
+		return "LOCAL"
+	case ReasonExplicit:
+		return "EXPLICIT"
+	case ReasonDirectContact:
+		return "DIRECT_CONTACT"
+	case ReasonGossip:
+		return "GOSSIP"
+	case ReasonPingTimeout:
+		return "PING_TIMEOUT"
+	case ReasonPingRequestTimeout:
+		return "PINGREQ_TIMEOUT"
+	case ReasonNFPTimeout:
+		return "NFP_TIMEOUT"
+	case ReasonSnapshot:
+		return "SNAPSHOT"
+	default:
+		return "UNDEFINED"
+	}
+}
+
+// StatusCause records why a node's status last changed, and the evidence
+// behind the change. Fields that don't apply to the reason are left empty.
+type StatusCause struct {
+	// Reason is the code for what caused the change.
+	Reason StatusReason
+
+	// Probe is the type of the probe that timed out: PING, PINGREQ or NFP.
+	Probe string
+
+	// Timeout is how long the probe was allowed before it timed out.
+	Timeout time.Duration
+
+	// Relays lists the addresses of the nodes that were asked to ping the
+	// node indirectly.
+	Relays []string
+
+	// Requester is the address of the node on whose behalf a non-forwarding
+	// ping was sent.
+	Requester string
+
+	// Reporter is the address of the node whose message reported the status.
+	Reporter string
+
+	// Source is the address of the node that originally stated the status;
+	// the source of the gossip.
+	Source string
+
+	// Timestamp is the local time at which the change was made.
+	Timestamp time.Time
+}
+
+func (c StatusCause) String() string {
+	parts := []string{c.Reason.String()}
+
+	if c.Probe != "" {
+		parts = append(parts, fmt.Sprintf("probe=%s timeout=%v", c.Probe, c.Timeout))
+	}
+
+	if len(c.Relays) > 0 {
+		parts = append(parts, "relays="+strings.Join(c.Relays, ","))
+	}
+
+	if c.Requester != "" {
+		parts = append(parts, "requester="+c.Requester)
+	}
+
+	if c.Reporter != "" {
+		parts = append(parts, "reporter="+c.Reporter)
+	}
+
+	if c.Source != "" {
+		parts = append(parts, "source="+c.Source)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Convenience function. Creates a cause with the specified reason.
+func newStatusCause(reason StatusReason) StatusCause {
+	return StatusCause{Reason: reason}
+}
+
+// Convenience function. Creates a cause describing a timed out probe.
+func newTimeoutCause(reason StatusReason, probe pendingAckType, timeoutMillis uint32) StatusCause {
+	return StatusCause{
+		Reason:  reason,
+		Probe:   probe.String(),
+		Timeout: time.Duration(timeoutMillis) * time.Millisecond,
+	}
+}
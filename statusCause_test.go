@@ -0,0 +1,133 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Checks that the node's cause, and that of the event reporting its new
+// status, have the expected reason.
+func expectCause(t *testing.T, sub *EventSubscription, node *Node, status NodeStatus, reason StatusReason) StatusCause {
+	t.Helper()
+
+	e := waitForEvent(t, sub, statusEventType(status))
+	if e.Node.Address != node.Address() || e.Status != status {
+		t.Fatalf("Expected %s to become %v but found %s %v",
+			node.Address(), status, e.Node.Address, e.Status)
+	}
+
+	if e.Cause.Reason != reason {
+		t.Errorf("Expected the event's cause to be %v but found %v", reason, e.Cause.Reason)
+	}
+
+	cause := node.StatusCause()
+	if cause.Reason != reason {
+		t.Errorf("Expected the node's cause to be %v but found %v", reason, cause.Reason)
+	}
+
+	if !reflect.DeepEqual(cause, e.Cause) {
+		t.Errorf("Expected the event's cause %v to match the node's %v", e.Cause, cause)
+	}
+
+	return cause
+}
+
+// A direct PING that times out with no relays to ask must kill the node, and
+// say so.
+func TestPingTimeoutCause(t *testing.T) {
+	nodes, cleanup := populateRegistry(1)
+	defer cleanup()
+
+	sub := Events()
+	defer sub.Unsubscribe()
+
+	doForwardOnTimeout(&pendingAck{node: nodes[0], packType: packPing}, 150)
+
+	cause := expectCause(t, sub, nodes[0], StatusDead, ReasonPingTimeout)
+	if cause.Probe != "PING" || cause.Timeout.Milliseconds() != 150 {
+		t.Errorf("Expected a 150ms PING probe but found %v", cause)
+	}
+}
+
+// Timed out PINGREQs and NFPs must suspect the node, and say which relays or
+// requester were involved.
+func TestIndirectTimeoutCauses(t *testing.T) {
+	nodes, cleanup := populateRegistry(3)
+	defer cleanup()
+
+	sub := Events()
+	defer sub.Unsubscribe()
+
+	relays := []string{nodes[1].Address(), nodes[2].Address()}
+
+	timeoutPendingAck(&pendingAck{
+		node:          nodes[1],
+		callback:      nodes[0],
+		packType:      packPingReq,
+		relays:        relays,
+		timeoutMillis: 300,
+	})
+
+	cause := expectCause(t, sub, nodes[0], StatusSuspected, ReasonPingRequestTimeout)
+	if cause.Probe != "PINGREQ" || !reflect.DeepEqual(cause.Relays, relays) {
+		t.Errorf("Expected a PINGREQ probe via %v but found %v", relays, cause)
+	}
+
+	timeoutPendingAck(&pendingAck{
+		node:          nodes[1],
+		callback:      nodes[2],
+		packType:      packNFP,
+		timeoutMillis: 100,
+	})
+
+	cause = expectCause(t, sub, nodes[1], StatusSuspected, ReasonNFPTimeout)
+	if cause.Probe != "NFP" || cause.Requester != nodes[2].Address() {
+		t.Errorf("Expected an NFP probe for %s but found %v", nodes[2].Address(), cause)
+	}
+}
+
+// Statuses learned from a message must be attributed to its sender: as
+// direct contact for the sender itself, and as gossip for the members it
+// reports.
+func TestMessageCauses(t *testing.T) {
+	nodes, cleanup := populateRegistry(3)
+	defer cleanup()
+
+	sender, target, source := nodes[0], nodes[1], nodes[2]
+	sender.status = StatusSuspected
+
+	sub := Events()
+	defer sub.Unsubscribe()
+
+	msg := newMessage(verbPing, sender, sender.Heartbeat()+1)
+	msg.addMember(target, StatusSuspected, target.Heartbeat()+1, source)
+
+	updateStatusesFromMessage(msg)
+
+	cause := expectCause(t, sub, sender, StatusAlive, ReasonDirectContact)
+	if cause.Reporter != sender.Address() {
+		t.Errorf("Expected direct contact from %s but found %v", sender.Address(), cause)
+	}
+
+	cause = expectCause(t, sub, target, StatusSuspected, ReasonGossip)
+	if cause.Reporter != sender.Address() || cause.Source != source.Address() {
+		t.Errorf("Expected gossip from %s sourced from %s but found %v",
+			sender.Address(), source.Address(), cause)
+	}
+}
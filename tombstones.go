@@ -0,0 +1,89 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"sync"
+	"time"
+)
+
+// Members that have been removed, keyed on address. Until it's reaped, a
+// tombstone rejects gossip about its member that's no newer than the status
+// the member was removed with, and any gossip that the member isn't alive:
+// otherwise, members that hadn't yet heard of the removal could add it
+// straight back.
+var tombstones = struct {
+	sync.Mutex
+	m map[string]tombstone
+}{m: make(map[string]tombstone)}
+
+type tombstone struct {
+	// Gossip about the member at or before this heartbeat is rejected.
+	heartbeat uint32
+
+	// When the tombstone is reaped.
+	expires time.Time
+}
+
+// Records that the node has been removed, rejecting gossip about it at or
+// before the heartbeat, and reaps any expired tombstones.
+func addTombstone(node *Node, heartbeat uint32) {
+	now := time.Now()
+	timeout := time.Duration(GetReapTimeoutSeconds()) * time.Second
+
+	tombstones.Lock()
+	defer tombstones.Unlock()
+
+	for address, t := range tombstones.m {
+		if !now.Before(t.expires) {
+			delete(tombstones.m, address)
+		}
+	}
+
+	tombstones.m[node.Address()] = tombstone{
+		heartbeat: heartbeat,
+		expires:   now.Add(timeout),
+	}
+}
+
+// Removes the node's tombstone, if it has one, as when it's added again.
+func removeTombstone(node *Node) {
+	tombstones.Lock()
+	delete(tombstones.m, node.Address())
+	tombstones.Unlock()
+}
+
+// Returns whether gossip about the node with the status and heartbeat is
+// stale: the node has an unexpired tombstone, and the gossip either doesn't
+// say that it's alive or is from the same or an earlier heartbeat than its
+// removal. Only a member that's actually returned gets past a tombstone.
+func tombstoned(node *Node, status NodeStatus, heartbeat uint32) bool {
+	tombstones.Lock()
+	defer tombstones.Unlock()
+
+	t, ok := tombstones.m[node.Address()]
+	if !ok {
+		return false
+	}
+
+	if !time.Now().Before(t.expires) {
+		delete(tombstones.m, node.Address())
+		return false
+	}
+
+	return status != StatusAlive || heartbeat <= t.heartbeat
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"testing"
+	"time"
+)
+
+// Once a node has been removed, gossip carrying its old status, or saying
+// that it's anything but alive, mustn't add it back, but gossip that it's
+// alive at a newer heartbeat must.
+func TestTombstoneRejectsStaleGossip(t *testing.T) {
+	nodes, cleanup := populateRegistry(2)
+	defer cleanup()
+
+	removed, reporter := nodes[0], nodes[1]
+	removed.heartbeat = 100
+
+	removeNode(removed, EventRemoved)
+
+	gossip := func(status NodeStatus, heartbeat uint32) {
+		stale := &Node{ip: removed.ip, port: removed.port}
+
+		msg := newMessage(verbPing, reporter, reporter.Heartbeat())
+		msg.addMember(stale, status, heartbeat, reporter)
+
+		updateStatusesFromMessage(msg)
+	}
+
+	gossip(StatusAlive, 99)
+	gossip(StatusAlive, 100)
+
+	if knownNodes.containsByAddress(removed.Address()) {
+		t.Fatal("Expected stale gossip about the removed node to be ignored")
+	}
+
+	gossip(StatusSuspected, 101)
+	gossip(StatusDead, 150)
+
+	if knownNodes.containsByAddress(removed.Address()) {
+		t.Fatal("Expected later gossip that the removed node isn't alive to be ignored")
+	}
+
+	gossip(StatusAlive, 101)
+
+	added := knownNodes.getByAddress(removed.Address())
+	if added == nil {
+		t.Fatal("Expected newer gossip about the removed node to add it")
+	}
+	defer knownNodes.delete(added)
+
+	if tombstoned(added, StatusAlive, 100) {
+		t.Error("Expected the tombstone to be removed when the node was added")
+	}
+}
+
+func TestTombstoneExpiry(t *testing.T) {
+	node, _ := CreateNodeByAddress("127.0.0.1:10146")
+	node.heartbeat = 10
+
+	addTombstone(node, node.Heartbeat())
+
+	if !tombstoned(node, StatusAlive, 10) {
+		t.Fatal("Expected gossip at the removal heartbeat to be stale")
+	}
+
+	if !tombstoned(node, StatusDead, 11) {
+		t.Fatal("Expected gossip of death after the removal heartbeat to be stale")
+	}
+
+	if tombstoned(node, StatusAlive, 11) {
+		t.Error("Expected gossip of life after the removal heartbeat not to be stale")
+	}
+
+	tombstones.Lock()
+	tombstones.m[node.Address()] = tombstone{heartbeat: 10, expires: time.Now()}
+	tombstones.Unlock()
+
+	if tombstoned(node, StatusDead, 10) {
+		t.Error("Expected an expired tombstone to be reaped")
+	}
+}
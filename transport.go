@@ -0,0 +1,276 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// The maximum number of packets sent or received with a single system call,
+// on platforms that support it.
+const udpBatchSize = 32
+
+// The number of outbound packets that may be queued before transmission
+// blocks.
+const outboundQueueSize = 1024
+
+// Big enough to fit 1280 IPv6 UDP message.
+const udpBufferSize = 2048
+
+// The number of received packets that may be queued for processing. Packets
+// that arrive while the queue is full are dropped.
+const inboundQueueSize = 1024
+
+// The number of goroutines that process received packets.
+const receiveWorkerCount = 8
+
+// The number of calls to the user's handlers and listeners that may be queued.
+// Calls made while the queue is full are dropped.
+const handlerQueueSize = 1024
+
+// The number of goroutines that call the user's handlers and listeners.
+const handlerWorkerCount = 4
+
+// The bound listening socket. All outbound traffic is sent from it, so that
+// responses originate from the port that we listen on.
+var udpConn *net.UDPConn
+
+// Packets waiting to be sent by sendUDP.
+var outboundPackets = make(chan outboundPacket, outboundQueueSize)
+
+// Packets waiting to be processed by the receive workers.
+var inboundPackets = make(chan inboundPacket, inboundQueueSize)
+
+// Calls to the user's handlers and listeners, waiting for a handler worker.
+var handlerCalls = make(chan func(), handlerQueueSize)
+
+// Receive buffers, recycled once the packet they hold has been processed.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, udpBufferSize)
+		return &buf
+	},
+}
+
+// outboundPacket is a single encoded message and its destination.
+type outboundPacket struct {
+	addr  *net.UDPAddr
+	bytes []byte
+}
+
+// inboundPacket is a single received packet, held in a pooled buffer.
+type inboundPacket struct {
+	addr      *net.UDPAddr
+	buf       *[]byte
+	size      int
+	multicast bool
+}
+
+// receiveBatch holds the pooled buffers that a batch of packets is read into.
+// It is reused for every read, with the buffers that were filled replaced by
+// fresh ones from the pool.
+type receiveBatch struct {
+	bufs    []*[]byte
+	sizes   []int
+	addrs   []*net.UDPAddr
+	headers batchHeaders
+}
+
+func newReceiveBatch(size int) *receiveBatch {
+	b := &receiveBatch{
+		bufs:  make([]*[]byte, size),
+		sizes: make([]int, size),
+		addrs: make([]*net.UDPAddr, size),
+	}
+
+	for i := range b.bufs {
+		b.bufs[i] = bufferPool.Get().(*[]byte)
+	}
+
+	b.headers = newBatchHeaders(size)
+
+	return b
+}
+
+// Opens the UDP socket that is used for all unicast traffic, both inbound and
+// outbound.
+func openUDP(port int) (*net.UDPConn, error) {
+	listenAddress, err := net.ResolveUDPAddr("udp", ":"+strconv.FormatInt(int64(port), 10))
+	if err != nil {
+		return nil, err
+	}
+
+	/* Now listen at selected port */
+	return net.ListenUDP("udp", listenAddress)
+}
+
+// Reads packets from the socket, in batches where the platform allows, and
+// queues each for the receive workers.
+func listenUDP(c *net.UDPConn) error {
+	defer c.Close()
+
+	batch := newReceiveBatch(udpBatchSize)
+
+	for {
+		n, err := readBatch(c, batch)
+		if err != nil {
+			logError("UDP read error: ", err)
+		}
+
+		for i := 0; i < n; i++ {
+			queueInbound(inboundPacket{
+				addr: batch.addrs[i],
+				buf:  batch.bufs[i],
+				size: batch.sizes[i],
+			})
+
+			// The filled buffer now belongs to the queue.
+			batch.bufs[i] = bufferPool.Get().(*[]byte)
+		}
+	}
+}
+
+// Queues a received packet for the receive workers. Packets from sources
+// over the rate limit are dropped here, before they can take a place in the
+// queue. If the queue is full the packet is dropped and counted, rather than
+// letting the backlog (and the memory it holds) grow without bound.
+func queueInbound(p inboundPacket) {
+	atomic.AddUint64(&metrics.packetsReceived, 1)
+
+	if !allowPacket(p.addr.IP) {
+		bufferPool.Put(p.buf)
+		return
+	}
+
+	select {
+	case inboundPackets <- p:
+	default:
+		atomic.AddUint64(&metrics.packetsDropped, 1)
+		logfTrace("Receive queue full: dropping packet from %v", p.addr)
+
+		bufferPool.Put(p.buf)
+	}
+}
+
+// Processes queued packets until the queue is closed, returning each buffer
+// to the pool once its packet has been handled. The decoders copy anything
+// they retain, so the buffer is free for reuse.
+func receiveWorker() {
+	for p := range inboundPackets {
+		msgBytes := (*p.buf)[0:p.size]
+
+		var err error
+		if p.multicast {
+			err = receiveMulticastUDP(p.addr, msgBytes)
+		} else {
+			err = receiveMessageUDP(p.addr, msgBytes)
+		}
+
+		if err != nil {
+			logError(err)
+		}
+
+		bufferPool.Put(p.buf)
+	}
+}
+
+// Starts the fixed pool of goroutines that process received packets.
+func startReceiveWorkers() {
+	for i := 0; i < receiveWorkerCount; i++ {
+		go receiveWorker()
+	}
+}
+
+// Queues a call to one of the user's handlers or listeners, so that a slow
+// handler can't stall the receive workers, and with them the protocol. If
+// the queue is full the call is dropped and counted.
+func queueHandlerCall(call func()) {
+	select {
+	case handlerCalls <- call:
+	default:
+		dropped := atomic.AddUint64(&metrics.handlerCallsDropped, 1)
+
+		// Warn at powers of two, so that a stalled handler doesn't flood the
+		// log.
+		if dropped&(dropped-1) == 0 {
+			logfWarn("Handler queue full: %d calls dropped", dropped)
+		} else {
+			logDebug("Handler queue full: dropping call")
+		}
+	}
+}
+
+// Makes queued calls to the user's handlers and listeners.
+func handlerWorker() {
+	for call := range handlerCalls {
+		call()
+	}
+}
+
+// Starts the fixed pool of goroutines that call the user's handlers and
+// listeners.
+func startHandlerWorkers() {
+	for i := 0; i < handlerWorkerCount; i++ {
+		go handlerWorker()
+	}
+}
+
+// Sends queued packets from the socket. Whatever has accumulated in the
+// queue by the time the socket is free is sent as a single batch where the
+// platform allows.
+func sendUDP(c *net.UDPConn) {
+	packets := make([]outboundPacket, 0, udpBatchSize)
+
+	for p := range outboundPackets {
+		packets = append(packets[:0], p)
+
+	Drain:
+		for len(packets) < udpBatchSize {
+			select {
+			case p := <-outboundPackets:
+				packets = append(packets, p)
+			default:
+				break Drain
+			}
+		}
+
+		err := writeBatch(c, packets)
+		if err != nil {
+			logError("UDP write error:", err)
+		}
+	}
+}
+
+// Queues encoded message bytes for transmission from the listening socket.
+func queuePacket(addr *net.UDPAddr, bytes []byte) error {
+	if udpConn == nil {
+		return errors.New("cannot send: the UDP socket is not open")
+	}
+
+	outboundPackets <- outboundPacket{addr: addr, bytes: bytes}
+
+	return nil
+}
+
+// Returns the UDP address of a node, without the need for resolution.
+func udpAddrOf(node *Node) *net.UDPAddr {
+	return &net.UDPAddr{IP: node.ip, Port: int(node.port)}
+}
@@ -0,0 +1,256 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file batches UDP sends and receives with the sendmmsg(2) and
+// recvmmsg(2) system calls, so that several pending packets cost a single
+// system call. The syscall package doesn't define the system call numbers
+// for every architecture, so they're defined per architecture alongside.
+
+package smudge
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// The Linux struct mmsghdr.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// batchHeaders holds the message headers, I/O vectors and socket addresses
+// that are passed to recvmmsg(2) for a receiveBatch.
+type batchHeaders struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet6
+}
+
+func newBatchHeaders(size int) batchHeaders {
+	return batchHeaders{
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		names: make([]syscall.RawSockaddrInet6, size),
+	}
+}
+
+// Reads as many packets as are immediately available (at least one) into the
+// batch with a single recvmmsg(2) call. Returns the number of packets read.
+func readBatch(c *net.UDPConn, b *receiveBatch) (int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	h := &b.headers
+
+	for i := range b.bufs {
+		buf := *b.bufs[i]
+
+		h.iovs[i].Base = &buf[0]
+		h.iovs[i].SetLen(len(buf))
+
+		h.hdrs[i] = mmsghdr{}
+		h.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&h.names[i]))
+		h.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet6
+		h.hdrs[i].hdr.Iov = &h.iovs[i]
+		h.hdrs[i].hdr.Iovlen = 1
+	}
+
+	var n int
+	var errno syscall.Errno
+
+	err = rc.Read(func(fd uintptr) bool {
+		for {
+			r, _, e := syscall.Syscall6(sysRecvmmsg, fd,
+				uintptr(unsafe.Pointer(&h.hdrs[0])), uintptr(len(h.hdrs)),
+				0, 0, 0)
+
+			switch e {
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				return false
+			}
+
+			n, errno = int(r), e
+			return true
+		}
+	})
+
+	runtime.KeepAlive(b)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if errno != 0 {
+		return 0, errno
+	}
+
+	for i := 0; i < n; i++ {
+		b.sizes[i] = int(h.hdrs[i].len)
+		b.addrs[i] = rawToUDPAddr(&h.names[i])
+	}
+
+	return n, nil
+}
+
+// Sends all of the packets with as few sendmmsg(2) calls as possible. A
+// packet that can't be sent is logged and skipped.
+func writeBatch(c *net.UDPConn, packets []outboundPacket) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	ipv4Socket := isIPv4Socket(c)
+
+	hdrs := make([]mmsghdr, 0, len(packets))
+	iovs := make([]syscall.Iovec, len(packets))
+	names := make([]syscall.RawSockaddrInet6, len(packets))
+
+	for i, p := range packets {
+		namelen, err := udpAddrToRaw(p.addr, ipv4Socket, &names[i])
+		if err != nil {
+			logError("Cannot send to", p.addr, "->", err)
+			continue
+		}
+
+		if len(p.bytes) > 0 {
+			iovs[i].Base = &p.bytes[0]
+		}
+		iovs[i].SetLen(len(p.bytes))
+
+		var h mmsghdr
+		h.hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		h.hdr.Namelen = namelen
+		h.hdr.Iov = &iovs[i]
+		h.hdr.Iovlen = 1
+
+		hdrs = append(hdrs, h)
+	}
+
+	for len(hdrs) > 0 {
+		var sent int
+		var errno syscall.Errno
+
+		err = rc.Write(func(fd uintptr) bool {
+			for {
+				r, _, e := syscall.Syscall6(sysSendmmsg, fd,
+					uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)),
+					0, 0, 0)
+
+				switch e {
+				case syscall.EINTR:
+					continue
+				case syscall.EAGAIN:
+					return false
+				}
+
+				sent, errno = int(r), e
+				return true
+			}
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// sendmmsg(2) only reports an error if the first message fails; skip
+		// it and carry on with the rest.
+		if errno != 0 {
+			logError("UDP write error:", errno)
+			sent = 1
+		}
+
+		hdrs = hdrs[sent:]
+	}
+
+	runtime.KeepAlive(packets)
+	runtime.KeepAlive(iovs)
+	runtime.KeepAlive(names)
+
+	return nil
+}
+
+// Returns true if the socket is an AF_INET socket, which can only address
+// IPv4 destinations, rather than an AF_INET6 (possibly dual-stack) one.
+func isIPv4Socket(c *net.UDPConn) bool {
+	la, ok := c.LocalAddr().(*net.UDPAddr)
+
+	return ok && la.IP.To4() != nil
+}
+
+// Encodes a UDP address into a raw socket address of the socket's family,
+// returning its length.
+func udpAddrToRaw(addr *net.UDPAddr, ipv4Socket bool, raw *syscall.RawSockaddrInet6) (uint32, error) {
+	// Ports are in network byte order; both supported architectures are
+	// little-endian.
+	port := uint16(addr.Port)
+	netPort := port>>8 | port<<8
+
+	if ipv4Socket {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0, errors.New("IPv6 destination on an IPv4 socket")
+		}
+
+		raw4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(raw))
+		raw4.Family = syscall.AF_INET
+		raw4.Port = netPort
+		copy(raw4.Addr[:], ip)
+
+		return syscall.SizeofSockaddrInet4, nil
+	}
+
+	ip := addr.IP.To16()
+	if ip == nil {
+		return 0, errors.New("invalid destination IP")
+	}
+
+	raw.Family = syscall.AF_INET6
+	raw.Port = netPort
+	copy(raw.Addr[:], ip)
+
+	return syscall.SizeofSockaddrInet6, nil
+}
+
+// Decodes a raw socket address, as filled in by recvmmsg(2).
+func rawToUDPAddr(raw *syscall.RawSockaddrInet6) *net.UDPAddr {
+	port := int(raw.Port>>8 | raw.Port<<8)
+
+	if raw.Family == syscall.AF_INET {
+		raw4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(raw))
+		ip := net.IPv4(raw4.Addr[0], raw4.Addr[1], raw4.Addr[2], raw4.Addr[3])
+
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, raw.Addr[:])
+
+	return &net.UDPAddr{IP: ip, Port: port}
+}
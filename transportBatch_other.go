@@ -0,0 +1,58 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// On platforms without sendmmsg(2) and recvmmsg(2), packets are sent and
+// received one at a time, though still from the one bound socket.
+
+package smudge
+
+import "net"
+
+// batchHeaders holds no state on this platform.
+type batchHeaders struct{}
+
+func newBatchHeaders(size int) batchHeaders {
+	return batchHeaders{}
+}
+
+// Reads a single packet into the batch. Returns the number of packets read.
+func readBatch(c *net.UDPConn, b *receiveBatch) (int, error) {
+	n, addr, err := c.ReadFromUDP(*b.bufs[0])
+	if err != nil {
+		return 0, err
+	}
+
+	b.sizes[0] = n
+	b.addrs[0] = addr
+
+	return 1, nil
+}
+
+// Sends each of the packets in turn. A packet that can't be sent is logged
+// and skipped.
+func writeBatch(c *net.UDPConn, packets []outboundPacket) error {
+	for _, p := range packets {
+		_, err := c.WriteToUDP(p.bytes, p.addr)
+		if err != nil {
+			logError("UDP write error:", err)
+		}
+	}
+
+	return nil
+}
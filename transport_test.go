@@ -0,0 +1,71 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Send a batch of packets from a socket to itself, and check that they all
+// arrive intact and from the sending socket's own port.
+func TestBatchLoopback(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	self := c.LocalAddr().(*net.UDPAddr)
+
+	packets := make([]outboundPacket, 8)
+	for i := range packets {
+		packets[i] = outboundPacket{addr: self, bytes: []byte{byte(i), 1, 2, 3}}
+	}
+
+	err = writeBatch(c, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+
+	batch := newReceiveBatch(udpBatchSize)
+	received := 0
+
+	for received < len(packets) {
+		n, err := readBatch(c, batch)
+		if err != nil {
+			t.Fatalf("Read %d of %d packets: %v", received, len(packets), err)
+		}
+
+		for i := 0; i < n; i++ {
+			buf := *batch.bufs[i]
+
+			if batch.sizes[i] != 4 || buf[0] != byte(received) {
+				t.Errorf("Unexpected packet %v", buf[:batch.sizes[i]])
+			}
+
+			if batch.addrs[i].Port != self.Port || !batch.addrs[i].IP.Equal(self.IP) {
+				t.Errorf("Expected source %v but found %v", self, batch.addrs[i])
+			}
+
+			received++
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// updateQueue holds the recently updated nodes whose statuses are still to
+// be piggybacked on outgoing messages, in a max-heap ordered on their emit
+// counters so that the newest updates are taken first without sorting.
+type updateQueue struct {
+	sync.Mutex
+
+	entries []updateEntry
+
+	// Each queued node's position in entries, keyed on address.
+	positions map[string]int
+}
+
+type updateEntry struct {
+	node *Node
+
+	// The node's emit counter when it was queued.
+	priority int8
+}
+
+func newUpdateQueue() *updateQueue {
+	return &updateQueue{positions: make(map[string]int)}
+}
+
+// Queues a node whose status has been updated, or moves it to reflect its
+// new emit counter if it's already queued.
+func (q *updateQueue) push(node *Node) {
+	q.Lock()
+	q.pushLocked(node)
+	q.Unlock()
+}
+
+func (q *updateQueue) pushLocked(node *Node) {
+	h := updateHeap{q}
+
+	if i, ok := q.positions[node.Address()]; ok {
+		q.entries[i] = updateEntry{node: node, priority: node.EmitCounter()}
+		heap.Fix(h, i)
+	} else {
+		heap.Push(h, updateEntry{node: node, priority: node.EmitCounter()})
+	}
+}
+
+// Removes and returns up to size of the queued nodes with the highest emit
+// counters, other than the exclusions. Nodes whose counters have run out
+// are dropped from the queue. Once their updates have been sent, the nodes
+// should be returned with requeue().
+func (q *updateQueue) take(size int, exclude ...*Node) []*Node {
+	q.Lock()
+	defer q.Unlock()
+
+	h := updateHeap{q}
+
+	taken := make([]*Node, 0, size)
+	var excluded []*Node
+
+	for len(taken) < size && len(q.entries) > 0 {
+		n := heap.Pop(h).(updateEntry).node
+
+		switch {
+		case n.EmitCounter() <= 0:
+			logDebug("Removing", n.Address(), "from recently updated list")
+		case isExcluded(n, exclude):
+			excluded = append(excluded, n)
+		default:
+			taken = append(taken, n)
+		}
+	}
+
+	for _, n := range excluded {
+		q.pushLocked(n)
+	}
+
+	return taken
+}
+
+// Returns nodes obtained from take() to the queue, unless their emit counters
+// have run out.
+func (q *updateQueue) requeue(nodes []*Node) {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, n := range nodes {
+		if n.EmitCounter() > 0 {
+			q.pushLocked(n)
+		}
+	}
+}
+
+func (q *updateQueue) length() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.entries)
+}
+
+// updateHeap implements heap.Interface for an updateQueue's entries, keeping
+// the positions map current.
+type updateHeap struct {
+	q *updateQueue
+}
+
+func (h updateHeap) Len() int {
+	return len(h.q.entries)
+}
+
+func (h updateHeap) Less(i, j int) bool {
+	return h.q.entries[i].priority > h.q.entries[j].priority
+}
+
+func (h updateHeap) Swap(i, j int) {
+	e := h.q.entries
+	e[i], e[j] = e[j], e[i]
+	h.q.positions[e[i].node.Address()] = i
+	h.q.positions[e[j].node.Address()] = j
+}
+
+func (h updateHeap) Push(x interface{}) {
+	entry := x.(updateEntry)
+	h.q.positions[entry.node.Address()] = len(h.q.entries)
+	h.q.entries = append(h.q.entries, entry)
+}
+
+func (h updateHeap) Pop() interface{} {
+	old := h.q.entries
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = updateEntry{}
+	h.q.entries = old[:n-1]
+	delete(h.q.positions, entry.node.Address())
+
+	return entry
+}
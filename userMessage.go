@@ -0,0 +1,235 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoRequestHandler is returned by Request() when the remote node has no
+// RequestHandler to respond to the request.
+var ErrNoRequestHandler = errors.New("remote node has no request handler")
+
+// The ID counter value for the next request.
+var requestCounter uint32
+
+// Requests awaiting a response, keyed on the address of the node they were
+// sent to and the request ID. IDs are sequential, so a response is only
+// accepted from the node that the request was sent to.
+var pendingRequests = struct {
+	sync.Mutex
+	m map[requestKey]chan *messagePayload
+}{m: make(map[requestKey]chan *messagePayload)}
+
+type requestKey struct {
+	address string
+	id      uint32
+}
+
+var requestHandler = struct {
+	sync.RWMutex
+	h RequestHandler
+}{}
+
+// RequestHandler is the interface that must be implemented to respond to
+// requests emitted by other nodes via the Request() function.
+type RequestHandler interface {
+	// The OnRequest() function is called whenever the node receives a
+	// request. The returned bytes are sent back to the requesting node; a
+	// non-nil error is returned to the requester as a Request() error.
+	OnRequest(from *Node, payload []byte) ([]byte, error)
+}
+
+// SetRequestHandler sets the RequestHandler whose OnRequest() function will
+// be called whenever this node receives a request from another node. Only
+// one handler may be set at a time; setting nil removes it.
+func SetRequestHandler(handler RequestHandler) {
+	requestHandler.Lock()
+	requestHandler.h = handler
+	requestHandler.Unlock()
+}
+
+// SendTo transmits a short payload directly to a single node, which will
+// be passed to that node's MessageListeners. Delivery is not confirmed and
+// is not retried. The maximum payload length is the same as for broadcasts.
+func SendTo(node *Node, payload []byte) error {
+	err := checkPayloadLength(payload)
+	if err != nil {
+		return err
+	}
+
+	msg := newMessage(verbUserMessage, thisHost, currentHeartbeat())
+	msg.addPayload(0, payloadOK, payload)
+
+	return transmitMessageUDP(node, msg)
+}
+
+// Request transmits a short payload directly to a single node and waits for
+// the response returned by that node's RequestHandler. It returns when the
+// response arrives or the context is done, whichever comes first. Only a
+// response from the node itself is accepted. The maximum payload length is
+// the same as for broadcasts.
+func Request(ctx context.Context, node *Node, payload []byte) ([]byte, error) {
+	err := checkPayloadLength(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	id := atomic.AddUint32(&requestCounter, 1)
+	key := requestKey{address: node.Address(), id: id}
+	ch := make(chan *messagePayload, 1)
+
+	pendingRequests.Lock()
+	pendingRequests.m[key] = ch
+	pendingRequests.Unlock()
+
+	defer func() {
+		pendingRequests.Lock()
+		delete(pendingRequests.m, key)
+		pendingRequests.Unlock()
+	}()
+
+	msg := newMessage(verbRequest, thisHost, currentHeartbeat())
+	msg.addPayload(id, payloadOK, payload)
+
+	err = transmitMessageUDP(node, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-ch:
+		switch response.flags {
+		case payloadNoHandler:
+			return nil, ErrNoRequestHandler
+		case payloadError:
+			return nil, fmt.Errorf("remote error from %s: %s",
+				node.Address(), string(response.bytes))
+		default:
+			return response.bytes, nil
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func checkPayloadLength(payload []byte) error {
+	if len(payload) > GetMaxBroadcastBytes() {
+		return fmt.Errorf("payload length exceeds %d bytes",
+			GetMaxBroadcastBytes())
+	}
+
+	return nil
+}
+
+func receiveVerbUserMessageUDP(msg message) error {
+	if msg.payload == nil {
+		return errors.New("USER message without payload from " +
+			msg.sender.Address())
+	}
+
+	sender, payload := msg.sender, msg.payload.bytes
+
+	queueHandlerCall(func() {
+		doMessageUpdate(sender, payload)
+	})
+
+	return nil
+}
+
+func receiveVerbRequestUDP(msg message) error {
+	if msg.payload == nil {
+		return errors.New("REQUEST message without payload from " +
+			msg.sender.Address())
+	}
+
+	requestHandler.RLock()
+	handler := requestHandler.h
+	requestHandler.RUnlock()
+
+	if handler == nil {
+		response := newMessage(verbResponse, thisHost, currentHeartbeat())
+		response.addPayload(msg.payload.id, payloadNoHandler, nil)
+
+		return transmitMessageUDP(msg.sender, response)
+	}
+
+	sender, payload := msg.sender, msg.payload
+
+	queueHandlerCall(func() {
+		err := respondToRequest(handler, sender, payload)
+		if err != nil {
+			logError(err)
+		}
+	})
+
+	return nil
+}
+
+// Calls the request handler, and sends its response to the requester.
+func respondToRequest(handler RequestHandler, sender *Node, payload *messagePayload) error {
+	bytes, err := handler.OnRequest(sender, payload.bytes)
+
+	if err == nil {
+		err = checkPayloadLength(bytes)
+	}
+
+	response := newMessage(verbResponse, thisHost, currentHeartbeat())
+
+	if err != nil {
+		text := []byte(err.Error())
+		if len(text) > GetMaxBroadcastBytes() {
+			text = text[:GetMaxBroadcastBytes()]
+		}
+
+		response.addPayload(payload.id, payloadError, text)
+	} else {
+		response.addPayload(payload.id, payloadOK, bytes)
+	}
+
+	return transmitMessageUDP(sender, response)
+}
+
+func receiveVerbResponseUDP(msg message) error {
+	if msg.payload == nil {
+		return errors.New("RESPONSE message without payload from " +
+			msg.sender.Address())
+	}
+
+	key := requestKey{address: msg.sender.Address(), id: msg.payload.id}
+
+	pendingRequests.Lock()
+	ch, ok := pendingRequests.m[key]
+	delete(pendingRequests.m, key)
+	pendingRequests.Unlock()
+
+	if !ok {
+		logfDebug("Dropping unexpected response %d from %s",
+			msg.payload.id,
+			msg.sender.Address())
+
+		return nil
+	}
+
+	ch <- msg.payload
+
+	return nil
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type echoRequestHandler struct{}
+
+func (echoRequestHandler) OnRequest(from *Node, payload []byte) ([]byte, error) {
+	return append([]byte("echo "), payload...), nil
+}
+
+type channelMessageListener chan []byte
+
+func (l channelMessageListener) OnMessage(from *Node, payload []byte) {
+	l <- payload
+}
+
+// A request sent over the network must be answered by the receiving
+// member's handler, or fail when it has none or the context is done first.
+func TestRequestLoopback(t *testing.T) {
+	me, cleanup := startLoopbackMember(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := Request(ctx, me, []byte("ping"))
+	if !errors.Is(err, ErrNoRequestHandler) {
+		t.Errorf("Expected ErrNoRequestHandler but found %v", err)
+	}
+
+	SetRequestHandler(echoRequestHandler{})
+	defer SetRequestHandler(nil)
+
+	response, err := Request(ctx, me, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(response) != "echo ping" {
+		t.Errorf("Expected \"echo ping\" but found %q", response)
+	}
+
+	// A member that never answers.
+	_, silent, closePeer := openLoopbackPeer(t)
+	defer closePeer()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = Request(ctx, silent, []byte("ping"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded but found %v", err)
+	}
+}
+
+// A response must only be accepted from the member that the request was
+// sent to, whatever its request ID.
+func TestRequestIgnoresOtherResponders(t *testing.T) {
+	me, cleanup := startLoopbackMember(t)
+	defer cleanup()
+
+	target, targetNode, closeTarget := openLoopbackPeer(t)
+	defer closeTarget()
+
+	forger, forgerNode, closeForger := openLoopbackPeer(t)
+	defer closeForger()
+
+	type result struct {
+		bytes []byte
+		err   error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		b, err := Request(ctx, targetNode, []byte("ping"))
+		done <- result{b, err}
+	}()
+
+	buf := make([]byte, 1024)
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, _, err := target.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := decodeMessage(me.IP(), buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	} else if request.verb != verbRequest || request.payload == nil {
+		t.Fatalf("Expected a request but found %v", request.verb)
+	}
+
+	respond := func(from *Node, text string) {
+		msg := newMessage(verbResponse, from, 1)
+		msg.addPayload(request.payload.id, payloadOK, []byte(text))
+
+		conn := forger
+		if from == targetNode {
+			conn = target
+		}
+
+		_, err := conn.WriteToUDP(msg.encode(), udpAddrOf(me))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	respond(forgerNode, "forged")
+	time.Sleep(50 * time.Millisecond)
+	respond(targetNode, "genuine")
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	} else if !bytes.Equal(r.bytes, []byte("genuine")) {
+		t.Errorf("Expected the target's response but found %q", r.bytes)
+	}
+}
+
+// A payload sent to a member must be passed to its message listeners.
+func TestSendToLoopback(t *testing.T) {
+	me, cleanup := startLoopbackMember(t)
+	defer cleanup()
+
+	messageListeners.RLock()
+	listeners := messageListeners.s
+	messageListeners.RUnlock()
+
+	defer func() {
+		messageListeners.Lock()
+		messageListeners.s = listeners
+		messageListeners.Unlock()
+	}()
+
+	listener := make(channelMessageListener, 1)
+	AddMessageListener(listener)
+
+	err := SendTo(me, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case payload := <-listener:
+		if string(payload) != "hello" {
+			t.Errorf("Expected \"hello\" but found %q", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the payload to be delivered")
+	}
+}
+
+type blockingMessageListener chan struct{}
+
+func (l blockingMessageListener) OnMessage(from *Node, payload []byte) {
+	<-l
+}
+
+// Listeners that block mustn't stall the receive workers: requests must
+// still be answered while every receive worker's worth of messages waits.
+func TestBlockedListenerDoesNotStallProtocol(t *testing.T) {
+	me, cleanup := startLoopbackMember(t)
+	defer cleanup()
+
+	messageListeners.RLock()
+	listeners := messageListeners.s
+	messageListeners.RUnlock()
+
+	listener := make(blockingMessageListener)
+
+	defer func() {
+		close(listener)
+
+		messageListeners.Lock()
+		messageListeners.s = listeners
+		messageListeners.Unlock()
+	}()
+
+	AddMessageListener(listener)
+
+	for i := 0; i <= receiveWorkerCount; i++ {
+		err := SendTo(me, []byte("block"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := Request(ctx, me, []byte("ping"))
+	if !errors.Is(err, ErrNoRequestHandler) {
+		t.Errorf("Expected ErrNoRequestHandler but found %v", err)
+	}
+}